@@ -34,7 +34,7 @@ echo "Got access_token: $ACCESS_TOKEN"
 info "Create function with Python snippet"
 CREATE_FUNC_RESPONSE=$(curl -s -X POST -H "Content-Type: application/json" \
   -H "Authorization: Bearer ${ACCESS_TOKEN}" \
-  -d '{"owner":"alice","code":"print(\"SWAPD\")","language":"python"}' \
+  -d '{"code":"import json, os, sys\nevent = json.load(sys.stdin)\nprint(\"SWAPD\")\njson.dump({\"hello\": event[\"name\"]}, open(os.environ[\"RESULT_PATH\"], \"w\"))","language":"python"}' \
   "${BASE_URL}/functions")
 
 echo "CREATE_FUNC_RESPONSE: $CREATE_FUNC_RESPONSE"
@@ -46,9 +46,30 @@ if [[ -z "$FUNCTION_ID" || "$FUNCTION_ID" == "null" ]]; then
 fi
 echo "Function ID: $FUNCTION_ID"
 
+info "Waiting for version 1 to build"
+while true; do
+  VERSION_INFO=$(curl -s -H "Authorization: Bearer ${ACCESS_TOKEN}" \
+    "${BASE_URL}/functions/${FUNCTION_ID}/versions/1")
+
+  BUILD_STATUS=$(echo "$VERSION_INFO" | jq -r '.BuildStatus')
+  echo "Current build status: $BUILD_STATUS"
+
+  if [[ "$BUILD_STATUS" == "ready" ]]; then
+    break
+  fi
+  if [[ "$BUILD_STATUS" == "failed" ]]; then
+    echo "ERROR: Build failed!"
+    echo "$VERSION_INFO" | jq -r '.BuildError, .BuildLog'
+    exit 1
+  fi
+
+  sleep 2
+done
+
 info "Execute function: $FUNCTION_ID"
-EXEC_RESPONSE=$(curl -s -X POST \
+EXEC_RESPONSE=$(curl -s -X POST -H "Content-Type: application/json" \
   -H "Authorization: Bearer ${ACCESS_TOKEN}" \
+  -d '{"name":"world"}' \
   "${BASE_URL}/functions/${FUNCTION_ID}/execute")
 
 echo "EXEC_RESPONSE: $EXEC_RESPONSE"
@@ -79,3 +100,7 @@ while true; do
 done
 
 
+
+info "Fetch job logs as Server-Sent Events"
+curl -sN -H "Authorization: Bearer ${ACCESS_TOKEN}" \
+  "${BASE_URL}/jobs/${JOB_ID}/logs?follow=true"
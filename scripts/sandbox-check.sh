@@ -0,0 +1,146 @@
+#!/usr/bin/env bash
+#
+# Runs a probe function through the stack and checks every restriction of
+# the function container sandbox against the local Docker daemon. Expects the
+# services to be up, as for e2e.sh.
+
+BASE_URL="http://localhost:8080"
+
+info() {
+  echo -e "\n=== $1 ==="
+}
+
+FAILED=0
+
+# expect <description> <jq filter over the probe report that must be true>
+expect() {
+  if [[ "$(echo "$REPORT" | jq -r "$2")" == "true" ]]; then
+    echo "PASS: $1"
+  else
+    echo "FAIL: $1"
+    FAILED=1
+  fi
+}
+
+RANDOM_PART=$((RANDOM % 10000))
+USER_EMAIL="sandbox${RANDOM_PART}@example.com"
+USER_PASS="secretpass"
+
+info "Register and log in: $USER_EMAIL"
+curl -s -X POST -H "Content-Type: application/json" \
+  -d "{\"email\":\"${USER_EMAIL}\",\"password\":\"${USER_PASS}\"}" \
+  "${BASE_URL}/auth/register" > /dev/null
+
+LOGIN_RESPONSE=$(curl -s -X POST -H "Content-Type: application/json" \
+  -d "{\"email\":\"${USER_EMAIL}\",\"password\":\"${USER_PASS}\"}" \
+  "${BASE_URL}/auth/login")
+
+ACCESS_TOKEN=$(echo "$LOGIN_RESPONSE" | jq -r '.access_token')
+if [[ -z "$ACCESS_TOKEN" || "$ACCESS_TOKEN" == "null" ]]; then
+  echo "ERROR: Failed to obtain access_token!"
+  exit 1
+fi
+
+read -r -d '' PROBE <<'EOF'
+import ctypes, json, os
+
+report = {"uid": os.getuid()}
+
+status = {}
+for line in open("/proc/self/status"):
+    key, _, value = line.partition(":")
+    status[key] = value.strip()
+report["cap_eff"] = status["CapEff"]
+report["no_new_privs"] = status["NoNewPrivs"]
+report["seccomp"] = status["Seccomp"]
+
+try:
+    open("/rootfs-probe", "w")
+    report["rootfs_writable"] = True
+except OSError:
+    report["rootfs_writable"] = False
+
+# /tmp must fill up long before 1 GB
+written = 0
+try:
+    with open("/tmp/fill", "wb") as f:
+        for _ in range(1024):
+            f.write(b"\0" * (1 << 20))
+            written += 1
+except OSError:
+    pass
+os.remove("/tmp/fill")
+report["tmp_written_mb"] = written
+
+# unshare(CLONE_NEWUSER) needs no capability, so only seccomp stops it
+libc = ctypes.CDLL(None, use_errno=True)
+report["unshare_allowed"] = libc.unshare(0x10000000) == 0
+
+report["interfaces"] = [line.split(":")[0].strip() for line in open("/proc/net/dev").readlines()[2:]]
+
+json.dump(report, open(os.environ["RESULT_PATH"], "w"))
+EOF
+
+# probe <network_access> creates a function running PROBE and prints the
+# report it produced
+probe() {
+  local body
+  body=$(jq -n --arg code "$PROBE" --argjson net "$1" \
+    '{code: $code, language: "python", network_access: $net}')
+  local fn_id
+  fn_id=$(curl -s -X POST -H "Content-Type: application/json" \
+    -H "Authorization: Bearer ${ACCESS_TOKEN}" \
+    -d "$body" "${BASE_URL}/functions" | jq -r '.function_id')
+  if [[ -z "$fn_id" || "$fn_id" == "null" ]]; then
+    echo "ERROR: Could not create probe function!" >&2
+    exit 1
+  fi
+
+  local build_status=""
+  until [[ "$build_status" == "ready" ]]; do
+    sleep 1
+    build_status=$(curl -s -H "Authorization: Bearer ${ACCESS_TOKEN}" \
+      "${BASE_URL}/functions/${fn_id}/versions/1" | jq -r '.BuildStatus')
+    if [[ "$build_status" == "failed" ]]; then
+      echo "ERROR: probe function failed to build!" >&2
+      exit 1
+    fi
+  done
+
+  local job
+  job=$(curl -s -X POST -H "Content-Type: application/json" \
+    -H "Authorization: Bearer ${ACCESS_TOKEN}" \
+    -d 'null' "${BASE_URL}/functions/${fn_id}/invoke?timeout=30s")
+  if [[ "$(echo "$job" | jq -r '.Status')" != "done" ]]; then
+    echo "ERROR: probe did not finish:" >&2
+    echo "$job" | jq . >&2
+    exit 1
+  fi
+  echo "$job" | jq -c '.Output'
+}
+
+info "Probe the default sandbox"
+REPORT=$(probe false) || exit 1
+echo "$REPORT" | jq .
+
+expect "runs as a non-root user" '.uid != 0'
+expect "has no effective capabilities" '.cap_eff == "0000000000000000"'
+expect "cannot gain privileges" '.no_new_privs == "1"'
+expect "runs under a seccomp filter" '.seccomp == "2"'
+expect "seccomp blocks unshare" '.unshare_allowed == false'
+expect "root filesystem is read-only" '.rootfs_writable == false'
+expect "/tmp is size-limited" '.tmp_written_mb > 0 and .tmp_written_mb < 1024'
+expect "has no network" '.interfaces == ["lo"]'
+
+info "Probe a function that opted in to networking"
+REPORT=$(probe true) || exit 1
+echo "$REPORT" | jq .
+
+expect "has a network" '.interfaces | any(. != "lo")'
+expect "still runs as a non-root user" '.uid != 0'
+
+if [[ "$FAILED" != 0 ]]; then
+  info "Sandbox check FAILED"
+  exit 1
+fi
+info "Sandbox check passed"
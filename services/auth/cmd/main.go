@@ -1,13 +1,25 @@
 package main
 
 import (
+	"errors"
+	"html/template"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
+	"platform/auth/internal/apikeys"
 	"platform/auth/internal/db"
+	"platform/auth/internal/functions"
+	"platform/auth/internal/introspection"
+	"platform/auth/internal/mail"
+	"platform/auth/internal/oidc"
 	"platform/auth/internal/tokens"
+	"platform/auth/internal/upstream"
 	"platform/auth/internal/users"
 
 	"github.com/gin-gonic/gin"
@@ -30,6 +42,58 @@ func main() {
 		time.Minute*15,
 		time.Hour*24*7,
 	)
+	apiKeyService := apikeys.NewAPIKeyService(database)
+
+	issuer := os.Getenv("OIDC_ISSUER")
+	if issuer == "" {
+		issuer = "http://localhost:8080/auth"
+	}
+	signingKeyPEM := os.Getenv("OIDC_SIGNING_KEY")
+	if signingKeyPEM == "" {
+		log.Println("OIDC_SIGNING_KEY not set, generating an ephemeral ID token signing key")
+	}
+	signingKey, err := oidc.LoadSigningKey([]byte(signingKeyPEM))
+	if err != nil {
+		log.Fatal("failed to load OIDC signing key:", err)
+	}
+	provider := oidc.NewProvider(issuer, signingKey, time.Hour)
+	clientService := oidc.NewClientService(database)
+	codeService := oidc.NewCodeService(database, time.Minute*5)
+
+	var upstreamClient *upstream.Client
+	if upstreamIssuer := os.Getenv("OIDC_UPSTREAM_ISSUER"); upstreamIssuer != "" {
+		redirectURL := os.Getenv("OIDC_UPSTREAM_REDIRECT_URL")
+		if redirectURL == "" {
+			redirectURL = issuer + "/login/oidc/callback"
+		}
+		upstreamClient = upstream.NewClient(upstream.Config{
+			Issuer:       upstreamIssuer,
+			ClientID:     os.Getenv("OIDC_UPSTREAM_CLIENT_ID"),
+			ClientSecret: os.Getenv("OIDC_UPSTREAM_CLIENT_SECRET"),
+			RedirectURL:  redirectURL,
+		})
+	}
+	loginStateTTL := time.Minute * 10
+	stateService := upstream.NewStateService(database, loginStateTTL)
+	introspectionService := introspection.NewIntrospectionService(tokenService, apiKeyService, userService)
+
+	functionServiceURL := os.Getenv("FUNCTION_SERVICE_URL")
+	if functionServiceURL == "" {
+		functionServiceURL = "http://functionservice:8082"
+	}
+	functionsClient := functions.NewClient(functionServiceURL, os.Getenv("INTERNAL_AUTH_SECRET"))
+
+	// email changes need a way to deliver the confirmation token, so they
+	// are unavailable until SMTP is configured
+	var mailer mail.Mailer
+	if smtpAddr := os.Getenv("SMTP_ADDR"); smtpAddr != "" {
+		mailer, err = mail.NewSMTPMailer(smtpAddr, os.Getenv("SMTP_FROM"), os.Getenv("SMTP_USERNAME"), os.Getenv("SMTP_PASSWORD"))
+		if err != nil {
+			log.Fatal("failed to configure mail:", err)
+		}
+	}
+
+	go pruneRevokedTokens(tokenService, time.Hour)
 
 	r := gin.Default()
 
@@ -87,6 +151,84 @@ func main() {
 		})
 	})
 
+	r.GET("/login/oidc", func(c *gin.Context) {
+		if upstreamClient == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "external login is not configured"})
+			return
+		}
+
+		ls, err := stateService.NewLoginState()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to start login"})
+			return
+		}
+		authURL, err := upstreamClient.AuthCodeURL(c.Request.Context(), ls.State, ls.Nonce, ls.CodeChallenge)
+		if err != nil {
+			c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+			return
+		}
+		upstream.SetStateCookie(c.Writer, ls.State, loginStateTTL, strings.HasPrefix(issuer, "https://"))
+		c.Redirect(http.StatusFound, authURL)
+	})
+
+	r.GET("/login/oidc/callback", func(c *gin.Context) {
+		if upstreamClient == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "external login is not configured"})
+			return
+		}
+		if errCode := c.Query("error"); errCode != "" {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": errCode, "error_description": c.Query("error_description")})
+			return
+		}
+
+		// the state must come back to the browser that started the login,
+		// or an attacker could log the victim into the attacker's account
+		if err := upstream.CheckStateCookie(c.Writer, c.Request, c.Query("state")); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		ls, err := stateService.ConsumeLoginState(c.Query("state"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		rawIDToken, err := upstreamClient.Exchange(c.Request.Context(), c.Query("code"), ls.CodeVerifier)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+		claims, err := upstreamClient.VerifyIDToken(c.Request.Context(), rawIDToken, ls.Nonce)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+
+		user, err := userService.LoginWithIdentity(upstreamClient.Issuer(), claims.Subject, claims.Email, claims.EmailVerified)
+		if errors.Is(err, users.ErrIdentityNotLinked) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+
+		accessToken, refreshToken, err := tokenService.GenerateTokens(user.ID, user.Roles)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "token generation failed"})
+			return
+		}
+		if err := tokenService.StoreRefreshToken(user.ID, refreshToken); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to store refresh token"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"access_token":  accessToken,
+			"refresh_token": refreshToken,
+		})
+	})
+
 	r.POST("/refresh", func(c *gin.Context) {
 		var req struct {
 			RefreshToken string `json:"refresh_token"`
@@ -101,9 +243,14 @@ func main() {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid or expired refresh token"})
 			return
 		}
+		user, err := userService.GetActiveUserByID(userID)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
 
 		// generate new tokens
-		accessToken, newRefresh, err := tokenService.GenerateTokens(userID, []string{"user"})
+		accessToken, newRefresh, err := tokenService.GenerateTokens(userID, user.Roles)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "token generation failed"})
 			return
@@ -122,6 +269,563 @@ func main() {
 		})
 	})
 
+	me := r.Group("/me")
+	me.Use(requireUser(tokenService))
+	{
+		me.GET("", func(c *gin.Context) {
+			user, err := userService.GetActiveUserByID(c.GetString(ctxUserKey))
+			if err != nil {
+				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, user)
+		})
+
+		me.PATCH("", func(c *gin.Context) {
+			var req struct {
+				DisplayName *string `json:"display_name"`
+				Email       *string `json:"email"`
+			}
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid json"})
+				return
+			}
+			userID := c.GetString(ctxUserKey)
+			if req.Email != nil && mailer == nil {
+				c.JSON(http.StatusNotImplemented, gin.H{"error": "email changes are unavailable, mail delivery is not configured"})
+				return
+			}
+
+			if req.DisplayName != nil {
+				if err := userService.UpdateDisplayName(userID, strings.TrimSpace(*req.DisplayName)); err != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update profile"})
+					return
+				}
+			}
+
+			resp := gin.H{"status": "updated"}
+			if req.Email != nil {
+				newEmail := strings.TrimSpace(*req.Email)
+				token, err := userService.RequestEmailChange(userID, newEmail)
+				if err != nil {
+					if errors.Is(err, users.ErrEmailTaken) {
+						c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+						return
+					}
+					c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to request email change"})
+					return
+				}
+				// the token goes only to the new address, proving the user
+				// controls it
+				body := "Confirm your new email address with this token at POST /auth/me/email/verify:\n\n" + token + "\n"
+				if err := mailer.Send(newEmail, "Confirm your email address", body); err != nil {
+					log.Printf("Failed to send email change confirmation for user %s: %v", userID, err)
+					c.JSON(http.StatusServiceUnavailable, gin.H{"error": "failed to send confirmation email"})
+					return
+				}
+				resp["email_change"] = "pending verification"
+			}
+			c.JSON(http.StatusOK, resp)
+		})
+
+		me.POST("/email/verify", func(c *gin.Context) {
+			var req struct {
+				Token string `json:"token"`
+			}
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid json"})
+				return
+			}
+
+			err := userService.ConfirmEmailChange(c.GetString(ctxUserKey), req.Token)
+			if err != nil {
+				switch {
+				case errors.Is(err, users.ErrInvalidEmailToken):
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				case errors.Is(err, users.ErrEmailTaken):
+					c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+				default:
+					c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to change email"})
+				}
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"status": "email changed"})
+		})
+
+		me.POST("/password", func(c *gin.Context) {
+			var req struct {
+				CurrentPassword string `json:"current_password"`
+				NewPassword     string `json:"new_password"`
+				RefreshToken    string `json:"refresh_token"`
+			}
+			if err := c.ShouldBindJSON(&req); err != nil || req.NewPassword == "" {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid json"})
+				return
+			}
+
+			err := userService.ChangePassword(c.GetString(ctxUserKey), req.CurrentPassword, req.NewPassword, req.RefreshToken)
+			if err != nil {
+				if errors.Is(err, users.ErrInvalidCredentials) {
+					c.JSON(http.StatusUnauthorized, gin.H{"error": "current password is incorrect"})
+					return
+				}
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to change password"})
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"status": "password changed"})
+		})
+
+		me.DELETE("", func(c *gin.Context) {
+			userID := c.GetString(ctxUserKey)
+
+			// remove owned functions first so a failure leaves the account
+			// in place to retry rather than orphaning functions
+			if err := functionsClient.DeleteOwnedFunctions(userID); err != nil {
+				log.Printf("Failed to delete functions of user %s: %v", userID, err)
+				c.JSON(http.StatusServiceUnavailable, gin.H{"error": "failed to delete owned functions"})
+				return
+			}
+			if err := userService.DeleteUser(userID); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete account"})
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"status": "deleted"})
+		})
+	}
+
+	admin := r.Group("/admin")
+	admin.Use(requireUser(tokenService), requireRole("admin"))
+	{
+		admin.GET("/users", func(c *gin.Context) {
+			limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+			if err != nil || limit < 1 || limit > 200 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and 200"})
+				return
+			}
+			offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+			if err != nil || offset < 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid offset"})
+				return
+			}
+
+			list, err := userService.ListUsers(c.Query("q"), limit, offset)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to list users"})
+				return
+			}
+			c.JSON(http.StatusOK, list)
+		})
+
+		setDisabled := func(disabled bool) gin.HandlerFunc {
+			return func(c *gin.Context) {
+				if err := userService.SetDisabled(c.Param("id"), disabled); err != nil {
+					if errors.Is(err, users.ErrUserNotFound) {
+						c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+						return
+					}
+					c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update user"})
+					return
+				}
+				c.JSON(http.StatusOK, gin.H{"status": "updated", "disabled": disabled})
+			}
+		}
+		admin.POST("/users/:id/disable", setDisabled(true))
+		admin.POST("/users/:id/enable", setDisabled(false))
+	}
+
+	keys := r.Group("/api-keys")
+	keys.Use(requireUser(tokenService))
+	{
+		keys.POST("", func(c *gin.Context) {
+			var req struct {
+				Name      string     `json:"name"`
+				Scopes    []string   `json:"scopes"`
+				ExpiresAt *time.Time `json:"expires_at"`
+			}
+			if err := c.ShouldBindJSON(&req); err != nil || req.Name == "" {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid json"})
+				return
+			}
+			if req.ExpiresAt != nil && req.ExpiresAt.Before(time.Now()) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "expires_at must be in the future"})
+				return
+			}
+
+			key, plaintext, err := apiKeyService.CreateKey(c.GetString(ctxUserKey), req.Name, req.Scopes, req.ExpiresAt)
+			if err != nil {
+				if errors.Is(err, apikeys.ErrInvalidScope) {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create api key"})
+				return
+			}
+
+			c.JSON(http.StatusCreated, gin.H{
+				"api_key": key,
+				"key":     plaintext,
+			})
+		})
+
+		keys.GET("", func(c *gin.Context) {
+			list, err := apiKeyService.ListKeys(c.GetString(ctxUserKey))
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to list api keys"})
+				return
+			}
+			c.JSON(http.StatusOK, list)
+		})
+
+		keys.DELETE("/:id", func(c *gin.Context) {
+			err := apiKeyService.RevokeKey(c.GetString(ctxUserKey), c.Param("id"))
+			if err != nil {
+				if errors.Is(err, apikeys.ErrNotFound) {
+					c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+					return
+				}
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to revoke api key"})
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"status": "revoked"})
+		})
+	}
+
+	// internal endpoints are called by other services and are not exposed
+	// through the gateway
+	r.POST("/internal/api-keys/verify", func(c *gin.Context) {
+		var req struct {
+			Key string `json:"key"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid json"})
+			return
+		}
+
+		// 401 only when the key is bad; the gateway reports anything else
+		// as the auth service being unavailable
+		key, err := apiKeyService.VerifyKey(req.Key)
+		if err != nil {
+			if apikeys.IsRejected(err) {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "failed to verify api key"})
+			return
+		}
+		user, err := userService.GetActiveUserByID(key.UserID)
+		if err != nil {
+			if errors.Is(err, users.ErrUserNotFound) || errors.Is(err, users.ErrUserDisabled) {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid api key"})
+				return
+			}
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "failed to verify api key"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"user_id": user.ID,
+			"roles":   user.Roles,
+			"scopes":  key.Scopes,
+		})
+	})
+
+	// the gateway validates access tokens itself but asks here whether they
+	// were revoked or their user disabled
+	r.POST("/internal/tokens/verify", func(c *gin.Context) {
+		var req struct {
+			Token string `json:"token"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid json"})
+			return
+		}
+
+		claims, err := tokenService.ParseAccessToken(req.Token)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+		user, err := userService.GetActiveUserByID(claims.UserID)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid token"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"user_id": user.ID,
+			"roles":   user.Roles,
+		})
+	})
+
+	r.GET("/.well-known/openid-configuration", func(c *gin.Context) {
+		c.JSON(http.StatusOK, provider.Discovery())
+	})
+
+	r.GET("/jwks", func(c *gin.Context) {
+		c.JSON(http.StatusOK, provider.JWKS())
+	})
+
+	r.POST("/clients", requireUser(tokenService), requireRole("admin"), func(c *gin.Context) {
+		var req struct {
+			Name         string   `json:"name"`
+			RedirectURIs []string `json:"redirect_uris"`
+			Public       bool     `json:"public"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil || req.Name == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid json"})
+			return
+		}
+		for _, uri := range req.RedirectURIs {
+			if u, err := url.Parse(uri); err != nil || !u.IsAbs() || u.Fragment != "" {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid redirect_uri: " + uri})
+				return
+			}
+		}
+
+		client, secret, err := clientService.RegisterClient(req.Name, req.RedirectURIs, req.Public)
+		if err != nil {
+			if errors.Is(err, oidc.ErrMissingRedirectURIs) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to register client"})
+			return
+		}
+
+		resp := gin.H{"client": client}
+		if secret != "" {
+			resp["client_secret"] = secret
+		}
+		c.JSON(http.StatusCreated, resp)
+	})
+
+	// authorize handles both the login form (GET) and its submission (POST)
+	authorize := func(c *gin.Context) {
+		if err := c.Request.ParseForm(); err != nil {
+			c.String(http.StatusBadRequest, "invalid request\n")
+			return
+		}
+		params := c.Request.Form
+
+		client, err := clientService.GetClient(params.Get("client_id"))
+		if err != nil {
+			c.String(http.StatusBadRequest, "unknown client_id\n")
+			return
+		}
+		redirectURI := params.Get("redirect_uri")
+		if !client.ValidRedirectURI(redirectURI) {
+			c.String(http.StatusBadRequest, "redirect_uri not registered for client\n")
+			return
+		}
+
+		state := params.Get("state")
+		scope := params.Get("scope")
+		switch {
+		case params.Get("response_type") != "code":
+			redirectWithError(c, redirectURI, state, "unsupported_response_type", "only the code flow is supported")
+			return
+		case params.Get("code_challenge") == "" || params.Get("code_challenge_method") != "S256":
+			redirectWithError(c, redirectURI, state, "invalid_request", "PKCE with code_challenge_method=S256 is required")
+			return
+		}
+		for _, sc := range strings.Fields(scope) {
+			if !slices.Contains(oidc.SupportedScopes, sc) {
+				redirectWithError(c, redirectURI, state, "invalid_scope", "unsupported scope "+sc)
+				return
+			}
+		}
+
+		if c.Request.Method == http.MethodGet {
+			renderLogin(c, http.StatusOK, client.Name, params, "")
+			return
+		}
+
+		user, err := userService.LoginUser(c.PostForm("email"), c.PostForm("password"))
+		if err != nil {
+			renderLogin(c, http.StatusUnauthorized, client.Name, params, err.Error())
+			return
+		}
+
+		code, err := codeService.IssueCode(&oidc.AuthCode{
+			ClientID:      client.ID,
+			UserID:        user.ID,
+			RedirectURI:   redirectURI,
+			Scope:         scope,
+			Nonce:         params.Get("nonce"),
+			CodeChallenge: params.Get("code_challenge"),
+			AuthTime:      time.Now(),
+		})
+		if err != nil {
+			redirectWithError(c, redirectURI, state, "server_error", "failed to issue authorization code")
+			return
+		}
+
+		target, _ := url.Parse(redirectURI)
+		q := target.Query()
+		q.Set("code", code)
+		if state != "" {
+			q.Set("state", state)
+		}
+		target.RawQuery = q.Encode()
+		c.Redirect(http.StatusFound, target.String())
+	}
+	r.GET("/authorize", authorize)
+	r.POST("/authorize", authorize)
+
+	r.POST("/token", func(c *gin.Context) {
+		c.Header("Cache-Control", "no-store")
+		c.Header("Pragma", "no-cache")
+
+		client, err := authenticateClient(c, clientService)
+		if err != nil {
+			oauthError(c, http.StatusUnauthorized, "invalid_client", err.Error())
+			return
+		}
+
+		// granted is the scope the grant carries, scope what this response
+		// is for; a refresh may ask for less than was granted
+		var userID, granted, scope, nonce string
+		var authTime time.Time
+		switch c.PostForm("grant_type") {
+		case "authorization_code":
+			ac, err := codeService.RedeemCode(c.PostForm("code"), client.ID, c.PostForm("redirect_uri"), c.PostForm("code_verifier"))
+			if err != nil {
+				oauthError(c, http.StatusBadRequest, "invalid_grant", err.Error())
+				return
+			}
+			userID, granted, nonce, authTime = ac.UserID, ac.Scope, ac.Nonce, ac.AuthTime
+			scope = granted
+
+		case "refresh_token":
+			// the scope is checked before the token is consumed, so a
+			// client asking for too much keeps its token (RFC 6749 §6)
+			oldRefresh := c.PostForm("refresh_token")
+			rt, err := tokenService.ValidateClientRefreshToken(oldRefresh, client.ID)
+			if err != nil {
+				oauthError(c, http.StatusBadRequest, "invalid_grant", err.Error())
+				return
+			}
+			scope = rt.Scope
+			if requested := c.PostForm("scope"); requested != "" {
+				grantedScopes := strings.Fields(rt.Scope)
+				for _, sc := range strings.Fields(requested) {
+					if !slices.Contains(grantedScopes, sc) {
+						oauthError(c, http.StatusBadRequest, "invalid_scope", "scope "+sc+" was not granted")
+						return
+					}
+				}
+				scope = requested
+			}
+			rt, err = tokenService.ConsumeClientRefreshToken(oldRefresh, client.ID)
+			if err != nil {
+				if errors.Is(err, tokens.ErrInvalidRefreshToken) || errors.Is(err, tokens.ErrRefreshTokenExpired) {
+					oauthError(c, http.StatusBadRequest, "invalid_grant", err.Error())
+					return
+				}
+				oauthError(c, http.StatusInternalServerError, "server_error", "failed to rotate refresh token")
+				return
+			}
+			userID, granted = rt.UserID, rt.Scope
+
+		default:
+			oauthError(c, http.StatusBadRequest, "unsupported_grant_type", "grant_type must be authorization_code or refresh_token")
+			return
+		}
+
+		user, err := userService.GetActiveUserByID(userID)
+		if err != nil {
+			oauthError(c, http.StatusBadRequest, "invalid_grant", err.Error())
+			return
+		}
+
+		accessToken, refreshToken, err := tokenService.GenerateClientTokens(user.ID, client.ID, user.Roles)
+		if err != nil {
+			oauthError(c, http.StatusInternalServerError, "server_error", "token generation failed")
+			return
+		}
+		if err := tokenService.StoreClientRefreshToken(user.ID, client.ID, granted, refreshToken); err != nil {
+			oauthError(c, http.StatusInternalServerError, "server_error", "failed to store refresh token")
+			return
+		}
+
+		resp := gin.H{
+			"access_token":  accessToken,
+			"token_type":    "Bearer",
+			"expires_in":    int(tokenService.AccessTokenExpiry().Seconds()),
+			"refresh_token": refreshToken,
+			"scope":         scope,
+		}
+		if slices.Contains(strings.Fields(scope), "openid") {
+			if authTime.IsZero() {
+				authTime = time.Now()
+			}
+			idToken, err := provider.SignIDToken(user.ID, user.Email, client.ID, nonce, authTime)
+			if err != nil {
+				oauthError(c, http.StatusInternalServerError, "server_error", "failed to sign id token")
+				return
+			}
+			resp["id_token"] = idToken
+		}
+		c.JSON(http.StatusOK, resp)
+	})
+
+	// introspect implements RFC 7662 for resource servers, which must
+	// authenticate as confidential clients.
+	r.POST("/introspect", func(c *gin.Context) {
+		client, err := authenticateClient(c, clientService)
+		if err != nil {
+			oauthError(c, http.StatusUnauthorized, "invalid_client", err.Error())
+			return
+		}
+		if client.Public {
+			oauthError(c, http.StatusUnauthorized, "invalid_client", "public clients cannot introspect tokens")
+			return
+		}
+
+		token := c.PostForm("token")
+		if token == "" {
+			oauthError(c, http.StatusBadRequest, "invalid_request", "token is required")
+			return
+		}
+		c.Header("Cache-Control", "no-store")
+		c.JSON(http.StatusOK, introspectionService.Introspect(token, c.PostForm("token_type_hint")))
+	})
+
+	// revoke implements RFC 7009 and always answers 200 for unknown tokens
+	// and tokens of other clients.
+	r.POST("/revoke", func(c *gin.Context) {
+		client, err := authenticateClient(c, clientService)
+		if err != nil {
+			oauthError(c, http.StatusUnauthorized, "invalid_client", err.Error())
+			return
+		}
+
+		token := c.PostForm("token")
+		if token == "" {
+			oauthError(c, http.StatusBadRequest, "invalid_request", "token is required")
+			return
+		}
+		if err := introspectionService.Revoke(token, c.PostForm("token_type_hint"), client.ID); err != nil {
+			oauthError(c, http.StatusServiceUnavailable, "temporarily_unavailable", "failed to revoke token")
+			return
+		}
+		c.Status(http.StatusOK)
+	})
+
+	userinfo := func(c *gin.Context) {
+		user, err := userService.GetActiveUserByID(c.GetString(ctxUserKey))
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"sub":   user.ID,
+			"email": user.Email,
+		})
+	}
+	r.GET("/userinfo", requireUser(tokenService), userinfo)
+	r.POST("/userinfo", requireUser(tokenService), userinfo)
+
 	addr := ":8081"
 	if port := os.Getenv("AUTH_PORT"); port != "" {
 		addr = ":" + port
@@ -132,3 +836,119 @@ func main() {
 		log.Fatal("Failed to start Auth service:", err)
 	}
 }
+
+// pruneRevokedTokens periodically drops denylisted access tokens that have
+// expired, so the denylist only holds tokens that could still be used.
+func pruneRevokedTokens(ts *tokens.TokenService, interval time.Duration) {
+	for {
+		n, err := ts.PruneRevokedAccessTokens()
+		if err != nil {
+			log.Printf("Failed to prune revoked access tokens: %v", err)
+		} else if n > 0 {
+			log.Printf("Pruned %d expired revoked access tokens", n)
+		}
+		time.Sleep(interval)
+	}
+}
+
+var loginPage = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Sign in</title></head>
+<body>
+  <h1>Sign in to {{.Client}}</h1>
+  {{if .Error}}<p style="color:red">{{.Error}}</p>{{end}}
+  <form method="POST" action="authorize">
+    {{range $k, $v := .Params}}{{if and (ne $k "email") (ne $k "password")}}<input type="hidden" name="{{$k}}" value="{{index $v 0}}">
+    {{end}}{{end}}<input type="email" name="email" placeholder="Email" required>
+    <input type="password" name="password" placeholder="Password" required>
+    <button type="submit">Sign in</button>
+  </form>
+</body>
+</html>
+`))
+
+func renderLogin(c *gin.Context, status int, clientName string, params url.Values, errMsg string) {
+	c.Status(status)
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	_ = loginPage.Execute(c.Writer, gin.H{
+		"Client": clientName,
+		"Params": params,
+		"Error":  errMsg,
+	})
+}
+
+func redirectWithError(c *gin.Context, redirectURI, state, code, description string) {
+	target, _ := url.Parse(redirectURI)
+	q := target.Query()
+	q.Set("error", code)
+	q.Set("error_description", description)
+	if state != "" {
+		q.Set("state", state)
+	}
+	target.RawQuery = q.Encode()
+	c.Redirect(http.StatusFound, target.String())
+}
+
+// authenticateClient checks client credentials sent with HTTP Basic auth or
+// as client_id/client_secret form fields.
+func authenticateClient(c *gin.Context, cs *oidc.ClientService) (*oidc.Client, error) {
+	clientID, clientSecret, ok := c.Request.BasicAuth()
+	if ok {
+		// RFC 6749 section 2.3.1 form-encodes Basic credentials
+		clientID, _ = url.QueryUnescape(clientID)
+		clientSecret, _ = url.QueryUnescape(clientSecret)
+	} else {
+		clientID = c.PostForm("client_id")
+		clientSecret = c.PostForm("client_secret")
+	}
+	return cs.Authenticate(clientID, clientSecret)
+}
+
+// oauthError writes an RFC 6749 section 5.2 error response.
+func oauthError(c *gin.Context, status int, code, description string) {
+	if status == http.StatusUnauthorized {
+		c.Header("WWW-Authenticate", `Basic realm="auth-service"`)
+	}
+	c.JSON(status, gin.H{
+		"error":             code,
+		"error_description": description,
+	})
+}
+
+const (
+	ctxUserKey  = "userID"
+	ctxRolesKey = "roles"
+)
+
+// requireUser authenticates the caller from a Bearer access token issued by
+// this service.
+func requireUser(ts *tokens.TokenService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		parts := strings.SplitN(c.GetHeader("Authorization"), " ", 2)
+		if len(parts) != 2 || !strings.EqualFold(parts[0], "Bearer") {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "missing or invalid Authorization header"})
+			return
+		}
+
+		claims, err := ts.ParseAccessToken(parts[1])
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.Set(ctxUserKey, claims.UserID)
+		c.Set(ctxRolesKey, claims.Roles)
+		c.Next()
+	}
+}
+
+func requireRole(role string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		roles, _ := c.Get(ctxRolesKey)
+		if list, ok := roles.([]string); !ok || !slices.Contains(list, role) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "forbidden, insufficient roles"})
+			return
+		}
+		c.Next()
+	}
+}
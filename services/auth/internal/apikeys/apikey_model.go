@@ -0,0 +1,36 @@
+package apikeys
+
+import "time"
+
+const (
+	ScopeFunctionsRead    = "functions:read"
+	ScopeFunctionsWrite   = "functions:write"
+	ScopeFunctionsExecute = "functions:execute"
+	ScopeJobsRead         = "jobs:read"
+	ScopeJobsWrite        = "jobs:write"
+)
+
+// AllScopes lists every scope an API key may be granted.
+var AllScopes = []string{
+	ScopeFunctionsRead,
+	ScopeFunctionsWrite,
+	ScopeFunctionsExecute,
+	ScopeJobsRead,
+	ScopeJobsWrite,
+}
+
+// DefaultScopes are granted when a key is created without explicit scopes,
+// which covers the common CI use case of triggering and polling executions.
+var DefaultScopes = []string{ScopeFunctionsExecute, ScopeJobsRead}
+
+type APIKey struct {
+	ID         string     `json:"id"`
+	UserID     string     `json:"user_id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
@@ -0,0 +1,225 @@
+package apikeys
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// KeyPrefix starts every plaintext API key, which lets callers tell keys
+// apart from other credentials.
+const KeyPrefix = "pk_"
+
+var (
+	ErrNotFound     = errors.New("api key not found")
+	ErrInvalidKey   = errors.New("invalid api key")
+	ErrExpiredKey   = errors.New("api key expired")
+	ErrRevokedKey   = errors.New("api key revoked")
+	ErrInvalidScope = errors.New("invalid scope")
+)
+
+type APIKeyService struct {
+	db *sql.DB
+}
+
+func NewAPIKeyService(db *sql.DB) *APIKeyService {
+	return &APIKeyService{db: db}
+}
+
+// CreateKey issues a new key for userID. The plaintext key is only returned
+// here; the database keeps its SHA-256 hash.
+func (s *APIKeyService) CreateKey(userID, name string, scopes []string, expiresAt *time.Time) (*APIKey, string, error) {
+	if len(scopes) == 0 {
+		scopes = DefaultScopes
+	}
+	for _, sc := range scopes {
+		if !slices.Contains(AllScopes, sc) {
+			return nil, "", fmt.Errorf("%w: %s", ErrInvalidScope, sc)
+		}
+	}
+
+	prefix, err := randomString(6)
+	if err != nil {
+		return nil, "", err
+	}
+	secret, err := randomString(32)
+	if err != nil {
+		return nil, "", err
+	}
+	plaintext := KeyPrefix + prefix + "_" + secret
+
+	key := &APIKey{
+		ID:        uuid.NewString(),
+		UserID:    userID,
+		Name:      name,
+		Prefix:    KeyPrefix + prefix,
+		Scopes:    scopes,
+		CreatedAt: time.Now(),
+		ExpiresAt: expiresAt,
+	}
+
+	_, err = s.db.Exec(`
+        INSERT INTO api_keys (id, user_id, name, prefix, key_hash, scopes, created_at, expires_at)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+    `, key.ID, key.UserID, key.Name, key.Prefix, hashKey(plaintext),
+		strings.Join(key.Scopes, ","), key.CreatedAt, key.ExpiresAt)
+	if err != nil {
+		return nil, "", err
+	}
+	return key, plaintext, nil
+}
+
+func (s *APIKeyService) ListKeys(userID string) ([]APIKey, error) {
+	rows, err := s.db.Query(`
+        SELECT id, user_id, name, prefix, scopes, created_at, last_used_at, expires_at, revoked_at
+        FROM api_keys
+        WHERE user_id = $1
+        ORDER BY created_at DESC
+    `, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		key, err := scanKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, *key)
+	}
+	return keys, rows.Err()
+}
+
+// RevokeKey marks the key as revoked. Only the owning user can revoke it.
+func (s *APIKeyService) RevokeKey(userID, keyID string) error {
+	res, err := s.db.Exec(`
+        UPDATE api_keys SET revoked_at = $1
+        WHERE id = $2 AND user_id = $3 AND revoked_at IS NULL
+    `, time.Now(), keyID, userID)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// VerifyKey resolves a plaintext key to its record and records its use.
+// Recording the use is best effort: a key is not rejected because its
+// last use could not be saved.
+func (s *APIKeyService) VerifyKey(plaintext string) (*APIKey, error) {
+	key, err := s.LookupKey(plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if _, err := s.db.Exec("UPDATE api_keys SET last_used_at = $1 WHERE id = $2", now, key.ID); err != nil {
+		log.Printf("Failed to record the use of api key %s: %v", key.ID, err)
+		return key, nil
+	}
+	key.LastUsedAt = &now
+	return key, nil
+}
+
+// LookupKey resolves a plaintext key to a usable record without recording
+// a use, e.g. for token introspection. Keys that do not exist, are revoked
+// or expired are rejected with ErrInvalidKey, ErrRevokedKey or
+// ErrExpiredKey; any other error means the key could not be checked.
+func (s *APIKeyService) LookupKey(plaintext string) (*APIKey, error) {
+	if !strings.HasPrefix(plaintext, KeyPrefix) {
+		return nil, ErrInvalidKey
+	}
+
+	row := s.db.QueryRow(`
+        SELECT id, user_id, name, prefix, scopes, created_at, last_used_at, expires_at, revoked_at
+        FROM api_keys
+        WHERE key_hash = $1
+    `, hashKey(plaintext))
+	key, err := scanKey(row)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrInvalidKey
+		}
+		return nil, err
+	}
+	if key.RevokedAt != nil {
+		return nil, ErrRevokedKey
+	}
+	if key.ExpiresAt != nil && time.Now().After(*key.ExpiresAt) {
+		return nil, ErrExpiredKey
+	}
+	return key, nil
+}
+
+// RevokeKeyByValue revokes the key identified by its plaintext. Presenting
+// the key itself proves the caller may revoke it.
+func (s *APIKeyService) RevokeKeyByValue(plaintext string) error {
+	_, err := s.db.Exec(`
+        UPDATE api_keys SET revoked_at = $1
+        WHERE key_hash = $2 AND revoked_at IS NULL
+    `, time.Now(), hashKey(plaintext))
+	return err
+}
+
+// IsRejected reports whether err from LookupKey or VerifyKey rejects the
+// key, as opposed to the key not being checked.
+func IsRejected(err error) bool {
+	return errors.Is(err, ErrInvalidKey) || errors.Is(err, ErrRevokedKey) || errors.Is(err, ErrExpiredKey)
+}
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanKey(row scanner) (*APIKey, error) {
+	var key APIKey
+	var scopes string
+	var lastUsed, expires, revoked sql.NullTime
+	if err := row.Scan(&key.ID, &key.UserID, &key.Name, &key.Prefix, &scopes,
+		&key.CreatedAt, &lastUsed, &expires, &revoked); err != nil {
+		return nil, err
+	}
+	key.Scopes = strings.Split(scopes, ",")
+	key.LastUsedAt = nullTimePtr(lastUsed)
+	key.ExpiresAt = nullTimePtr(expires)
+	key.RevokedAt = nullTimePtr(revoked)
+	return &key, nil
+}
+
+func nullTimePtr(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+func hashKey(plaintext string) string {
+	sum := sha256.Sum256([]byte(plaintext))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,183 @@
+package introspection
+
+import (
+	"slices"
+	"strings"
+
+	"platform/auth/internal/apikeys"
+	"platform/auth/internal/tokens"
+	"platform/auth/internal/users"
+)
+
+const (
+	TypeAccessToken  = "access_token"
+	TypeRefreshToken = "refresh_token"
+	TypeAPIKey       = "api_key"
+)
+
+// Result is an RFC 7662 introspection response. Inactive tokens carry no
+// other information.
+type Result struct {
+	Active    bool     `json:"active"`
+	TokenType string   `json:"token_type,omitempty"`
+	Subject   string   `json:"sub,omitempty"`
+	Username  string   `json:"username,omitempty"`
+	Scope     string   `json:"scope,omitempty"`
+	Roles     []string `json:"roles,omitempty"`
+	Issuer    string   `json:"iss,omitempty"`
+	ExpiresAt int64    `json:"exp,omitempty"`
+	IssuedAt  int64    `json:"iat,omitempty"`
+}
+
+type IntrospectionService struct {
+	tokens  *tokens.TokenService
+	apiKeys *apikeys.APIKeyService
+	users   *users.UserService
+}
+
+func NewIntrospectionService(ts *tokens.TokenService, ks *apikeys.APIKeyService, us *users.UserService) *IntrospectionService {
+	return &IntrospectionService{tokens: ts, apiKeys: ks, users: us}
+}
+
+// Introspect reports whether token is currently active. The hint only
+// decides which token type is tried first.
+func (s *IntrospectionService) Introspect(token, hint string) *Result {
+	for _, tokenType := range candidateTypes(token, hint) {
+		var res *Result
+		switch tokenType {
+		case TypeAccessToken:
+			res = s.introspectAccessToken(token)
+		case TypeRefreshToken:
+			res = s.introspectRefreshToken(token)
+		case TypeAPIKey:
+			res = s.introspectAPIKey(token)
+		}
+		if res != nil {
+			return res
+		}
+	}
+	return &Result{Active: false}
+}
+
+// Revoke invalidates a token issued to clientID. Per RFC 7009 unknown or
+// already invalid tokens are not an error, and neither are tokens of other
+// clients, which are left alone. API keys belong to no client; presenting
+// one proves the caller may revoke it, so a leaked key can be revoked by
+// whoever found it.
+func (s *IntrospectionService) Revoke(token, hint, clientID string) error {
+	for _, tokenType := range candidateTypes(token, hint) {
+		switch tokenType {
+		case TypeAccessToken:
+			if claims, err := s.tokens.ParseAccessToken(token); err == nil {
+				if claims.ClientID != clientID {
+					return nil
+				}
+				return s.tokens.RevokeAccessToken(claims)
+			}
+		case TypeRefreshToken:
+			if rt, err := s.tokens.LookupRefreshToken(token); err == nil {
+				if rt.ClientID != clientID {
+					return nil
+				}
+				return s.tokens.RevokeRefreshToken(token)
+			}
+		case TypeAPIKey:
+			_, err := s.apiKeys.LookupKey(token)
+			if err == nil {
+				return s.apiKeys.RevokeKeyByValue(token)
+			}
+			if !apikeys.IsRejected(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *IntrospectionService) introspectAccessToken(token string) *Result {
+	claims, err := s.tokens.ParseAccessToken(token)
+	if err != nil {
+		return nil
+	}
+	res := s.activeResult(TypeAccessToken, claims.UserID)
+	if res == nil {
+		return nil
+	}
+	res.Roles = claims.Roles
+	res.Issuer = claims.Issuer
+	if claims.ExpiresAt != nil {
+		res.ExpiresAt = claims.ExpiresAt.Unix()
+	}
+	if claims.IssuedAt != nil {
+		res.IssuedAt = claims.IssuedAt.Unix()
+	}
+	return res
+}
+
+func (s *IntrospectionService) introspectRefreshToken(token string) *Result {
+	rt, err := s.tokens.LookupRefreshToken(token)
+	if err != nil {
+		return nil
+	}
+	res := s.activeResult(TypeRefreshToken, rt.UserID)
+	if res == nil {
+		return nil
+	}
+	res.ExpiresAt = rt.ExpiresAt.Unix()
+	return res
+}
+
+func (s *IntrospectionService) introspectAPIKey(token string) *Result {
+	key, err := s.apiKeys.LookupKey(token)
+	if err != nil {
+		return nil
+	}
+	res := s.activeResult(TypeAPIKey, key.UserID)
+	if res == nil {
+		return nil
+	}
+	res.Scope = strings.Join(key.Scopes, " ")
+	res.IssuedAt = key.CreatedAt.Unix()
+	if key.ExpiresAt != nil {
+		res.ExpiresAt = key.ExpiresAt.Unix()
+	}
+	return res
+}
+
+// activeResult returns nil when the token's user no longer exists or has
+// been disabled.
+func (s *IntrospectionService) activeResult(tokenType, userID string) *Result {
+	user, err := s.users.GetActiveUserByID(userID)
+	if err != nil {
+		return nil
+	}
+	return &Result{
+		Active:    true,
+		TokenType: tokenType,
+		Subject:   user.ID,
+		Username:  user.Email,
+		Roles:     user.Roles,
+	}
+}
+
+// candidateTypes orders the token types to try, starting with the hint and
+// then the type the token's format suggests.
+func candidateTypes(token, hint string) []string {
+	guess := TypeRefreshToken
+	switch {
+	case strings.HasPrefix(token, apikeys.KeyPrefix):
+		guess = TypeAPIKey
+	case strings.Count(token, ".") == 2:
+		guess = TypeAccessToken
+	}
+
+	order := []string{}
+	for _, t := range []string{hint, guess, TypeAccessToken, TypeRefreshToken, TypeAPIKey} {
+		if t == TypeAccessToken || t == TypeRefreshToken || t == TypeAPIKey {
+			if !slices.Contains(order, t) {
+				order = append(order, t)
+			}
+		}
+	}
+	return order
+}
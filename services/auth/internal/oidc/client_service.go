@@ -0,0 +1,127 @@
+package oidc
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+var (
+	ErrClientNotFound      = errors.New("client not found")
+	ErrInvalidClient       = errors.New("invalid client credentials")
+	ErrInvalidRedirectURI  = errors.New("redirect_uri not registered for client")
+	ErrMissingRedirectURIs = errors.New("at least one redirect_uri is required")
+)
+
+// Client is a relying party registered with the provider. Public clients
+// (browser or native apps) have no secret and must rely on PKCE alone.
+type Client struct {
+	ID           string    `json:"client_id"`
+	Name         string    `json:"name"`
+	RedirectURIs []string  `json:"redirect_uris"`
+	Public       bool      `json:"public"`
+	CreatedAt    time.Time `json:"created_at"`
+
+	secretHash string
+}
+
+type ClientService struct {
+	db *sql.DB
+}
+
+func NewClientService(db *sql.DB) *ClientService {
+	return &ClientService{db: db}
+}
+
+// RegisterClient stores a new client and returns its plaintext secret, which
+// is empty for public clients.
+func (cs *ClientService) RegisterClient(name string, redirectURIs []string, public bool) (*Client, string, error) {
+	if len(redirectURIs) == 0 {
+		return nil, "", ErrMissingRedirectURIs
+	}
+
+	client := &Client{
+		ID:           uuid.NewString(),
+		Name:         name,
+		RedirectURIs: redirectURIs,
+		Public:       public,
+		CreatedAt:    time.Now(),
+	}
+
+	var secret string
+	var secretHash sql.NullString
+	if !public {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			return nil, "", err
+		}
+		secret = base64.RawURLEncoding.EncodeToString(b)
+		secretHash = sql.NullString{String: hashSecret(secret), Valid: true}
+	}
+
+	_, err := cs.db.Exec(`
+        INSERT INTO oauth_clients (id, secret_hash, name, redirect_uris, created_at)
+        VALUES ($1, $2, $3, $4, $5)
+    `, client.ID, secretHash, client.Name, pq.Array(client.RedirectURIs), client.CreatedAt)
+	if err != nil {
+		return nil, "", err
+	}
+	return client, secret, nil
+}
+
+func (cs *ClientService) GetClient(id string) (*Client, error) {
+	row := cs.db.QueryRow(`
+        SELECT id, secret_hash, name, redirect_uris, created_at
+        FROM oauth_clients
+        WHERE id = $1
+    `, id)
+
+	var client Client
+	var secretHash sql.NullString
+	if err := row.Scan(&client.ID, &secretHash, &client.Name, pq.Array(&client.RedirectURIs), &client.CreatedAt); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrClientNotFound
+		}
+		return nil, err
+	}
+	client.Public = !secretHash.Valid
+	client.secretHash = secretHash.String
+	return &client, nil
+}
+
+// Authenticate checks the client credentials presented at the token
+// endpoint. Public clients authenticate with their ID only.
+func (cs *ClientService) Authenticate(id, secret string) (*Client, error) {
+	client, err := cs.GetClient(id)
+	if err != nil {
+		if errors.Is(err, ErrClientNotFound) {
+			return nil, ErrInvalidClient
+		}
+		return nil, err
+	}
+	if client.Public {
+		return client, nil
+	}
+	if subtle.ConstantTimeCompare([]byte(client.secretHash), []byte(hashSecret(secret))) != 1 {
+		return nil, ErrInvalidClient
+	}
+	return client, nil
+}
+
+func (c *Client) ValidRedirectURI(uri string) bool {
+	return slices.Contains(c.RedirectURIs, uri)
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
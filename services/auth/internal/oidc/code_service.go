@@ -0,0 +1,114 @@
+package oidc
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"time"
+)
+
+var (
+	ErrInvalidGrant = errors.New("invalid or expired authorization code")
+	ErrPKCEMismatch = errors.New("code_verifier does not match code_challenge")
+)
+
+// AuthCode is an issued authorization code together with the request that
+// produced it.
+type AuthCode struct {
+	ClientID      string
+	UserID        string
+	RedirectURI   string
+	Scope         string
+	Nonce         string
+	CodeChallenge string
+	AuthTime      time.Time
+	ExpiresAt     time.Time
+}
+
+type CodeService struct {
+	db  *sql.DB
+	ttl time.Duration
+}
+
+func NewCodeService(db *sql.DB, ttl time.Duration) *CodeService {
+	return &CodeService{db: db, ttl: ttl}
+}
+
+// IssueCode stores ac and returns the one-time code to hand to the client.
+// Only the hash of the code is persisted.
+func (cs *CodeService) IssueCode(ac *AuthCode) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	code := base64.RawURLEncoding.EncodeToString(b)
+	ac.ExpiresAt = time.Now().Add(cs.ttl)
+
+	_, err := cs.db.Exec(`
+        INSERT INTO authorization_codes
+            (code_hash, client_id, user_id, redirect_uri, scope, nonce, code_challenge, auth_time, expires_at)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+    `, hashSecret(code), ac.ClientID, ac.UserID, ac.RedirectURI, ac.Scope, ac.Nonce,
+		ac.CodeChallenge, ac.AuthTime, ac.ExpiresAt)
+	if err != nil {
+		return "", err
+	}
+	return code, nil
+}
+
+// RedeemCode consumes code for clientID, checking the redirect URI and the
+// PKCE verifier. A code can be redeemed only once. The request is checked
+// before the code is consumed, so a wrong client cannot burn another
+// client's code.
+func (cs *CodeService) RedeemCode(code, clientID, redirectURI, verifier string) (*AuthCode, error) {
+	codeHash := hashSecret(code)
+	row := cs.db.QueryRow(`
+        SELECT client_id, user_id, redirect_uri, scope, nonce, code_challenge, auth_time, expires_at
+        FROM authorization_codes
+        WHERE code_hash = $1 AND used_at IS NULL
+    `, codeHash)
+
+	var ac AuthCode
+	if err := row.Scan(&ac.ClientID, &ac.UserID, &ac.RedirectURI, &ac.Scope, &ac.Nonce,
+		&ac.CodeChallenge, &ac.AuthTime, &ac.ExpiresAt); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrInvalidGrant
+		}
+		return nil, err
+	}
+
+	if time.Now().After(ac.ExpiresAt) || ac.ClientID != clientID || ac.RedirectURI != redirectURI {
+		return nil, ErrInvalidGrant
+	}
+	if !VerifyPKCE(verifier, ac.CodeChallenge) {
+		return nil, ErrPKCEMismatch
+	}
+
+	// a concurrent redemption of the same code leaves nothing to update
+	res, err := cs.db.Exec(`
+        UPDATE authorization_codes SET used_at = $1
+        WHERE code_hash = $2 AND used_at IS NULL
+    `, time.Now(), codeHash)
+	if err != nil {
+		return nil, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return nil, err
+	} else if n == 0 {
+		return nil, ErrInvalidGrant
+	}
+	return &ac, nil
+}
+
+// VerifyPKCE checks an S256 code_verifier against its challenge (RFC 7636).
+func VerifyPKCE(verifier, challenge string) bool {
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	computed := base64.RawURLEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(challenge)) == 1
+}
@@ -0,0 +1,136 @@
+package oidc
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// SupportedScopes are the scopes advertised in the discovery document.
+var SupportedScopes = []string{"openid", "profile", "email", "offline_access"}
+
+// Provider signs ID tokens and describes the provider to relying parties.
+type Provider struct {
+	issuer        string
+	signingKey    *rsa.PrivateKey
+	keyID         string
+	idTokenExpiry time.Duration
+}
+
+func NewProvider(issuer string, signingKey *rsa.PrivateKey, idTokenExpiry time.Duration) *Provider {
+	der, _ := x509.MarshalPKIXPublicKey(&signingKey.PublicKey)
+	sum := sha256.Sum256(der)
+	return &Provider{
+		issuer:        issuer,
+		signingKey:    signingKey,
+		keyID:         base64.RawURLEncoding.EncodeToString(sum[:12]),
+		idTokenExpiry: idTokenExpiry,
+	}
+}
+
+// LoadSigningKey parses a PEM encoded RSA private key (PKCS#1 or PKCS#8).
+// With no PEM it generates an ephemeral key, so ID tokens will not verify
+// across restarts.
+func LoadSigningKey(pemData []byte) (*rsa.PrivateKey, error) {
+	if len(pemData) == 0 {
+		return rsa.GenerateKey(rand.Reader, 2048)
+	}
+
+	block, _ := pem.Decode(pemData)
+	if block == nil {
+		return nil, errors.New("no PEM block found in signing key")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse signing key: %w", err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("signing key is not an RSA key")
+	}
+	return key, nil
+}
+
+func (p *Provider) Issuer() string {
+	return p.issuer
+}
+
+type IDTokenClaims struct {
+	Nonce    string `json:"nonce,omitempty"`
+	AuthTime int64  `json:"auth_time"`
+	Email    string `json:"email,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// SignIDToken issues an RS256 ID token for userID addressed to clientID.
+func (p *Provider) SignIDToken(userID, email, clientID, nonce string, authTime time.Time) (string, error) {
+	now := time.Now()
+	claims := &IDTokenClaims{
+		Nonce:    nonce,
+		AuthTime: authTime.Unix(),
+		Email:    email,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    p.issuer,
+			Subject:   userID,
+			Audience:  jwt.ClaimStrings{clientID},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(p.idTokenExpiry)),
+		},
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = p.keyID
+	signed, err := token.SignedString(p.signingKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to sign id token: %w", err)
+	}
+	return signed, nil
+}
+
+// JWKS returns the public signing key as a JSON Web Key Set.
+func (p *Provider) JWKS() map[string]any {
+	pub := p.signingKey.PublicKey
+	return map[string]any{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"use": "sig",
+			"alg": "RS256",
+			"kid": p.keyID,
+			"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}},
+	}
+}
+
+// Discovery returns the OpenID Provider metadata document.
+func (p *Provider) Discovery() map[string]any {
+	return map[string]any{
+		"issuer":                                p.issuer,
+		"authorization_endpoint":                p.issuer + "/authorize",
+		"token_endpoint":                        p.issuer + "/token",
+		"userinfo_endpoint":                     p.issuer + "/userinfo",
+		"jwks_uri":                              p.issuer + "/jwks",
+		"introspection_endpoint":                p.issuer + "/introspect",
+		"revocation_endpoint":                   p.issuer + "/revoke",
+		"response_types_supported":              []string{"code"},
+		"grant_types_supported":                 []string{"authorization_code", "refresh_token"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
+		"scopes_supported":                      SupportedScopes,
+		"claims_supported":                      []string{"sub", "iss", "aud", "exp", "iat", "auth_time", "nonce", "email"},
+	}
+}
@@ -26,9 +26,15 @@ func NewTokenService(db *sql.DB, secret string, accessExp, refreshExp time.Durat
 	}
 }
 
+func (ts *TokenService) AccessTokenExpiry() time.Duration {
+	return ts.accessTokenExpiry
+}
+
 type CustomClaims struct {
 	UserID string   `json:"user_id"`
 	Roles  []string `json:"roles"`
+	// ClientID is the OAuth client the token was issued to, if any.
+	ClientID string `json:"client_id,omitempty"`
 	jwt.RegisteredClaims
 }
 
@@ -43,12 +49,22 @@ func (c *CustomClaims) Valid() error {
 }
 
 func (ts *TokenService) GenerateTokens(userID string, roles []string) (string, string, error) {
+	return ts.GenerateClientTokens(userID, "", roles)
+}
+
+// GenerateClientTokens issues tokens to an OAuth client; the access token
+// names the client, so only it can revoke the token.
+func (ts *TokenService) GenerateClientTokens(userID, clientID string, roles []string) (string, string, error) {
 	// 1) access token
+	now := time.Now()
 	atClaims := &CustomClaims{
-		UserID: userID,
-		Roles:  roles,
+		UserID:   userID,
+		Roles:    roles,
+		ClientID: clientID,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(ts.accessTokenExpiry)),
+			ID:        uuid.NewString(),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(ts.accessTokenExpiry)),
 			Issuer:    "auth-service",
 		},
 	}
@@ -62,40 +78,161 @@ func (ts *TokenService) GenerateTokens(userID string, roles []string) (string, s
 	return accessToken, refreshToken, nil
 }
 
+// ParseAccessToken verifies an access token issued by this service and
+// rejects tokens that were revoked before their expiry.
+func (ts *TokenService) ParseAccessToken(tokenString string) (*CustomClaims, error) {
+	token, err := jwt.ParseWithClaims(tokenString, &CustomClaims{}, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+		}
+		return ts.hmacSecret, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("token parse error: %w", err)
+	}
+
+	claims, ok := token.Claims.(*CustomClaims)
+	if !ok || !token.Valid {
+		return nil, errors.New("invalid token claims")
+	}
+
+	if claims.ID != "" {
+		var revoked bool
+		err := ts.db.QueryRow("SELECT EXISTS (SELECT 1 FROM revoked_access_tokens WHERE jti = $1)", claims.ID).Scan(&revoked)
+		if err != nil {
+			return nil, err
+		}
+		if revoked {
+			return nil, errors.New("token has been revoked")
+		}
+	}
+	return claims, nil
+}
+
+// RevokeAccessToken denylists the token's jti until the token expires.
+// Tokens issued before jti was introduced cannot be revoked and simply expire.
+func (ts *TokenService) RevokeAccessToken(claims *CustomClaims) error {
+	if claims.ID == "" || claims.ExpiresAt == nil {
+		return nil
+	}
+	_, err := ts.db.Exec(`
+        INSERT INTO revoked_access_tokens (jti, expires_at)
+        VALUES ($1, $2)
+        ON CONFLICT (jti) DO NOTHING
+    `, claims.ID, claims.ExpiresAt.Time)
+	return err
+}
+
+// RefreshToken is a stored refresh token. ClientID is the OAuth client it
+// was issued to, or empty for tokens issued by /login and /refresh. Scope
+// is what the client was granted with it.
+type RefreshToken struct {
+	UserID    string
+	ClientID  string
+	Scope     string
+	ExpiresAt time.Time
+}
+
+var (
+	ErrInvalidRefreshToken = errors.New("invalid refresh token or not found")
+	ErrRefreshTokenExpired = errors.New("refresh token expired")
+)
+
+// PruneRevokedAccessTokens drops denylist entries of tokens that have
+// expired anyway.
+func (ts *TokenService) PruneRevokedAccessTokens() (int64, error) {
+	res, err := ts.db.Exec("DELETE FROM revoked_access_tokens WHERE expires_at < $1", time.Now())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
 func (ts *TokenService) StoreRefreshToken(userID, refreshToken string) error {
+	return ts.StoreClientRefreshToken(userID, "", "", refreshToken)
+}
+
+// StoreClientRefreshToken stores a refresh token issued to an OAuth client
+// with the scope it was granted, which only that client can redeem.
+func (ts *TokenService) StoreClientRefreshToken(userID, clientID, scope, refreshToken string) error {
 	rtExpiresAt := time.Now().Add(ts.refreshExpiry)
-	return ts.insertRefreshToken(refreshToken, userID, rtExpiresAt)
+	return ts.insertRefreshToken(refreshToken, userID, clientID, scope, rtExpiresAt)
 }
 
-func (ts *TokenService) insertRefreshToken(token, userID string, exp time.Time) error {
+func (ts *TokenService) insertRefreshToken(token, userID, clientID, scope string, exp time.Time) error {
 	_, err := ts.db.Exec(`
-        INSERT INTO refresh_tokens (token, user_id, expires_at)
-        VALUES ($1, $2, $3)
-    `, token, userID, exp)
+        INSERT INTO refresh_tokens (token, user_id, client_id, scope, expires_at)
+        VALUES ($1, $2, $3, $4, $5)
+    `, token, userID, clientID, scope, exp)
 	return err
 }
 
+// ValidateRefreshToken returns the owner of a valid refresh token that was
+// issued outside of any OAuth client.
 func (ts *TokenService) ValidateRefreshToken(refreshToken string) (string, error) {
-	var userID string
-	var expiresAt time.Time
+	rt, err := ts.ValidateClientRefreshToken(refreshToken, "")
+	if err != nil {
+		return "", err
+	}
+	return rt.UserID, nil
+}
 
+// ValidateClientRefreshToken returns a valid refresh token issued to
+// clientID. A token of another client is reported as not found.
+func (ts *TokenService) ValidateClientRefreshToken(refreshToken, clientID string) (*RefreshToken, error) {
+	rt, err := ts.LookupRefreshToken(refreshToken)
+	if err != nil {
+		return nil, err
+	}
+	if rt.ClientID != clientID {
+		return nil, ErrInvalidRefreshToken
+	}
+	return rt, nil
+}
+
+// ConsumeClientRefreshToken deletes a refresh token issued to clientID and
+// returns it if it was still valid. The token is looked up and deleted in
+// one statement, so of concurrent redemptions only one gets it.
+func (ts *TokenService) ConsumeClientRefreshToken(refreshToken, clientID string) (*RefreshToken, error) {
+	rt := RefreshToken{ClientID: clientID}
 	row := ts.db.QueryRow(`
-        SELECT user_id, expires_at
+        DELETE FROM refresh_tokens
+        WHERE token = $1 AND client_id = $2
+        RETURNING user_id, scope, expires_at
+    `, refreshToken, clientID)
+	if err := row.Scan(&rt.UserID, &rt.Scope, &rt.ExpiresAt); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrInvalidRefreshToken
+		}
+		return nil, err
+	}
+	if time.Now().After(rt.ExpiresAt) {
+		return nil, ErrRefreshTokenExpired
+	}
+	return &rt, nil
+}
+
+// LookupRefreshToken returns a valid refresh token, whichever client it was
+// issued to.
+func (ts *TokenService) LookupRefreshToken(refreshToken string) (*RefreshToken, error) {
+	var rt RefreshToken
+
+	row := ts.db.QueryRow(`
+        SELECT user_id, client_id, scope, expires_at
         FROM refresh_tokens
         WHERE token = $1
     `, refreshToken)
 
-	if err := row.Scan(&userID, &expiresAt); err != nil {
-		return "", errors.New("invalid refresh token or not found")
+	if err := row.Scan(&rt.UserID, &rt.ClientID, &rt.Scope, &rt.ExpiresAt); err != nil {
+		return nil, ErrInvalidRefreshToken
 	}
-	if time.Now().After(expiresAt) {
-		return "", errors.New("refresh token expired")
+	if time.Now().After(rt.ExpiresAt) {
+		return nil, ErrRefreshTokenExpired
 	}
-	return userID, nil
+	return &rt, nil
 }
 
 func (ts *TokenService) RevokeRefreshToken(refreshToken string) error {
 	_, err := ts.db.Exec("DELETE FROM refresh_tokens WHERE token = $1", refreshToken)
 	return err
 }
-
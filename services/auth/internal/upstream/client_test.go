@@ -0,0 +1,144 @@
+package upstream
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"platform/auth/internal/upstream/upstreamtest"
+)
+
+const redirectURL = "http://auth.example/login/oidc/callback"
+
+func newTestClient(t *testing.T) (*Client, *upstreamtest.Issuer) {
+	t.Helper()
+	iss := upstreamtest.NewIssuer("platform", "s3cret")
+	t.Cleanup(iss.Close)
+	c := NewClient(Config{
+		Issuer:       iss.URL,
+		ClientID:     "platform",
+		ClientSecret: "s3cret",
+		RedirectURL:  redirectURL,
+	})
+	return c, iss
+}
+
+func newLoginState(t *testing.T) *LoginState {
+	t.Helper()
+	state, _ := randomToken()
+	nonce, _ := randomToken()
+	verifier, _ := randomToken()
+	sum := sha256.Sum256([]byte(verifier))
+	return &LoginState{
+		State:         state,
+		Nonce:         nonce,
+		CodeVerifier:  verifier,
+		CodeChallenge: base64.RawURLEncoding.EncodeToString(sum[:]),
+	}
+}
+
+// authorize follows the redirect to the issuer and returns the code and
+// state it sends back to the callback.
+func authorize(t *testing.T, c *Client, ls *LoginState) (code, state string) {
+	t.Helper()
+	authURL, err := c.AuthCodeURL(context.Background(), ls.State, ls.Nonce, ls.CodeChallenge)
+	if err != nil {
+		t.Fatalf("AuthCodeURL: %v", err)
+	}
+	browser := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := browser.Get(authURL)
+	if err != nil {
+		t.Fatalf("GET authorize: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("authorize returned %d, want 302", resp.StatusCode)
+	}
+	callback, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatalf("invalid callback location: %v", err)
+	}
+	if got := callback.Scheme + "://" + callback.Host + callback.Path; got != redirectURL {
+		t.Fatalf("redirected to %s, want %s", got, redirectURL)
+	}
+	return callback.Query().Get("code"), callback.Query().Get("state")
+}
+
+func TestLoginFlow(t *testing.T) {
+	c, iss := newTestClient(t)
+	iss.Subject = "user-1"
+	iss.Email = "user-1@example.com"
+	ls := newLoginState(t)
+
+	code, state := authorize(t, c, ls)
+	if state != ls.State {
+		t.Fatalf("callback state %q, want %q", state, ls.State)
+	}
+	rawIDToken, err := c.Exchange(context.Background(), code, ls.CodeVerifier)
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+	claims, err := c.VerifyIDToken(context.Background(), rawIDToken, ls.Nonce)
+	if err != nil {
+		t.Fatalf("VerifyIDToken: %v", err)
+	}
+	if claims.Subject != "user-1" || claims.Email != "user-1@example.com" || !claims.EmailVerified {
+		t.Fatalf("unexpected claims %+v", claims)
+	}
+}
+
+func TestExchangeRejectsWrongVerifier(t *testing.T) {
+	c, _ := newTestClient(t)
+	ls := newLoginState(t)
+
+	code, _ := authorize(t, c, ls)
+	if _, err := c.Exchange(context.Background(), code, ls.CodeVerifier+"x"); err == nil {
+		t.Fatal("Exchange succeeded with a wrong code_verifier")
+	}
+}
+
+func TestExchangeRedeemsCodeOnce(t *testing.T) {
+	c, _ := newTestClient(t)
+	ls := newLoginState(t)
+
+	code, _ := authorize(t, c, ls)
+	if _, err := c.Exchange(context.Background(), code, ls.CodeVerifier); err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+	if _, err := c.Exchange(context.Background(), code, ls.CodeVerifier); err == nil {
+		t.Fatal("a code was redeemed twice")
+	}
+}
+
+func TestVerifyIDTokenRejectsNonceMismatch(t *testing.T) {
+	c, iss := newTestClient(t)
+
+	rawIDToken, err := iss.SignIDToken("other-nonce")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.VerifyIDToken(context.Background(), rawIDToken, "expected-nonce")
+	if !errors.Is(err, ErrNonceMismatch) {
+		t.Fatalf("got %v, want ErrNonceMismatch", err)
+	}
+}
+
+func TestVerifyIDTokenRejectsOtherIssuer(t *testing.T) {
+	c, _ := newTestClient(t)
+	other := upstreamtest.NewIssuer("platform", "s3cret")
+	defer other.Close()
+
+	rawIDToken, err := other.SignIDToken("nonce")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.VerifyIDToken(context.Background(), rawIDToken, "nonce"); err == nil {
+		t.Fatal("accepted an ID token of another issuer")
+	}
+}
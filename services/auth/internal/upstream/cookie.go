@@ -0,0 +1,39 @@
+package upstream
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// StateCookie holds the state of a login in the browser that started it,
+// so a callback carrying a state from another browser is rejected.
+const StateCookie = "oidc_login_state"
+
+var ErrStateMismatch = errors.New("login state does not match this browser")
+
+// SetStateCookie binds state to the browser. The cookie is sent on the
+// top-level redirect back from the upstream provider, but not on
+// cross-site subrequests.
+func SetStateCookie(w http.ResponseWriter, state string, ttl time.Duration, secure bool) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     StateCookie,
+		Value:    state,
+		MaxAge:   int(ttl.Seconds()),
+		HttpOnly: true,
+		Secure:   secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// CheckStateCookie verifies that the browser calling back started the login
+// for state, and clears the cookie.
+func CheckStateCookie(w http.ResponseWriter, r *http.Request, state string) error {
+	cookie, err := r.Cookie(StateCookie)
+	http.SetCookie(w, &http.Cookie{Name: StateCookie, MaxAge: -1, HttpOnly: true})
+	if err != nil || state == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+		return ErrStateMismatch
+	}
+	return nil
+}
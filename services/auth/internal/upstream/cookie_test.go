@@ -0,0 +1,54 @@
+package upstream
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// callback returns a callback request carrying the cookies set by w.
+func callback(w *httptest.ResponseRecorder) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/login/oidc/callback", nil)
+	for _, c := range w.Result().Cookies() {
+		r.AddCookie(c)
+	}
+	return r
+}
+
+func TestStateCookie(t *testing.T) {
+	start := httptest.NewRecorder()
+	SetStateCookie(start, "state-1", 10*time.Minute, true)
+
+	cookies := start.Result().Cookies()
+	if len(cookies) != 1 || !cookies[0].HttpOnly || !cookies[0].Secure || cookies[0].SameSite != http.SameSiteLaxMode {
+		t.Fatalf("unexpected cookie %+v", cookies)
+	}
+
+	w := httptest.NewRecorder()
+	if err := CheckStateCookie(w, callback(start), "state-1"); err != nil {
+		t.Fatalf("CheckStateCookie: %v", err)
+	}
+	if cleared := w.Result().Cookies(); len(cleared) != 1 || cleared[0].MaxAge >= 0 {
+		t.Fatalf("cookie not cleared: %+v", cleared)
+	}
+}
+
+func TestStateCookieRejectsOtherState(t *testing.T) {
+	start := httptest.NewRecorder()
+	SetStateCookie(start, "victim-state", 10*time.Minute, false)
+
+	err := CheckStateCookie(httptest.NewRecorder(), callback(start), "attacker-state")
+	if !errors.Is(err, ErrStateMismatch) {
+		t.Fatalf("got %v, want ErrStateMismatch", err)
+	}
+}
+
+func TestStateCookieRejectsMissingCookie(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/login/oidc/callback", nil)
+	err := CheckStateCookie(httptest.NewRecorder(), r, "state-1")
+	if !errors.Is(err, ErrStateMismatch) {
+		t.Fatalf("got %v, want ErrStateMismatch", err)
+	}
+}
@@ -0,0 +1,95 @@
+package upstream
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+var ErrInvalidState = errors.New("invalid or expired login state")
+
+// LoginState is what we remember between redirecting the user upstream and
+// receiving the callback.
+type LoginState struct {
+	State         string
+	Nonce         string
+	CodeVerifier  string
+	CodeChallenge string
+}
+
+type StateService struct {
+	db  *sql.DB
+	ttl time.Duration
+}
+
+func NewStateService(db *sql.DB, ttl time.Duration) *StateService {
+	return &StateService{db: db, ttl: ttl}
+}
+
+// NewLoginState generates and stores a fresh state, nonce and PKCE verifier.
+func (ss *StateService) NewLoginState() (*LoginState, error) {
+	state, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	verifier, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256([]byte(verifier))
+
+	_, err = ss.db.Exec(`
+        INSERT INTO upstream_login_states (state_hash, nonce, code_verifier, expires_at)
+        VALUES ($1, $2, $3, $4)
+    `, hashState(state), nonce, verifier, time.Now().Add(ss.ttl))
+	if err != nil {
+		return nil, err
+	}
+
+	return &LoginState{
+		State:         state,
+		Nonce:         nonce,
+		CodeVerifier:  verifier,
+		CodeChallenge: base64.RawURLEncoding.EncodeToString(sum[:]),
+	}, nil
+}
+
+// ConsumeLoginState looks up and deletes state, so each one is usable once.
+func (ss *StateService) ConsumeLoginState(state string) (*LoginState, error) {
+	row := ss.db.QueryRow(`
+        DELETE FROM upstream_login_states
+        WHERE state_hash = $1
+        RETURNING nonce, code_verifier, expires_at
+    `, hashState(state))
+
+	ls := &LoginState{State: state}
+	var expiresAt time.Time
+	if err := row.Scan(&ls.Nonce, &ls.CodeVerifier, &expiresAt); err != nil {
+		return nil, ErrInvalidState
+	}
+	if time.Now().After(expiresAt) {
+		return nil, ErrInvalidState
+	}
+	return ls, nil
+}
+
+func hashState(state string) string {
+	sum := sha256.Sum256([]byte(state))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
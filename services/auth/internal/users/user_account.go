@@ -0,0 +1,223 @@
+package users
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var ErrInvalidEmailToken = errors.New("invalid or expired email verification token")
+
+const emailChangeTTL = 24 * time.Hour
+
+func (us *UserService) UpdateDisplayName(id, displayName string) error {
+	res, err := us.db.Exec("UPDATE users SET display_name = $1 WHERE id = $2", displayName, id)
+	if err != nil {
+		return err
+	}
+	return expectOneRow(res)
+}
+
+// RequestEmailChange records a pending change to newEmail and returns the
+// token that confirms it. The address on the account only changes once the
+// token is confirmed, proving the user controls the new address.
+func (us *UserService) RequestEmailChange(id, newEmail string) (string, error) {
+	var taken bool
+	err := us.db.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE email = $1)", newEmail).Scan(&taken)
+	if err != nil {
+		return "", err
+	}
+	if taken {
+		return "", ErrEmailTaken
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+
+	_, err = us.db.Exec(`
+        INSERT INTO email_changes (token_hash, user_id, new_email, expires_at)
+        VALUES ($1, $2, $3, $4)
+    `, hashToken(token), id, newEmail, time.Now().Add(emailChangeTTL))
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// ConfirmEmailChange applies the pending change for token and marks the new
+// address verified.
+func (us *UserService) ConfirmEmailChange(id, token string) error {
+	tx, err := us.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var newEmail string
+	var expiresAt time.Time
+	err = tx.QueryRow(`
+        DELETE FROM email_changes
+        WHERE token_hash = $1 AND user_id = $2
+        RETURNING new_email, expires_at
+    `, hashToken(token), id).Scan(&newEmail, &expiresAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrInvalidEmailToken
+		}
+		return err
+	}
+	if time.Now().After(expiresAt) {
+		return ErrInvalidEmailToken
+	}
+
+	_, err = tx.Exec("UPDATE users SET email = $1, email_verified = TRUE WHERE id = $2", newEmail, id)
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			return ErrEmailTaken
+		}
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM email_changes WHERE user_id = $1", id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ChangePassword replaces the password after checking the current one and
+// revokes every refresh token except keepRefreshToken, ending the user's
+// other sessions.
+func (us *UserService) ChangePassword(id, currentPassword, newPassword, keepRefreshToken string) error {
+	user, err := us.GetActiveUserByID(id)
+	if err != nil {
+		return err
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(currentPassword)); err != nil {
+		return ErrInvalidCredentials
+	}
+
+	hashed, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	tx, err := us.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("UPDATE users SET password = $1 WHERE id = $2", string(hashed), id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM refresh_tokens WHERE user_id = $1 AND token <> $2", id, keepRefreshToken); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// DeleteUser removes the account and everything this service stores for it.
+func (us *UserService) DeleteUser(id string) error {
+	tx, err := us.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, q := range []string{
+		"DELETE FROM refresh_tokens WHERE user_id = $1",
+		"DELETE FROM api_keys WHERE user_id = $1",
+		"DELETE FROM user_identities WHERE user_id = $1",
+		"DELETE FROM email_changes WHERE user_id = $1",
+		"DELETE FROM authorization_codes WHERE user_id = $1",
+	} {
+		if _, err := tx.Exec(q, id); err != nil {
+			return err
+		}
+	}
+
+	res, err := tx.Exec("DELETE FROM users WHERE id = $1", id)
+	if err != nil {
+		return err
+	}
+	if err := expectOneRow(res); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ListUsers pages through users, optionally filtered by a case-insensitive
+// match on email or display name.
+func (us *UserService) ListUsers(query string, limit, offset int) ([]User, error) {
+	rows, err := us.db.Query(`
+        SELECT `+userColumns+`
+        FROM users
+        WHERE $1 = '' OR email ILIKE '%' || $1 || '%' OR display_name ILIKE '%' || $1 || '%'
+        ORDER BY created_at DESC, id
+        LIMIT $2 OFFSET $3
+    `, query, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []User{}
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, *u)
+	}
+	return list, rows.Err()
+}
+
+// SetDisabled enables or disables an account. Disabling also ends all of the
+// user's sessions; access tokens already issued expire on their own.
+func (us *UserService) SetDisabled(id string, disabled bool) error {
+	tx, err := us.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("UPDATE users SET disabled = $1 WHERE id = $2", disabled, id)
+	if err != nil {
+		return err
+	}
+	if err := expectOneRow(res); err != nil {
+		return err
+	}
+	if disabled {
+		if _, err := tx.Exec("DELETE FROM refresh_tokens WHERE user_id = $1", id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func expectOneRow(res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -1,8 +1,14 @@
 package users
 
+import "time"
+
 type User struct {
-	ID       string
-	Email    string
-	Password string
-	Roles    []string
+	ID            string    `json:"id"`
+	Email         string    `json:"email"`
+	Password      string    `json:"-"`
+	Roles         []string  `json:"roles"`
+	DisplayName   string    `json:"display_name"`
+	EmailVerified bool      `json:"email_verified"`
+	Disabled      bool      `json:"disabled"`
+	CreatedAt     time.Time `json:"created_at"`
 }
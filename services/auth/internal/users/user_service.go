@@ -4,11 +4,24 @@ import (
 	"database/sql"
 	"errors"
 	"strings"
+	"time"
 
 	"github.com/google/uuid"
 	"golang.org/x/crypto/bcrypt"
 )
 
+var (
+	ErrUserNotFound       = errors.New("user not found")
+	ErrUserDisabled       = errors.New("user account is disabled")
+	ErrInvalidCredentials = errors.New("invalid email or password")
+	ErrEmailTaken         = errors.New("email already in use")
+	// ErrIdentityNotLinked is returned by LoginWithIdentity when a local
+	// account has the identity's email but it cannot be linked to it.
+	ErrIdentityNotLinked = errors.New("an account with this email already exists; log in with its password instead")
+)
+
+const userColumns = "id, email, password, roles, display_name, email_verified, disabled, created_at"
+
 type UserService struct {
 	db *sql.DB
 }
@@ -42,26 +55,124 @@ func (us *UserService) RegisterUser(email, password string) error {
 }
 
 func (us *UserService) LoginUser(email, password string) (*User, error) {
-	row := us.db.QueryRow("SELECT id, password, roles FROM users WHERE email = $1", email)
-	var id, hashedPwd string
-	var rolesStr string
-	if err := row.Scan(&id, &hashedPwd, &rolesStr); err != nil {
-		return nil, errors.New("invalid email or password")
+	user, err := scanUser(us.db.QueryRow("SELECT "+userColumns+" FROM users WHERE email = $1", email))
+	if err != nil {
+		return nil, ErrInvalidCredentials
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)); err != nil {
+		return nil, ErrInvalidCredentials
+	}
+	if user.Disabled {
+		return nil, ErrUserDisabled
+	}
+	return user, nil
+}
+
+// GetUserByID returns the user whether or not the account is disabled.
+func (us *UserService) GetUserByID(id string) (*User, error) {
+	user, err := scanUser(us.db.QueryRow("SELECT "+userColumns+" FROM users WHERE id = $1", id))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrUserNotFound
+		}
+		return nil, err
 	}
+	return user, nil
+}
 
-	if err := bcrypt.CompareHashAndPassword([]byte(hashedPwd), []byte(password)); err != nil {
-		return nil, errors.New("invalid email or password")
+// GetActiveUserByID is GetUserByID for callers about to grant access, so
+// it rejects disabled accounts.
+func (us *UserService) GetActiveUserByID(id string) (*User, error) {
+	user, err := us.GetUserByID(id)
+	if err != nil {
+		return nil, err
 	}
+	if user.Disabled {
+		return nil, ErrUserDisabled
+	}
+	return user, nil
+}
+
+type scanner interface {
+	Scan(dest ...any) error
+}
 
+func scanUser(row scanner) (*User, error) {
+	var u User
+	var rolesStr string
+	if err := row.Scan(&u.ID, &u.Email, &u.Password, &rolesStr, &u.DisplayName,
+		&u.EmailVerified, &u.Disabled, &u.CreatedAt); err != nil {
+		return nil, err
+	}
+	u.Roles = parseRoles(rolesStr)
+	return &u, nil
+}
+
+func parseRoles(rolesStr string) []string {
 	roles := []string{"user"}
 	if strings.Contains(rolesStr, "admin") {
 		roles = append(roles, "admin")
 	}
+	return roles
+}
 
-	return &User{
-		ID:       id,
-		Email:    email,
-		Password: hashedPwd,
-		Roles:    roles,
-	}, nil
+// LoginWithIdentity returns the user linked to an external identity, linking
+// it on first login. An existing account is only linked by email when both
+// the upstream provider and the account have verified that email: anyone can
+// register an unverified account with someone else's address, and linking
+// it would log the address's owner into an account its registrant controls.
+// Without a matching account a new user is created.
+func (us *UserService) LoginWithIdentity(issuer, subject, email string, emailVerified bool) (*User, error) {
+	tx, err := us.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var userID string
+	var localVerified bool
+	err = tx.QueryRow("SELECT user_id FROM user_identities WHERE issuer = $1 AND subject = $2",
+		issuer, subject).Scan(&userID)
+	switch {
+	case err == nil:
+		if err := tx.Commit(); err != nil {
+			return nil, err
+		}
+		return us.GetActiveUserByID(userID)
+	case !errors.Is(err, sql.ErrNoRows):
+		return nil, err
+	}
+
+	if email == "" {
+		return nil, errors.New("identity provider did not return an email")
+	}
+
+	err = tx.QueryRow("SELECT id, email_verified FROM users WHERE email = $1", email).Scan(&userID, &localVerified)
+	switch {
+	case err == nil:
+		if !emailVerified || !localVerified {
+			return nil, ErrIdentityNotLinked
+		}
+	case errors.Is(err, sql.ErrNoRows):
+		// external users have no local password, so LoginUser always rejects them
+		userID = uuid.NewString()
+		_, err = tx.Exec("INSERT INTO users (id, email, password, roles, email_verified) VALUES ($1, $2, $3, $4, $5)",
+			userID, email, "", "{user}", emailVerified)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, err
+	}
+
+	_, err = tx.Exec(`INSERT INTO user_identities (issuer, subject, user_id, email, created_at)
+        VALUES ($1, $2, $3, $4, $5)`, issuer, subject, userID, email, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return us.GetActiveUserByID(userID)
 }
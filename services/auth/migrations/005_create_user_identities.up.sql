@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS user_identities (
+  issuer TEXT NOT NULL,
+  subject TEXT NOT NULL,
+  user_id TEXT NOT NULL,
+  email TEXT,
+  created_at TIMESTAMP NOT NULL,
+  PRIMARY KEY (issuer, subject)
+);
+
+CREATE TABLE IF NOT EXISTS upstream_login_states (
+  state_hash TEXT PRIMARY KEY,
+  nonce TEXT NOT NULL,
+  code_verifier TEXT NOT NULL,
+  expires_at TIMESTAMP NOT NULL
+);
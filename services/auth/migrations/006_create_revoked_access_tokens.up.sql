@@ -0,0 +1,4 @@
+CREATE TABLE IF NOT EXISTS revoked_access_tokens (
+  jti TEXT PRIMARY KEY,
+  expires_at TIMESTAMP NOT NULL
+);
@@ -0,0 +1,131 @@
+// Command agent is the entrypoint of function containers. It waits on stdin
+// for the function to run, unpacks its files into the working directory and
+// runs the function's process. When that exits, it serves the exit status
+// and result file on the result socket, see package agent, and exits too.
+//
+// Run as "agent result" it connects to the agent serving the result socket
+// and copies the result to stdout; the runner execs this to read the result
+// out of the container's tmpfs before the container stops.
+//
+// It must be built without cgo, as it runs on every runtime image.
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"platform/functions/internal/agent"
+)
+
+func main() {
+	run := runFunction
+	if len(os.Args) == 2 && os.Args[1] == agent.ResultCommand {
+		run = fetchResult
+	}
+	if err := run(); err != nil {
+		fmt.Fprintf(os.Stderr, "agent: %v\n", err)
+		os.Exit(125)
+	}
+}
+
+func runFunction() error {
+	// stdin is read unbuffered, so the function gets the rest of it
+	req, err := agent.Read(os.Stdin)
+	if err != nil {
+		return fmt.Errorf("reading request: %w", err)
+	}
+	if err := agent.Extract(bytes.NewReader(req.Files), "."); err != nil {
+		return fmt.Errorf("unpacking files: %w", err)
+	}
+
+	// the request's variables win, and PATH is also used to find the
+	// entrypoint
+	for _, kv := range req.Env {
+		key, value, _ := strings.Cut(kv, "=")
+		if err := os.Setenv(key, value); err != nil {
+			return err
+		}
+	}
+	bin, err := exec.LookPath(req.Entrypoint[0])
+	if err != nil {
+		return err
+	}
+
+	// listen before the function starts, so it cannot take the socket
+	ln, err := net.Listen("unix", agent.ResultSocket)
+	if err != nil {
+		return fmt.Errorf("result socket: %w", err)
+	}
+	defer ln.Close()
+
+	cmd := &exec.Cmd{
+		Path:   bin,
+		Args:   req.Entrypoint,
+		Stdin:  os.Stdin,
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	// as PID 1 the agent gets the signals meant for the function
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		for sig := range signals {
+			_ = cmd.Process.Signal(sig)
+		}
+	}()
+
+	res := &agent.Result{ExitCode: exitCode(cmd.Wait())}
+	res.Output, res.TooLarge, err = agent.ReadResultFile(os.Getenv("RESULT_PATH"))
+	if err != nil {
+		return fmt.Errorf("reading result: %w", err)
+	}
+
+	conn, err := ln.Accept()
+	if err != nil {
+		return fmt.Errorf("result socket: %w", err)
+	}
+	defer conn.Close()
+	if err := agent.WriteResult(conn, res); err != nil {
+		return fmt.Errorf("writing result: %w", err)
+	}
+	conn.Close()
+	os.Exit(res.ExitCode)
+	return nil
+}
+
+// exitCode is the function's exit code as a shell reports it, 128 plus the
+// signal for a process killed by one.
+func exitCode(err error) int {
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		return 125
+	}
+	if exitErr == nil {
+		return 0
+	}
+	if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return exitErr.ExitCode()
+}
+
+func fetchResult() error {
+	conn, err := net.Dial("unix", agent.ResultSocket)
+	if err != nil {
+		return fmt.Errorf("result socket: %w", err)
+	}
+	defer conn.Close()
+	_, err = io.Copy(os.Stdout, conn)
+	return err
+}
@@ -1,18 +1,26 @@
 package main
 
 import (
+	"context"
 	"log"
 	"os"
+	"path/filepath"
+	"strconv"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 	_ "github.com/lib/pq"
 
 	"platform/functions/internal/db"
+	"platform/functions/internal/domain/bundle"
 	"platform/functions/internal/domain/function"
 	"platform/functions/internal/domain/job"
+	"platform/functions/internal/domain/nonce"
 	"platform/functions/internal/executor"
+	"platform/functions/internal/runtimes"
 	httpTransport "platform/functions/internal/transport/http"
 )
 
@@ -22,6 +30,11 @@ func main() {
 		log.Fatal("FUNCTION_DB_DSN not set")
 	}
 
+	identitySecret := os.Getenv("INTERNAL_AUTH_SECRET")
+	if identitySecret == "" {
+		log.Fatal("INTERNAL_AUTH_SECRET not set")
+	}
+
 	dbConn, err := connectDB(dsn)
 	if err != nil {
 		log.Fatalf("failed to connect DB: %v", err)
@@ -34,19 +47,75 @@ func main() {
 
 	funcRepo := function.NewPostgresRepository(dbConn)
 	jobRepo := job.NewPostgresRepository(dbConn)
+	bundleRepo := bundle.NewPostgresRepository(dbConn)
+	nonceRepo := nonce.NewPostgresRepository(dbConn)
+
+	outputLimit := 1 << 20
+	if v := os.Getenv("JOB_OUTPUT_LIMIT_BYTES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			log.Fatalf("invalid JOB_OUTPUT_LIMIT_BYTES %q", v)
+		}
+		outputLimit = n
+	}
 
-	dockerRunner, err := executor.NewDockerRunner()
+	registry := runtimes.Default()
+	runtimesFile := os.Getenv("RUNTIMES_FILE")
+	if runtimesFile != "" {
+		registry, err = runtimes.Load(runtimesFile)
+		if err != nil {
+			log.Fatalf("failed to load runtimes: %v", err)
+		}
+	}
+
+	dockerRunner, err := executor.NewDockerRunner(outputLimit, sandbox(), registry, buildCache(), imagePolicy())
 	if err != nil {
 		log.Fatalf("failed to init DockerRunner: %v", err)
 	}
+	go dockerRunner.PrepullImages(context.Background())
+	if runtimesFile != "" {
+		go watchRuntimes(runtimesFile, registry, dockerRunner)
+	}
+
+	// every function container runs the agent
+	agentPath := os.Getenv("AGENT_BINARY")
+	if agentPath == "" {
+		agentPath = "/fn-agent"
+	}
+	agentBinary, err := os.ReadFile(agentPath)
+	if err != nil {
+		log.Fatalf("failed to read AGENT_BINARY: %v", err)
+	}
+	agentCtx, cancelAgent := context.WithTimeout(context.Background(), time.Minute)
+	err = dockerRunner.InstallAgent(agentCtx, agentBinary)
+	cancelAgent()
+	if err != nil {
+		log.Fatalf("failed to install the agent: %v", err)
+	}
+	dockerRunner.StartWarmPool(poolConfig())
+	defer dockerRunner.StopWarmPool()
 
-	execSvc := executor.NewExecutor(jobRepo, funcRepo, dockerRunner, 5)
+	worker := workerID()
+	builder := executor.NewBuilder(worker, funcRepo, bundleRepo, dockerRunner, 2)
+	builder.Start()
+	defer builder.Stop()
+
+	caps := limitCaps()
+	execSvc := executor.NewExecutor(worker, jobRepo, funcRepo, builder, dockerRunner, caps, 5)
 	execSvc.Start()
 	defer execSvc.Stop()
 
+	reaper := executor.NewReaper(jobRepo, funcRepo, dockerRunner, orphanPolicy(), 15*time.Second)
+	reaper.Start()
+	defer reaper.Stop()
+
+	collector := executor.NewCollector(funcRepo, bundleRepo, dockerRunner, time.Hour)
+	collector.Start()
+	defer collector.Stop()
+
 	r := gin.Default()
 
-	httpTransport.SetupRoutes(r, funcRepo, jobRepo, execSvc)
+	httpTransport.SetupRoutes(r, funcRepo, jobRepo, bundleRepo, nonceRepo, execSvc, builder, collector, dockerRunner, registry, caps, []byte(identitySecret))
 
 	log.Println("[Function-Service] listening on :8082")
 	if err := r.Run(":8082"); err != nil {
@@ -54,6 +123,192 @@ func main() {
 	}
 }
 
+// workerID identifies this replica in job leases. The random suffix keeps it
+// unique across restarts of the same container.
+func workerID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "functionservice"
+	}
+	return host + "-" + uuid.New().String()[:8]
+}
+
+// runtimesReloadInterval is how often RUNTIMES_FILE is checked for changes.
+const runtimesReloadInterval = 30 * time.Second
+
+// watchRuntimes reloads the registry from path whenever the file changes
+// and pre-pulls the images of the new runtimes. An invalid file is logged
+// and the registry keeps the runtimes it has.
+func watchRuntimes(path string, registry *runtimes.Registry, runner *executor.DockerRunner) {
+	ticker := time.NewTicker(runtimesReloadInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		changed, err := registry.Reload(path)
+		if err != nil {
+			log.Printf("[runtimes] failed to reload %s: %v\n", path, err)
+			continue
+		}
+		if changed {
+			log.Printf("[runtimes] reloaded %s\n", path)
+			runner.PrepullImages(context.Background())
+		}
+	}
+}
+
+// orphanPolicy reads what to do with jobs whose worker died:
+// ORPHANED_JOB_POLICY is "requeue" (the default) or "fail", and
+// ORPHANED_JOB_MAX_REQUEUES bounds requeues per job (default 3).
+func orphanPolicy() executor.OrphanPolicy {
+	policy := executor.OrphanPolicy{Requeue: true, MaxRequeues: 3}
+	switch v := os.Getenv("ORPHANED_JOB_POLICY"); v {
+	case "", "requeue":
+	case "fail":
+		policy.Requeue = false
+	default:
+		log.Fatalf("invalid ORPHANED_JOB_POLICY %q", v)
+	}
+	if v := os.Getenv("ORPHANED_JOB_MAX_REQUEUES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			log.Fatalf("invalid ORPHANED_JOB_MAX_REQUEUES %q", v)
+		}
+		policy.MaxRequeues = n
+	}
+	return policy
+}
+
+// sandbox reads the function container sandbox: SANDBOX_TMPFS_SIZE_MB sizes
+// /tmp, SANDBOX_WORKSPACE_SIZE_MB the working directory holding the
+// function's files and result, and SANDBOX_SECCOMP_PROFILE names a file that
+// replaces the built-in seccomp profile.
+func sandbox() executor.Sandbox {
+	sb := executor.DefaultSandbox()
+	for env, size := range map[string]*int{
+		"SANDBOX_TMPFS_SIZE_MB":     &sb.TmpfsSizeMB,
+		"SANDBOX_WORKSPACE_SIZE_MB": &sb.WorkspaceSizeMB,
+	} {
+		if v := os.Getenv(env); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				log.Fatalf("invalid %s %q", env, v)
+			}
+			*size = n
+		}
+	}
+	if path := os.Getenv("SANDBOX_SECCOMP_PROFILE"); path != "" {
+		profile, err := os.ReadFile(path)
+		if err != nil {
+			log.Fatalf("failed to read SANDBOX_SECCOMP_PROFILE: %v", err)
+		}
+		sb.SeccompProfile = string(profile)
+	}
+	return sb
+}
+
+// buildCache reads where build artifacts are kept: BUILD_CACHE_DIR (default
+// a directory under the system's temporary directory), holding at most
+// BUILD_CACHE_MAX_MB (default 1024) of them and WORKSPACE_CACHE_MAX_MB
+// (default 1024) of version files.
+func buildCache() executor.CacheConfig {
+	cache := executor.CacheConfig{
+		Dir:                os.Getenv("BUILD_CACHE_DIR"),
+		MaxBytes:           1024 << 20,
+		WorkspacesMaxBytes: 1024 << 20,
+	}
+	if cache.Dir == "" {
+		cache.Dir = filepath.Join(os.TempDir(), "fn-build-cache")
+	}
+	for env, limit := range map[string]*int64{
+		"BUILD_CACHE_MAX_MB":     &cache.MaxBytes,
+		"WORKSPACE_CACHE_MAX_MB": &cache.WorkspacesMaxBytes,
+	} {
+		if v := os.Getenv(env); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				log.Fatalf("invalid %s %q", env, v)
+			}
+			*limit = int64(n) << 20
+		}
+	}
+	return cache
+}
+
+// imagePolicy reads how runtime images are pulled: IMAGE_PULL_POLICY is
+// "if-not-present" (the default), "always" or "never", and
+// REGISTRY_AUTH_FILE names a Docker config file, as written by docker login,
+// with the credentials of private registries.
+func imagePolicy() executor.ImagePolicy {
+	policy := executor.DefaultImagePolicy()
+	if v := os.Getenv("IMAGE_PULL_POLICY"); v != "" {
+		pull, err := executor.ParsePullPolicy(v)
+		if err != nil {
+			log.Fatalf("invalid IMAGE_PULL_POLICY: %v", err)
+		}
+		policy.Pull = pull
+	}
+	if path := os.Getenv("REGISTRY_AUTH_FILE"); path != "" {
+		auth, err := executor.LoadRegistryAuth(path)
+		if err != nil {
+			log.Fatalf("failed to read REGISTRY_AUTH_FILE: %v", err)
+		}
+		policy.Auth = auth
+	}
+	return policy
+}
+
+// poolConfig reads the warm pool size of runtimes that do not set their
+// own: WARM_POOL_MIN_IDLE (default 1) and WARM_POOL_MAX_IDLE (default 4)
+// containers per runtime, and WARM_POOL_IDLE_TTL (default 5m) for the ones
+// above the minimum. A maximum of 0 disables the pool.
+func poolConfig() executor.PoolConfig {
+	cfg := executor.PoolConfig{MinIdle: 1, MaxIdle: 4, IdleTTL: 5 * time.Minute}
+	for env, n := range map[string]*int{
+		"WARM_POOL_MIN_IDLE": &cfg.MinIdle,
+		"WARM_POOL_MAX_IDLE": &cfg.MaxIdle,
+	} {
+		if v := os.Getenv(env); v != "" {
+			var err error
+			*n, err = strconv.Atoi(v)
+			if err != nil || *n < 0 {
+				log.Fatalf("invalid %s %q", env, v)
+			}
+		}
+	}
+	if cfg.MaxIdle < cfg.MinIdle {
+		log.Fatalf("WARM_POOL_MAX_IDLE %d is below WARM_POOL_MIN_IDLE %d", cfg.MaxIdle, cfg.MinIdle)
+	}
+	if v := os.Getenv("WARM_POOL_IDLE_TTL"); v != "" {
+		ttl, err := time.ParseDuration(v)
+		if err != nil || ttl <= 0 {
+			log.Fatalf("invalid WARM_POOL_IDLE_TTL %q", v)
+		}
+		cfg.IdleTTL = ttl
+	}
+	return cfg
+}
+
+// limitCaps reads the platform-wide maximums for function limits from
+// FUNCTION_MAX_TIMEOUT_MS, FUNCTION_MAX_MEMORY_MB, FUNCTION_MAX_CPU_MILLICORES
+// and FUNCTION_MAX_PIDS, falling back to function.DefaultLimitCaps.
+func limitCaps() function.Limits {
+	caps := function.DefaultLimitCaps()
+	for env, limit := range map[string]*int{
+		"FUNCTION_MAX_TIMEOUT_MS":     &caps.TimeoutMs,
+		"FUNCTION_MAX_MEMORY_MB":      &caps.MemoryMB,
+		"FUNCTION_MAX_CPU_MILLICORES": &caps.CPUMillicores,
+		"FUNCTION_MAX_PIDS":           &caps.MaxPIDs,
+	} {
+		if v := os.Getenv(env); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				log.Fatalf("invalid %s %q", env, v)
+			}
+			*limit = n
+		}
+	}
+	return caps
+}
+
 func connectDB(dsn string) (*sqlx.DB, error) {
 	db, err := sqlx.Open("postgres", dsn)
 	if err != nil {
@@ -0,0 +1,144 @@
+// Package agent is the protocol between the runner and the agent that runs
+// in every function container. The agent starts as the container's entrypoint
+// and waits; the runner then writes a Request to the container's stdin,
+// followed by the job's input. A warm container sits idle in between until a
+// job claims it. The agent unpacks the function's files into its working
+// directory and runs the function's process, which reads the rest of stdin
+// as usual. When the function exits, the agent hands its Result to the
+// runner over ResultSocket.
+package agent
+
+import (
+	"archive/tar"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Request tells the agent what to run.
+type Request struct {
+	// Entrypoint is the function's command line.
+	Entrypoint []string `json:"entrypoint"`
+	// Env is added to the agent's environment.
+	Env []string `json:"env,omitempty"`
+	// Files is a tar of the function's files.
+	Files []byte `json:"-"`
+}
+
+// maxHeaderBytes caps the encoded request, without its files.
+const maxHeaderBytes = 1 << 20
+
+// maxFilesBytes caps the files of a request.
+const maxFilesBytes = 512 << 20
+
+// Write encodes req as a length-prefixed JSON header followed by the
+// length-prefixed files.
+func Write(w io.Writer, req *Request) error {
+	header, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	var lengths [12]byte
+	binary.BigEndian.PutUint32(lengths[:4], uint32(len(header)))
+	binary.BigEndian.PutUint64(lengths[4:], uint64(len(req.Files)))
+	if _, err := w.Write(lengths[:4]); err != nil {
+		return err
+	}
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	if _, err := w.Write(lengths[4:]); err != nil {
+		return err
+	}
+	_, err = w.Write(req.Files)
+	return err
+}
+
+// Read decodes a request. It reads exactly the bytes Write wrote, so
+// whatever follows in r is left for the function.
+func Read(r io.Reader) (*Request, error) {
+	var n [8]byte
+	if _, err := io.ReadFull(r, n[:4]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(n[:4])
+	if size > maxHeaderBytes {
+		return nil, fmt.Errorf("request header of %d bytes is too large", size)
+	}
+	header := make([]byte, size)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	var req Request
+	if err := json.Unmarshal(header, &req); err != nil {
+		return nil, err
+	}
+	if len(req.Entrypoint) == 0 {
+		return nil, errors.New("request without an entrypoint")
+	}
+
+	if _, err := io.ReadFull(r, n[:]); err != nil {
+		return nil, err
+	}
+	filesSize := binary.BigEndian.Uint64(n[:])
+	if filesSize > maxFilesBytes {
+		return nil, fmt.Errorf("request files of %d bytes are too large", filesSize)
+	}
+	req.Files = make([]byte, filesSize)
+	if _, err := io.ReadFull(r, req.Files); err != nil {
+		return nil, err
+	}
+	return &req, nil
+}
+
+// Extract unpacks the regular files and directories of a tar into dir.
+// Names that leave dir are rejected.
+func Extract(files io.Reader, dir string) error {
+	tr := tar.NewReader(files)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := filepath.Clean(filepath.FromSlash(hdr.Name))
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("file name %q leaves the working directory", hdr.Name)
+		}
+		target := filepath.Join(dir, name)
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0o755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+				return err
+			}
+			if err := writeFile(target, os.FileMode(hdr.Mode).Perm(), tr); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("%s is not a regular file", hdr.Name)
+		}
+	}
+}
+
+func writeFile(name string, perm os.FileMode, r io.Reader) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,144 @@
+package agent
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type file struct {
+	name     string
+	typeflag byte
+	body     string
+}
+
+func tarOf(t *testing.T, files ...file) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, f := range files {
+		hdr := &tar.Header{Name: f.name, Typeflag: f.typeflag, Mode: 0o644, Size: int64(len(f.body))}
+		if f.typeflag == tar.TypeDir {
+			hdr.Mode = 0o755
+		}
+		if f.typeflag == tar.TypeSymlink {
+			hdr.Linkname = f.body
+			hdr.Size = 0
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Size > 0 {
+			if _, err := tw.Write([]byte(f.body)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestReadWrite(t *testing.T) {
+	req := &Request{
+		Entrypoint: []string{"python", "-u", "main.py"},
+		Env:        []string{"PYTHONPATH=/opt/deps"},
+		Files:      tarOf(t, file{name: "main.py", typeflag: tar.TypeReg, body: "print(1)"}),
+	}
+	var buf bytes.Buffer
+	if err := Write(&buf, req); err != nil {
+		t.Fatal(err)
+	}
+	buf.WriteString(`{"input":true}`)
+
+	got, err := Read(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, req) {
+		t.Errorf("Read = %+v, want %+v", got, req)
+	}
+	// the input is left for the function
+	if rest, _ := io.ReadAll(&buf); string(rest) != `{"input":true}` {
+		t.Errorf("input after the request is %q", rest)
+	}
+}
+
+func TestReadLimits(t *testing.T) {
+	lengths := func(header uint32, header2 string, files uint64) []byte {
+		var b bytes.Buffer
+		binary.Write(&b, binary.BigEndian, header)
+		b.WriteString(header2)
+		binary.Write(&b, binary.BigEndian, files)
+		return b.Bytes()
+	}
+	entrypoint := `{"entrypoint":["true"]}`
+	for name, tc := range map[string]struct {
+		data []byte
+		want string
+	}{
+		"header too large": {lengths(maxHeaderBytes+1, "", 0), "too large"},
+		"files too large":  {lengths(uint32(len(entrypoint)), entrypoint, maxFilesBytes+1), "too large"},
+		"no entrypoint":    {lengths(2, "{}", 0), "without an entrypoint"},
+		"truncated files":  {lengths(uint32(len(entrypoint)), entrypoint, 10), "EOF"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := Read(bytes.NewReader(tc.data))
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("Read: %v, want an error containing %q", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestExtract(t *testing.T) {
+	dir := t.TempDir()
+	files := tarOf(t,
+		file{name: "lib/", typeflag: tar.TypeDir},
+		file{name: "lib/util.py", typeflag: tar.TypeReg, body: "x = 1"},
+		file{name: "./main.py", typeflag: tar.TypeReg, body: "import lib.util"},
+	)
+	if err := Extract(bytes.NewReader(files), dir); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{"lib/util.py": "x = 1", "main.py": "import lib.util"} {
+		got, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("%s holds %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestExtractRejects(t *testing.T) {
+	for name, f := range map[string]file{
+		"parent":         {name: "../escape.py", typeflag: tar.TypeReg, body: "x"},
+		"nested parent":  {name: "lib/../../escape.py", typeflag: tar.TypeReg, body: "x"},
+		"absolute":       {name: "/etc/escape.py", typeflag: tar.TypeReg, body: "x"},
+		"symlink":        {name: "link", typeflag: tar.TypeSymlink, body: "/etc/passwd"},
+		"parent as name": {name: "..", typeflag: tar.TypeDir},
+	} {
+		t.Run(name, func(t *testing.T) {
+			parent := t.TempDir()
+			dir := filepath.Join(parent, "work")
+			if err := os.Mkdir(dir, 0o755); err != nil {
+				t.Fatal(err)
+			}
+			if err := Extract(bytes.NewReader(tarOf(t, f)), dir); err == nil {
+				t.Fatalf("Extract accepted %q", f.name)
+			}
+			if _, err := os.Stat(filepath.Join(parent, "escape.py")); err == nil {
+				t.Error("a file was written outside the working directory")
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+package agent
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+// ResultSocket is the abstract unix socket the agent listens on while the
+// function runs. Once the function exits, the agent writes its Result to the
+// first connection and exits as well. The socket lives in the container's
+// network namespace, so only processes inside the container reach it; the
+// runner connects by exec'ing the agent with ResultCommand.
+const ResultSocket = "@fn-agent"
+
+// ResultCommand is the argument that makes the agent fetch the Result from
+// the agent serving ResultSocket and copy it to stdout.
+const ResultCommand = "result"
+
+// MaxResultBytes caps the result file of a function.
+const MaxResultBytes = 1 << 20
+
+// Result is how a function run ended.
+type Result struct {
+	// ExitCode is the function's exit code, or 128 plus the signal that
+	// killed it.
+	ExitCode int
+	// Output is the content of the result file, or nil if the function
+	// wrote none.
+	Output []byte
+	// TooLarge is set instead of Output when the result file exceeds
+	// MaxResultBytes.
+	TooLarge bool
+}
+
+// WriteResult encodes res as its exit code, a flag byte and the
+// length-prefixed output.
+func WriteResult(w io.Writer, res *Result) error {
+	var header [9]byte
+	binary.BigEndian.PutUint32(header[:4], uint32(int32(res.ExitCode)))
+	if res.TooLarge {
+		header[4] = 1
+	}
+	binary.BigEndian.PutUint32(header[5:], uint32(len(res.Output)))
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(res.Output)
+	return err
+}
+
+// ReadResult decodes a result written by WriteResult.
+func ReadResult(r io.Reader) (*Result, error) {
+	var header [9]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	res := &Result{
+		ExitCode: int(int32(binary.BigEndian.Uint32(header[:4]))),
+		TooLarge: header[4] == 1,
+	}
+	size := binary.BigEndian.Uint32(header[5:])
+	if size > MaxResultBytes {
+		return nil, fmt.Errorf("result of %d bytes is too large", size)
+	}
+	if size > 0 {
+		res.Output = make([]byte, size)
+		if _, err := io.ReadFull(r, res.Output); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// ReadResultFile reads the result file a function wrote at path. A missing
+// file is no output.
+func ReadResultFile(path string) (output []byte, tooLarge bool, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	defer f.Close()
+	output, err = io.ReadAll(io.LimitReader(f, MaxResultBytes+1))
+	if err != nil {
+		return nil, false, err
+	}
+	if len(output) > MaxResultBytes {
+		return nil, true, nil
+	}
+	return output, false, nil
+}
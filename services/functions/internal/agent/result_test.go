@@ -0,0 +1,65 @@
+package agent
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestResultReadWrite(t *testing.T) {
+	for _, res := range []*Result{
+		{ExitCode: 0, Output: []byte(`{"ok":true}`)},
+		{ExitCode: 137},
+		{ExitCode: -1, TooLarge: true},
+	} {
+		var buf bytes.Buffer
+		if err := WriteResult(&buf, res); err != nil {
+			t.Fatal(err)
+		}
+		got, err := ReadResult(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, res) {
+			t.Errorf("ReadResult = %+v, want %+v", got, res)
+		}
+	}
+}
+
+func TestReadResultTooLarge(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteResult(&buf, &Result{Output: make([]byte, MaxResultBytes+1)}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadResult(&buf); err == nil {
+		t.Error("ReadResult accepted a result over MaxResultBytes")
+	}
+}
+
+func TestReadResultFile(t *testing.T) {
+	dir := t.TempDir()
+
+	output, tooLarge, err := ReadResultFile(filepath.Join(dir, "missing"))
+	if err != nil || output != nil || tooLarge {
+		t.Errorf("missing file: %q, %v, %v, want no output", output, tooLarge, err)
+	}
+
+	path := filepath.Join(dir, "result.json")
+	if err := os.WriteFile(path, []byte(`[1,2]`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	output, tooLarge, err = ReadResultFile(path)
+	if err != nil || string(output) != `[1,2]` || tooLarge {
+		t.Errorf("result file: %q, %v, %v, want [1,2]", output, tooLarge, err)
+	}
+
+	if err := os.WriteFile(path, make([]byte, MaxResultBytes+1), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	output, tooLarge, err = ReadResultFile(path)
+	if err != nil || output != nil || !tooLarge {
+		t.Errorf("large result file: %d bytes, %v, %v, want too large", len(output), tooLarge, err)
+	}
+}
@@ -22,6 +22,108 @@ func RunMigrations(db *sqlx.DB) error {
 			created_at TIMESTAMP NOT NULL,
 			updated_at TIMESTAMP NOT NULL
 		)`,
+		`ALTER TABLE jobs ADD COLUMN IF NOT EXISTS owner TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE functions ADD COLUMN IF NOT EXISTS updated_at TIMESTAMP NOT NULL DEFAULT NOW()`,
+		`ALTER TABLE functions ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP`,
+		`ALTER TABLE functions ADD COLUMN IF NOT EXISTS version INT NOT NULL DEFAULT 1`,
+		`CREATE TABLE IF NOT EXISTS function_versions (
+			function_id UUID NOT NULL,
+			version INT NOT NULL,
+			code TEXT NOT NULL,
+			language TEXT NOT NULL,
+			created_at TIMESTAMP NOT NULL,
+			PRIMARY KEY (function_id, version)
+		)`,
+		`INSERT INTO function_versions (function_id, version, code, language, created_at)
+		 SELECT id, version, code, language, updated_at FROM functions
+		 ON CONFLICT DO NOTHING`,
+		`CREATE TABLE IF NOT EXISTS function_aliases (
+			function_id UUID NOT NULL,
+			name TEXT NOT NULL,
+			version INT NOT NULL,
+			updated_at TIMESTAMP NOT NULL,
+			PRIMARY KEY (function_id, name)
+		)`,
+		`ALTER TABLE jobs ADD COLUMN IF NOT EXISTS function_version INT NOT NULL DEFAULT 1`,
+		`ALTER TABLE jobs ADD COLUMN IF NOT EXISTS input JSONB NOT NULL DEFAULT 'null'`,
+		`ALTER TABLE jobs ADD COLUMN IF NOT EXISTS output JSONB NOT NULL DEFAULT 'null'`,
+		`ALTER TABLE jobs ADD COLUMN IF NOT EXISTS stdout TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE jobs ADD COLUMN IF NOT EXISTS stderr TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE jobs ADD COLUMN IF NOT EXISTS exit_code INT`,
+		`ALTER TABLE jobs ADD COLUMN IF NOT EXISTS truncated BOOLEAN NOT NULL DEFAULT FALSE`,
+		`ALTER TABLE jobs ADD COLUMN IF NOT EXISTS started_at TIMESTAMP`,
+		`ALTER TABLE jobs ADD COLUMN IF NOT EXISTS finished_at TIMESTAMP`,
+		`ALTER TABLE jobs ADD COLUMN IF NOT EXISTS duration_ms BIGINT`,
+		`UPDATE jobs SET result = '' WHERE result IS NULL`,
+		`ALTER TABLE jobs ADD COLUMN IF NOT EXISTS cancel_requested BOOLEAN NOT NULL DEFAULT FALSE`,
+		`CREATE INDEX IF NOT EXISTS jobs_queued_idx ON jobs (created_at) WHERE status = 'queued'`,
+		`ALTER TABLE jobs ADD COLUMN IF NOT EXISTS worker_id TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE jobs ADD COLUMN IF NOT EXISTS lease_expires_at TIMESTAMP`,
+		`ALTER TABLE jobs ADD COLUMN IF NOT EXISTS recoveries INT NOT NULL DEFAULT 0`,
+		// jobs left running by a version without leases are treated as expired
+		`UPDATE jobs SET lease_expires_at = updated_at WHERE status = 'running' AND lease_expires_at IS NULL`,
+		`ALTER TABLE functions ADD COLUMN IF NOT EXISTS retry_max_attempts INT NOT NULL DEFAULT 3`,
+		`ALTER TABLE functions ADD COLUMN IF NOT EXISTS retry_backoff_ms INT NOT NULL DEFAULT 1000`,
+		`ALTER TABLE functions ADD COLUMN IF NOT EXISTS retry_max_backoff_ms INT NOT NULL DEFAULT 30000`,
+		`ALTER TABLE functions ADD COLUMN IF NOT EXISTS retry_on TEXT[] NOT NULL DEFAULT '{infrastructure}'`,
+		`ALTER TABLE jobs ADD COLUMN IF NOT EXISTS attempts INT NOT NULL DEFAULT 0`,
+		`ALTER TABLE jobs ADD COLUMN IF NOT EXISTS run_after TIMESTAMP NOT NULL DEFAULT NOW()`,
+		`DROP INDEX IF EXISTS jobs_queued_idx`,
+		`CREATE INDEX IF NOT EXISTS jobs_runnable_idx ON jobs (run_after) WHERE status = 'queued'`,
+		`CREATE TABLE IF NOT EXISTS job_attempts (
+			job_id UUID NOT NULL,
+			attempt INT NOT NULL,
+			worker_id TEXT NOT NULL,
+			status TEXT NOT NULL,
+			error_class TEXT NOT NULL DEFAULT '',
+			error TEXT NOT NULL DEFAULT '',
+			exit_code INT,
+			started_at TIMESTAMP NOT NULL,
+			finished_at TIMESTAMP NOT NULL,
+			PRIMARY KEY (job_id, attempt)
+		)`,
+		`ALTER TABLE jobs ADD COLUMN IF NOT EXISTS attempt_offset INT NOT NULL DEFAULT 0`,
+		`ALTER TABLE jobs ADD COLUMN IF NOT EXISTS error_class TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE jobs ADD COLUMN IF NOT EXISTS dead_lettered_at TIMESTAMP`,
+		`ALTER TABLE jobs ADD COLUMN IF NOT EXISTS source_job_id UUID`,
+		`CREATE INDEX IF NOT EXISTS jobs_dead_lettered_idx ON jobs (dead_lettered_at) WHERE status = 'dead_lettered'`,
+		`ALTER TABLE functions ADD COLUMN IF NOT EXISTS failure_destination UUID`,
+		`ALTER TABLE functions ADD COLUMN IF NOT EXISTS timeout_ms INT NOT NULL DEFAULT 30000`,
+		`ALTER TABLE functions ADD COLUMN IF NOT EXISTS memory_mb INT NOT NULL DEFAULT 128`,
+		`ALTER TABLE functions ADD COLUMN IF NOT EXISTS cpu_millicores INT NOT NULL DEFAULT 500`,
+		`ALTER TABLE functions ADD COLUMN IF NOT EXISTS max_pids INT NOT NULL DEFAULT 64`,
+		`ALTER TABLE functions ADD COLUMN IF NOT EXISTS network_access BOOLEAN NOT NULL DEFAULT FALSE`,
+		`CREATE TABLE IF NOT EXISTS bundles (
+			digest TEXT PRIMARY KEY,
+			data BYTEA NOT NULL,
+			size INT NOT NULL,
+			created_at TIMESTAMP NOT NULL
+		)`,
+		`ALTER TABLE functions ADD COLUMN IF NOT EXISTS bundle_digest TEXT`,
+		`ALTER TABLE function_versions ADD COLUMN IF NOT EXISTS bundle_digest TEXT`,
+		// versions from before builds existed are queued for one; jobs of
+		// theirs wait in the queue until it finishes
+		`ALTER TABLE function_versions ADD COLUMN IF NOT EXISTS build_status TEXT NOT NULL DEFAULT 'pending'`,
+		`ALTER TABLE function_versions ADD COLUMN IF NOT EXISTS build_error TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE function_versions ADD COLUMN IF NOT EXISTS build_log TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE function_versions ADD COLUMN IF NOT EXISTS build_worker TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE function_versions ADD COLUMN IF NOT EXISTS build_started_at TIMESTAMP`,
+		`ALTER TABLE function_versions ADD COLUMN IF NOT EXISTS built_at TIMESTAMP`,
+		`ALTER TABLE function_versions ADD COLUMN IF NOT EXISTS image TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE jobs ADD COLUMN IF NOT EXISTS start_kind TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE jobs ADD COLUMN IF NOT EXISTS start_latency_ms BIGINT`,
+		`CREATE INDEX IF NOT EXISTS function_versions_build_idx ON function_versions (created_at) WHERE build_status IN ('pending', 'building')`,
+		`ALTER TABLE function_versions ADD COLUMN IF NOT EXISTS build_error_class TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE bundles ADD COLUMN IF NOT EXISTS uploaded_at TIMESTAMP NOT NULL DEFAULT NOW()`,
+		`CREATE INDEX IF NOT EXISTS functions_bundle_idx ON functions (bundle_digest) WHERE bundle_digest IS NOT NULL`,
+		`CREATE INDEX IF NOT EXISTS function_versions_bundle_idx ON function_versions (bundle_digest) WHERE bundle_digest IS NOT NULL`,
+		`ALTER TABLE function_versions ADD COLUMN IF NOT EXISTS build_attempts INT NOT NULL DEFAULT 0`,
+		`ALTER TABLE function_versions ADD COLUMN IF NOT EXISTS build_after TIMESTAMP NOT NULL DEFAULT NOW()`,
+		`CREATE TABLE IF NOT EXISTS identity_nonces (
+			nonce TEXT PRIMARY KEY,
+			used_at TIMESTAMP NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS identity_nonces_used_idx ON identity_nonces (used_at)`,
 	}
 
 	for _, q := range queries {
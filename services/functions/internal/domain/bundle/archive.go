@@ -0,0 +1,288 @@
+package bundle
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Limits on the files of a bundle once extracted.
+const (
+	MaxFiles         = 2000
+	MaxExtractedSize = 50 << 20
+)
+
+// ErrInvalid is wrapped by every error about the contents of an upload.
+var ErrInvalid = errors.New("invalid bundle")
+
+// fileUID is the owner of bundle files, the sandbox user of function
+// containers, so the files can be copied into a container as they are.
+const fileUID = 65534
+
+// Normalize reads a zip, tar or gzipped tar upload and returns the bundle in
+// canonical form along with its manifest. Directories are implied by file
+// names; links, devices and names that escape the bundle root are rejected.
+func Normalize(upload []byte) ([]byte, *Manifest, error) {
+	files, err := readUpload(upload)
+	if err != nil {
+		return nil, nil, err
+	}
+	manifest, err := parseManifest(files)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, name := range names {
+		f := files[name]
+		hdr := &tar.Header{
+			Name:    name,
+			Mode:    f.mode,
+			Size:    int64(len(f.data)),
+			Uid:     fileUID,
+			Gid:     fileUID,
+			ModTime: time.Unix(0, 0),
+			Format:  tar.FormatPAX,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return nil, nil, err
+		}
+		if _, err := tw.Write(f.data); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, nil, err
+	}
+	return buf.Bytes(), manifest, nil
+}
+
+// ReadManifest returns the manifest of a bundle in canonical form.
+func ReadManifest(data []byte) (*Manifest, error) {
+	raw, err := ReadFile(data, ManifestName)
+	if err != nil {
+		return nil, err
+	}
+	var m Manifest
+	if err := json.Unmarshal(raw, &m); err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrInvalid, ManifestName, err)
+	}
+	return &m, nil
+}
+
+// ReadFile returns one file of a bundle in canonical form.
+func ReadFile(data []byte, name string) ([]byte, error) {
+	tr := tar.NewReader(bytes.NewReader(data))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("%w: %s not found", ErrInvalid, name)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Name == name {
+			return io.ReadAll(tr)
+		}
+	}
+}
+
+type file struct {
+	mode int64
+	data []byte
+}
+
+func readUpload(upload []byte) (map[string]file, error) {
+	switch {
+	case bytes.HasPrefix(upload, []byte("PK\x03\x04")):
+		return readZip(upload)
+	case bytes.HasPrefix(upload, []byte{0x1f, 0x8b}):
+		zr, err := gzip.NewReader(bytes.NewReader(upload))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalid, err)
+		}
+		return readTar(zr)
+	default:
+		return readTar(bytes.NewReader(upload))
+	}
+}
+
+func readZip(upload []byte) (map[string]file, error) {
+	zr, err := zip.NewReader(bytes.NewReader(upload), int64(len(upload)))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	files := make(map[string]file)
+	var total int64
+	for _, zf := range zr.File {
+		if zf.FileInfo().IsDir() {
+			continue
+		}
+		if !zf.Mode().IsRegular() {
+			return nil, fmt.Errorf("%w: %s is not a regular file", ErrInvalid, zf.Name)
+		}
+		rc, err := zf.Open()
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalid, err)
+		}
+		data, err := readLimited(rc, &total)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		if err := addFile(files, zf.Name, int64(zf.Mode().Perm()), data); err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+func readTar(r io.Reader) (map[string]file, error) {
+	tr := tar.NewReader(r)
+	files := make(map[string]file)
+	var total int64
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalid, err)
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir, tar.TypeXGlobalHeader:
+			continue
+		case tar.TypeReg:
+		default:
+			return nil, fmt.Errorf("%w: %s is not a regular file", ErrInvalid, hdr.Name)
+		}
+		data, err := readLimited(tr, &total)
+		if err != nil {
+			return nil, err
+		}
+		if err := addFile(files, hdr.Name, hdr.Mode, data); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// readLimited reads one file, adding its size to total and failing once
+// total passes MaxExtractedSize.
+func readLimited(r io.Reader, total *int64) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, MaxExtractedSize-*total+1))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	*total += int64(len(data))
+	if *total > MaxExtractedSize {
+		return nil, fmt.Errorf("%w: more than %d MB once extracted", ErrInvalid, MaxExtractedSize>>20)
+	}
+	return data, nil
+}
+
+func addFile(files map[string]file, name string, mode int64, data []byte) error {
+	clean, ok := cleanName(name)
+	if !ok {
+		return fmt.Errorf("%w: file name %q escapes the bundle", ErrInvalid, name)
+	}
+	if _, dup := files[clean]; dup {
+		return fmt.Errorf("%w: %s appears twice", ErrInvalid, clean)
+	}
+	if len(files) == MaxFiles {
+		return fmt.Errorf("%w: more than %d files", ErrInvalid, MaxFiles)
+	}
+	// only the executable bit of the upload is kept
+	perm := int64(0o644)
+	if mode&0o111 != 0 {
+		perm = 0o755
+	}
+	files[clean] = file{mode: perm, data: data}
+	return nil
+}
+
+// cleanName returns name relative to the bundle root, or false if it is
+// absolute or leaves the root.
+func cleanName(name string) (string, bool) {
+	name = strings.TrimPrefix(strings.ReplaceAll(name, "\\", "/"), "./")
+	if name == "" || path.IsAbs(name) {
+		return "", false
+	}
+	clean := path.Clean(name)
+	if clean == "." || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", false
+	}
+	return clean, true
+}
+
+func parseManifest(files map[string]file) (*Manifest, error) {
+	f, ok := files[ManifestName]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s is missing", ErrInvalid, ManifestName)
+	}
+	var m Manifest
+	if err := json.Unmarshal(f.data, &m); err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrInvalid, ManifestName, err)
+	}
+	if m.Runtime == "" || m.Entrypoint == "" {
+		return nil, fmt.Errorf("%w: %s needs a runtime and an entrypoint", ErrInvalid, ManifestName)
+	}
+	// the entrypoint may be a directory, such as "." for a Go module
+	if m.Entrypoint != "." {
+		clean, ok := cleanName(m.Entrypoint)
+		if !ok {
+			return nil, fmt.Errorf("%w: entrypoint %q escapes the bundle", ErrInvalid, m.Entrypoint)
+		}
+		if !hasPath(files, clean) {
+			return nil, fmt.Errorf("%w: entrypoint %s is missing", ErrInvalid, clean)
+		}
+		m.Entrypoint = clean
+	}
+	if m.Dependencies != "" {
+		clean, ok := cleanName(m.Dependencies)
+		if !ok {
+			return nil, fmt.Errorf("%w: dependency file %q escapes the bundle", ErrInvalid, m.Dependencies)
+		}
+		if _, ok := files[clean]; !ok {
+			return nil, fmt.Errorf("%w: dependency file %s is missing", ErrInvalid, clean)
+		}
+		m.Dependencies = clean
+	}
+
+	// store the cleaned manifest, so runners need not validate it again
+	data, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	files[ManifestName] = file{mode: 0o644, data: data}
+	return &m, nil
+}
+
+// hasPath reports whether name is a file of the bundle or a directory
+// holding one.
+func hasPath(files map[string]file, name string) bool {
+	if _, ok := files[name]; ok {
+		return true
+	}
+	for f := range files {
+		if strings.HasPrefix(f, name+"/") {
+			return true
+		}
+	}
+	return false
+}
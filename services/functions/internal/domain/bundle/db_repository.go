@@ -0,0 +1,59 @@
+package bundle
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type postgresRepo struct {
+	db *sqlx.DB
+}
+
+func NewPostgresRepository(db *sqlx.DB) Repository {
+	return &postgresRepo{db: db}
+}
+
+func (r *postgresRepo) Put(ctx context.Context, b *Bundle) error {
+	const query = `
+	INSERT INTO bundles (digest, data, size, created_at, uploaded_at)
+	VALUES ($1, $2, $3, $4, $4)
+	ON CONFLICT (digest) DO UPDATE SET uploaded_at = EXCLUDED.uploaded_at
+	`
+	_, err := r.db.ExecContext(ctx, query, b.Digest, b.Data, b.Size, b.CreatedAt)
+	return err
+}
+
+func (r *postgresRepo) DeleteUnused(ctx context.Context, before time.Time) (int64, error) {
+	const query = `
+	DELETE FROM bundles b
+	 WHERE b.uploaded_at < $1
+	   AND NOT EXISTS (SELECT 1 FROM functions f
+	                    WHERE f.bundle_digest = b.digest AND f.deleted_at IS NULL)
+	   AND NOT EXISTS (SELECT 1 FROM function_versions v JOIN functions f ON f.id = v.function_id
+	                    WHERE v.bundle_digest = b.digest AND f.deleted_at IS NULL)
+	`
+	res, err := r.db.ExecContext(ctx, query, before)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (r *postgresRepo) Get(ctx context.Context, digest string) (*Bundle, error) {
+	const query = `
+	SELECT digest, data, size, created_at
+	  FROM bundles
+	 WHERE digest = $1
+	`
+	var b Bundle
+	if err := r.db.GetContext(ctx, &b, query, digest); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return &b, nil
+}
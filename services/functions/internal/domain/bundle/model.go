@@ -0,0 +1,45 @@
+package bundle
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+)
+
+// Bundle is an uploaded function archive in canonical form: an uncompressed
+// tar of regular files with sorted, relative names and fixed metadata, so
+// the same files always produce the same Digest whatever the upload format.
+type Bundle struct {
+	Digest    string    `db:"digest"`
+	Data      []byte    `db:"data"`
+	Size      int       `db:"size"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+// ManifestName is the manifest's path inside a bundle.
+const ManifestName = "function.json"
+
+// Manifest describes how to run a bundle.
+type Manifest struct {
+	// Runtime is a runtime name or alias from the registry.
+	Runtime string `json:"runtime"`
+	// Entrypoint is the file the runtime runs, relative to the bundle root.
+	Entrypoint string `json:"entrypoint"`
+	// Dependencies optionally names the runtime's dependency file, such as
+	// requirements.txt or package.json, installed before the bundle runs.
+	Dependencies string `json:"dependencies,omitempty"`
+}
+
+func New(data []byte) *Bundle {
+	return &Bundle{
+		Digest:    Digest(data),
+		Data:      data,
+		Size:      len(data),
+		CreatedAt: time.Now(),
+	}
+}
+
+func Digest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,23 @@
+package bundle
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Repository stores bundles by digest. Bundles are immutable and shared by
+// every function version with the same files.
+type Repository interface {
+	// Put stores b unless a bundle with its digest already exists, and
+	// records the upload either way.
+	Put(ctx context.Context, b *Bundle) error
+	Get(ctx context.Context, digest string) (*Bundle, error)
+	// DeleteUnused deletes the bundles that no function or version of a
+	// function that is not deleted refers to, except those uploaded since
+	// before, which a function being created may be about to use. It
+	// returns how many it deleted.
+	DeleteUnused(ctx context.Context, before time.Time) (int64, error)
+}
+
+var ErrNotFound = errors.New("bundle not found")
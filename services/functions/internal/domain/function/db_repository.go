@@ -3,11 +3,17 @@ package function
 import (
 	"context"
 	"database/sql"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/jmoiron/sqlx"
 )
 
+const functionColumns = `id, owner, code, language, bundle_digest, version,
+	       retry_max_attempts, retry_backoff_ms, retry_max_backoff_ms, retry_on,
+	       timeout_ms, memory_mb, cpu_millicores, max_pids, network_access,
+	       failure_destination, created_at, updated_at, deleted_at`
+
 type postgresRepo struct {
 	db *sqlx.DB
 }
@@ -17,20 +23,39 @@ func NewPostgresRepository(db *sqlx.DB) Repository {
 }
 
 func (r *postgresRepo) Create(ctx context.Context, fn *Function) error {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
 	const query = `
-	INSERT INTO functions (id, owner, code, language, created_at)
-	VALUES ($1, $2, $3, $4, $5)
+	INSERT INTO functions (id, owner, code, language, bundle_digest, version,
+	                       retry_max_attempts, retry_backoff_ms, retry_max_backoff_ms, retry_on,
+	                       timeout_ms, memory_mb, cpu_millicores, max_pids, network_access,
+	                       failure_destination, created_at, updated_at)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18)
 	`
-	_, err := r.db.ExecContext(ctx, query,
-		fn.ID, fn.Owner, fn.Code, fn.Language, fn.CreatedAt)
-	return err
+	p, l := fn.RetryPolicy, fn.Limits
+	_, err = tx.ExecContext(ctx, query,
+		fn.ID, fn.Owner, fn.Code, fn.Language, fn.BundleDigest, fn.Version,
+		p.MaxAttempts, p.BackoffMs, p.MaxBackoffMs, p.RetryOn,
+		l.TimeoutMs, l.MemoryMB, l.CPUMillicores, l.MaxPIDs, fn.NetworkAccess,
+		fn.FailureDestination, fn.CreatedAt, fn.UpdatedAt)
+	if err != nil {
+		return err
+	}
+	if err := insertVersion(ctx, tx, fn); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
 func (r *postgresRepo) GetByID(ctx context.Context, id uuid.UUID) (*Function, error) {
 	const query = `
-	SELECT id, owner, code, language, created_at
+	SELECT ` + functionColumns + `
 	  FROM functions
-	 WHERE id = $1
+	 WHERE id = $1 AND deleted_at IS NULL
 	`
 	var row Function
 	err := r.db.GetContext(ctx, &row, query, id)
@@ -45,8 +70,9 @@ func (r *postgresRepo) GetByID(ctx context.Context, id uuid.UUID) (*Function, er
 
 func (r *postgresRepo) List(ctx context.Context) ([]Function, error) {
 	const query = `
-	SELECT id, owner, code, language, created_at
+	SELECT ` + functionColumns + `
 	  FROM functions
+	 WHERE deleted_at IS NULL
 	 ORDER BY created_at DESC
 	`
 	var funcs []Function
@@ -55,3 +81,294 @@ func (r *postgresRepo) List(ctx context.Context) ([]Function, error) {
 	}
 	return funcs, nil
 }
+
+func (r *postgresRepo) ListByOwner(ctx context.Context, owner string) ([]Function, error) {
+	const query = `
+	SELECT ` + functionColumns + `
+	  FROM functions
+	 WHERE owner = $1 AND deleted_at IS NULL
+	 ORDER BY created_at DESC
+	`
+	var funcs []Function
+	if err := r.db.SelectContext(ctx, &funcs, query, owner); err != nil {
+		return nil, err
+	}
+	return funcs, nil
+}
+
+func (r *postgresRepo) Update(ctx context.Context, fn *Function) error {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var current Function
+	const lock = `
+	SELECT ` + functionColumns + `
+	  FROM functions
+	 WHERE id = $1 AND deleted_at IS NULL
+	   FOR UPDATE
+	`
+	if err := tx.GetContext(ctx, &current, lock, fn.ID); err != nil {
+		if err == sql.ErrNoRows {
+			return ErrNotFound
+		}
+		return err
+	}
+
+	fn.Version = current.Version
+	if !fn.sameCode(&current) {
+		fn.Version++
+		if err := insertVersion(ctx, tx, fn); err != nil {
+			return err
+		}
+	}
+
+	const query = `
+	UPDATE functions
+	   SET code                 = $1,
+	       language             = $2,
+	       bundle_digest        = $3,
+	       version              = $4,
+	       retry_max_attempts   = $5,
+	       retry_backoff_ms     = $6,
+	       retry_max_backoff_ms = $7,
+	       retry_on             = $8,
+	       timeout_ms           = $9,
+	       memory_mb            = $10,
+	       cpu_millicores       = $11,
+	       max_pids             = $12,
+	       network_access       = $13,
+	       failure_destination  = $14,
+	       updated_at           = $15
+	 WHERE id = $16
+	`
+	p, l := fn.RetryPolicy, fn.Limits
+	_, err = tx.ExecContext(ctx, query,
+		fn.Code, fn.Language, fn.BundleDigest, fn.Version,
+		p.MaxAttempts, p.BackoffMs, p.MaxBackoffMs, p.RetryOn,
+		l.TimeoutMs, l.MemoryMB, l.CPUMillicores, l.MaxPIDs, fn.NetworkAccess,
+		fn.FailureDestination, fn.UpdatedAt, fn.ID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func insertVersion(ctx context.Context, tx *sqlx.Tx, fn *Function) error {
+	const query = `
+	INSERT INTO function_versions (function_id, version, code, language, bundle_digest, created_at)
+	VALUES ($1, $2, $3, $4, $5, $6)
+	`
+	_, err := tx.ExecContext(ctx, query, fn.ID, fn.Version, fn.Code, fn.Language, fn.BundleDigest, fn.UpdatedAt)
+	return err
+}
+
+func (r *postgresRepo) Delete(ctx context.Context, id uuid.UUID) error {
+	const query = `
+	UPDATE functions
+	   SET deleted_at = $1
+	 WHERE id = $2 AND deleted_at IS NULL
+	`
+	res, err := r.db.ExecContext(ctx, query, time.Now(), id)
+	if err != nil {
+		return err
+	}
+	return expectRow(res, ErrNotFound)
+}
+
+func expectRow(res sql.Result, notFound error) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return notFound
+	}
+	return nil
+}
+
+// DeleteByOwner permanently removes the owner's functions, their versions,
+// aliases, jobs and job attempts.
+func (r *postgresRepo) DeleteByOwner(ctx context.Context, owner string) (int64, error) {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	const attempts = `
+	DELETE FROM job_attempts
+	 WHERE job_id IN (SELECT j.id FROM jobs j JOIN functions f ON f.id = j.function_id WHERE f.owner = $1)
+	`
+	if _, err := tx.ExecContext(ctx, attempts, owner); err != nil {
+		return 0, err
+	}
+	for _, table := range []string{"jobs", "function_versions", "function_aliases"} {
+		query := `DELETE FROM ` + table + ` WHERE function_id IN (SELECT id FROM functions WHERE owner = $1)`
+		if _, err := tx.ExecContext(ctx, query, owner); err != nil {
+			return 0, err
+		}
+	}
+
+	res, err := tx.ExecContext(ctx, `DELETE FROM functions WHERE owner = $1`, owner)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return n, tx.Commit()
+}
+
+const versionColumns = `function_id, version, code, language, bundle_digest, created_at,
+	build_status, build_error, build_error_class, build_log, build_worker, build_started_at, built_at, image,
+	build_attempts, build_after`
+
+func (r *postgresRepo) GetVersion(ctx context.Context, id uuid.UUID, version int) (*Version, error) {
+	const query = `
+	SELECT ` + versionColumns + `
+	  FROM function_versions
+	 WHERE function_id = $1 AND version = $2
+	`
+	var row Version
+	if err := r.db.GetContext(ctx, &row, query, id, version); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrVersionNotFound
+		}
+		return nil, err
+	}
+	return &row, nil
+}
+
+func (r *postgresRepo) ListVersions(ctx context.Context, id uuid.UUID) ([]Version, error) {
+	const query = `
+	SELECT ` + versionColumns + `
+	  FROM function_versions
+	 WHERE function_id = $1
+	 ORDER BY version DESC
+	`
+	var versions []Version
+	if err := r.db.SelectContext(ctx, &versions, query, id); err != nil {
+		return nil, err
+	}
+	return versions, nil
+}
+
+func (r *postgresRepo) ClaimBuild(ctx context.Context, workerID string, staleBefore time.Time) (*Version, error) {
+	const query = `
+	  UPDATE function_versions
+	     SET build_status = $1, build_worker = $2, build_started_at = $3,
+	         build_attempts = build_attempts + 1
+	   WHERE (function_id, version) = (
+	         SELECT v.function_id, v.version
+	           FROM function_versions v
+	           JOIN functions f ON f.id = v.function_id
+	          WHERE f.deleted_at IS NULL
+	            AND ((v.build_status = $4 AND v.build_after <= $3) OR (v.build_status = $1 AND v.build_started_at < $5))
+	          ORDER BY v.created_at
+	          LIMIT 1
+	            FOR UPDATE OF v SKIP LOCKED
+	         )
+	  RETURNING ` + versionColumns
+	var row Version
+	err := r.db.GetContext(ctx, &row, query, BuildBuilding, workerID, time.Now(), BuildPending, staleBefore)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrNoBuilds
+		}
+		return nil, err
+	}
+	return &row, nil
+}
+
+func (r *postgresRepo) FinishBuild(ctx context.Context, v *Version, workerID string) (bool, error) {
+	const query = `
+	UPDATE function_versions
+	   SET build_status = $1, build_error = $2, build_error_class = $3, build_log = $4, built_at = $5, image = $6,
+	       build_after = $7
+	 WHERE function_id = $8 AND version = $9 AND build_status = $10 AND build_worker = $11
+	`
+	res, err := r.db.ExecContext(ctx, query,
+		v.BuildStatus, v.BuildError, v.BuildErrorClass, v.BuildLog, v.BuiltAt, v.Image, v.BuildAfter,
+		v.FunctionID, v.Version, BuildBuilding, workerID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+func (r *postgresRepo) RequeueBuild(ctx context.Context, id uuid.UUID, version int) (bool, error) {
+	const query = `
+	UPDATE function_versions
+	   SET build_status = $1, build_error = '', build_error_class = '', build_worker = '', build_started_at = NULL,
+	       build_attempts = 0, build_after = NOW()
+	 WHERE function_id = $2 AND version = $3 AND build_status IN ($4, $5)
+	`
+	res, err := r.db.ExecContext(ctx, query, BuildPending, id, version, BuildReady, BuildFailed)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// SetAlias creates the alias or moves it to alias.Version.
+func (r *postgresRepo) SetAlias(ctx context.Context, alias *Alias) error {
+	const query = `
+	INSERT INTO function_aliases (function_id, name, version, updated_at)
+	VALUES ($1, $2, $3, $4)
+	ON CONFLICT (function_id, name)
+	DO UPDATE SET version = EXCLUDED.version, updated_at = EXCLUDED.updated_at
+	`
+	_, err := r.db.ExecContext(ctx, query, alias.FunctionID, alias.Name, alias.Version, alias.UpdatedAt)
+	return err
+}
+
+func (r *postgresRepo) GetAlias(ctx context.Context, id uuid.UUID, name string) (*Alias, error) {
+	const query = `
+	SELECT function_id, name, version, updated_at
+	  FROM function_aliases
+	 WHERE function_id = $1 AND name = $2
+	`
+	var row Alias
+	if err := r.db.GetContext(ctx, &row, query, id, name); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrAliasNotFound
+		}
+		return nil, err
+	}
+	return &row, nil
+}
+
+func (r *postgresRepo) ListAliases(ctx context.Context, id uuid.UUID) ([]Alias, error) {
+	const query = `
+	SELECT function_id, name, version, updated_at
+	  FROM function_aliases
+	 WHERE function_id = $1
+	 ORDER BY name
+	`
+	var aliases []Alias
+	if err := r.db.SelectContext(ctx, &aliases, query, id); err != nil {
+		return nil, err
+	}
+	return aliases, nil
+}
+
+func (r *postgresRepo) DeleteAlias(ctx context.Context, id uuid.UUID, name string) error {
+	res, err := r.db.ExecContext(ctx,
+		`DELETE FROM function_aliases WHERE function_id = $1 AND name = $2`, id, name)
+	if err != nil {
+		return err
+	}
+	return expectRow(res, ErrAliasNotFound)
+}
@@ -0,0 +1,70 @@
+package function
+
+import (
+	"fmt"
+	"time"
+)
+
+// Limits bounds the resources one execution of a function may use.
+type Limits struct {
+	TimeoutMs int `db:"timeout_ms" json:"timeout_ms"`
+	MemoryMB  int `db:"memory_mb" json:"memory_mb"`
+	// CPUMillicores is the CPU share in thousandths of a core, so 500 is
+	// half a core.
+	CPUMillicores int `db:"cpu_millicores" json:"cpu_millicores"`
+	MaxPIDs       int `db:"max_pids" json:"max_pids"`
+}
+
+func DefaultLimits() Limits {
+	return Limits{
+		TimeoutMs:     30000,
+		MemoryMB:      128,
+		CPUMillicores: 500,
+		MaxPIDs:       64,
+	}
+}
+
+// DefaultLimitCaps are the platform-wide maximums used when none are
+// configured.
+func DefaultLimitCaps() Limits {
+	return Limits{
+		TimeoutMs:     300000,
+		MemoryMB:      1024,
+		CPUMillicores: 2000,
+		MaxPIDs:       256,
+	}
+}
+
+func (l Limits) Timeout() time.Duration {
+	return time.Duration(l.TimeoutMs) * time.Millisecond
+}
+
+// Validate checks that every limit is positive and within caps.
+func (l Limits) Validate(caps Limits) error {
+	checks := []struct {
+		name       string
+		value, max int
+	}{
+		{"timeout_ms", l.TimeoutMs, caps.TimeoutMs},
+		{"memory_mb", l.MemoryMB, caps.MemoryMB},
+		{"cpu_millicores", l.CPUMillicores, caps.CPUMillicores},
+		{"max_pids", l.MaxPIDs, caps.MaxPIDs},
+	}
+	for _, c := range checks {
+		if c.value < 1 || c.value > c.max {
+			return fmt.Errorf("%s must be between 1 and %d", c.name, c.max)
+		}
+	}
+	return nil
+}
+
+// Clamp lowers every limit above its cap to the cap, for functions saved
+// before the caps were lowered.
+func (l Limits) Clamp(caps Limits) Limits {
+	return Limits{
+		TimeoutMs:     min(l.TimeoutMs, caps.TimeoutMs),
+		MemoryMB:      min(l.MemoryMB, caps.MemoryMB),
+		CPUMillicores: min(l.CPUMillicores, caps.CPUMillicores),
+		MaxPIDs:       min(l.MaxPIDs, caps.MaxPIDs),
+	}
+}
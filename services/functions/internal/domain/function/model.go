@@ -1,25 +1,166 @@
 package function
 
 import (
+	"regexp"
 	"time"
 
 	"github.com/google/uuid"
 )
 
+// Function is the mutable head of a function. Code and Language mirror the
+// latest Version; every code change creates a new immutable Version row.
 type Function struct {
-	ID        uuid.UUID `db:"id"`
-	Owner     string    `db:"owner"`
-	Code      string    `db:"code"`
-	Language  string    `db:"language"`
-	CreatedAt time.Time `db:"created_at"`
+	ID       uuid.UUID `db:"id"`
+	Owner    string    `db:"owner"`
+	Code     string    `db:"code"`
+	Language string    `db:"language"`
+	// BundleDigest is set instead of Code for functions uploaded as a
+	// bundle.
+	BundleDigest *string `db:"bundle_digest"`
+	Version      int     `db:"version"`
+	// RetryPolicy applies to every version; it is configuration, not code.
+	RetryPolicy `json:"Retry"`
+	Limits      `json:"Limits"`
+	// NetworkAccess gives the function's containers a network; they have
+	// none by default.
+	NetworkAccess bool `db:"network_access"`
+	// FailureDestination is a function of the same owner that is invoked
+	// with the details of every job of this function that is dead-lettered.
+	FailureDestination *uuid.UUID `db:"failure_destination"`
+	CreatedAt          time.Time  `db:"created_at"`
+	UpdatedAt          time.Time  `db:"updated_at"`
+	DeletedAt          *time.Time `db:"deleted_at"`
+}
+
+type Version struct {
+	FunctionID   uuid.UUID `db:"function_id"`
+	Version      int       `db:"version"`
+	Code         string    `db:"code"`
+	Language     string    `db:"language"`
+	BundleDigest *string   `db:"bundle_digest"`
+	CreatedAt    time.Time `db:"created_at"`
+
+	// Every version is built into an Image before it can run.
+	BuildStatus BuildStatus `db:"build_status"`
+	BuildError  string      `db:"build_error"`
+	// BuildErrorClass is ErrorCompile or ErrorInfrastructure for a failed
+	// build.
+	BuildErrorClass string     `db:"build_error_class"`
+	BuildLog        string     `db:"build_log"`
+	BuildWorker     string     `db:"build_worker"`
+	BuildStartedAt  *time.Time `db:"build_started_at"`
+	// BuildAttempts counts the builds started since the version was last
+	// queued, and a pending build waits until BuildAfter.
+	BuildAttempts int        `db:"build_attempts"`
+	BuildAfter    time.Time  `db:"build_after"`
+	BuiltAt       *time.Time `db:"built_at"`
+	Image         string     `db:"image"`
+}
+
+type BuildStatus string
+
+const (
+	BuildPending  BuildStatus = "pending"
+	BuildBuilding BuildStatus = "building"
+	BuildReady    BuildStatus = "ready"
+	BuildFailed   BuildStatus = "failed"
+)
+
+// MarkBuilt records a successful build of the version into image.
+func (v *Version) MarkBuilt(image, log string) {
+	now := time.Now()
+	v.BuildStatus = BuildReady
+	v.BuildError = ""
+	v.BuildErrorClass = ""
+	v.BuildLog = log
+	v.Image = image
+	v.BuiltAt = &now
+}
+
+// MarkBuildFailed records a failed build of the version. errorClass tells
+// whether the code or the platform is at fault.
+func (v *Version) MarkBuildFailed(errMsg, errorClass, log string) {
+	now := time.Now()
+	v.BuildStatus = BuildFailed
+	v.BuildError = errMsg
+	v.BuildErrorClass = errorClass
+	v.BuildLog = log
+	v.Image = ""
+	v.BuiltAt = &now
+}
+
+// ScheduleBuildRetry queues the version for another build at after, keeping
+// the error and log of the failed one until it starts.
+func (v *Version) ScheduleBuildRetry(errMsg, errorClass, log string, after time.Time) {
+	v.BuildStatus = BuildPending
+	v.BuildError = errMsg
+	v.BuildErrorClass = errorClass
+	v.BuildLog = log
+	v.BuildAfter = after
+}
+
+// Alias is a named pointer to a version, such as "prod" or "staging".
+type Alias struct {
+	FunctionID uuid.UUID `db:"function_id"`
+	Name       string    `db:"name"`
+	Version    int       `db:"version"`
+	UpdatedAt  time.Time `db:"updated_at"`
+}
+
+// alias names must not look like version numbers, so "fn@3" is unambiguous
+var aliasNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_-]{0,62}$`)
+
+func ValidAliasName(name string) bool {
+	return aliasNamePattern.MatchString(name)
 }
 
 func NewFunction(owner, code, language string) *Function {
+	now := time.Now()
 	return &Function{
-		ID:        uuid.New(),
-		Owner:     owner,
-		Code:      code,
-		Language:  language,
-		CreatedAt: time.Now(),
+		ID:          uuid.New(),
+		Owner:       owner,
+		Code:        code,
+		Language:    language,
+		Version:     1,
+		RetryPolicy: DefaultRetryPolicy(),
+		Limits:      DefaultLimits(),
+		CreatedAt:   now,
+		UpdatedAt:   now,
 	}
 }
+
+func (f *Function) Update(code, language string) {
+	f.Code = code
+	f.Language = language
+	f.BundleDigest = nil
+	f.UpdatedAt = time.Now()
+}
+
+// UpdateBundle replaces the function's code with a bundle.
+func (f *Function) UpdateBundle(digest, language string) {
+	f.Code = ""
+	f.Language = language
+	f.BundleDigest = &digest
+	f.UpdatedAt = time.Now()
+}
+
+// sameCode reports whether f and g run the same code.
+func (f *Function) sameCode(g *Function) bool {
+	if f.Code != g.Code || f.Language != g.Language {
+		return false
+	}
+	if f.BundleDigest == nil || g.BundleDigest == nil {
+		return f.BundleDigest == g.BundleDigest
+	}
+	return *f.BundleDigest == *g.BundleDigest
+}
+
+// AtVersion returns a copy of f that runs the code of v.
+func (f *Function) AtVersion(v *Version) *Function {
+	fn := *f
+	fn.Code = v.Code
+	fn.Language = v.Language
+	fn.BundleDigest = v.BundleDigest
+	fn.Version = v.Version
+	return &fn
+}
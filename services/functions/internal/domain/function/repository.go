@@ -3,14 +3,50 @@ package function
 import (
 	"context"
 	"errors"
+	"time"
 
 	"github.com/google/uuid"
 )
 
+// Repository stores functions. Deleted functions are soft deleted: every
+// read except on deletion itself treats them as missing.
 type Repository interface {
 	Create(ctx context.Context, fn *Function) error
 	GetByID(ctx context.Context, id uuid.UUID) (*Function, error)
 	List(ctx context.Context) ([]Function, error)
+	ListByOwner(ctx context.Context, owner string) ([]Function, error)
+	// Update saves fn, recording a new version when its code or language
+	// changed. fn.Version is set to the resulting latest version.
+	Update(ctx context.Context, fn *Function) error
+	Delete(ctx context.Context, id uuid.UUID) error
+	DeleteByOwner(ctx context.Context, owner string) (int64, error)
+
+	GetVersion(ctx context.Context, id uuid.UUID, version int) (*Version, error)
+	ListVersions(ctx context.Context, id uuid.UUID) ([]Version, error)
+
+	// ClaimBuild marks the version that has waited longest for a build as
+	// building by workerID, counts the attempt and returns the version,
+	// skipping versions being claimed concurrently and those whose
+	// BuildAfter has not come. Builds started before staleBefore are taken
+	// over, as their worker is presumed dead. It returns ErrNoBuilds when
+	// there is nothing to build.
+	ClaimBuild(ctx context.Context, workerID string, staleBefore time.Time) (*Version, error)
+	// FinishBuild saves the outcome of a build only while workerID still
+	// holds it, reporting whether it did.
+	FinishBuild(ctx context.Context, v *Version, workerID string) (bool, error)
+	// RequeueBuild queues a finished build of a version again with a fresh
+	// set of attempts, reporting whether the version had finished building.
+	RequeueBuild(ctx context.Context, id uuid.UUID, version int) (bool, error)
+
+	SetAlias(ctx context.Context, alias *Alias) error
+	GetAlias(ctx context.Context, id uuid.UUID, name string) (*Alias, error)
+	ListAliases(ctx context.Context, id uuid.UUID) ([]Alias, error)
+	DeleteAlias(ctx context.Context, id uuid.UUID, name string) error
 }
 
-var ErrNotFound = errors.New("function not found")
+var (
+	ErrNotFound        = errors.New("function not found")
+	ErrVersionNotFound = errors.New("function version not found")
+	ErrAliasNotFound   = errors.New("function alias not found")
+	ErrNoBuilds        = errors.New("no pending builds")
+)
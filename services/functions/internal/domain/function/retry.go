@@ -0,0 +1,83 @@
+package function
+
+import (
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Error classes a failed execution falls into. Infrastructure failures, such
+// as an image pull or Docker error, say nothing about the function and are
+// retried by default; timeouts, running out of memory, compile errors and
+// failures of the function's own code are not.
+const (
+	ErrorInfrastructure = "infrastructure"
+	ErrorTimeout        = "timeout"
+	ErrorOutOfMemory    = "out_of_memory"
+	ErrorCompile        = "compile"
+	ErrorUserCode       = "user_code"
+)
+
+var errorClasses = []string{ErrorInfrastructure, ErrorTimeout, ErrorOutOfMemory, ErrorCompile, ErrorUserCode}
+
+// RetryPolicy controls how failed executions of a function are retried.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first.
+	MaxAttempts int `db:"retry_max_attempts" json:"max_attempts"`
+	// BackoffMs is the delay before the first retry; it doubles on every
+	// further retry up to MaxBackoffMs.
+	BackoffMs    int            `db:"retry_backoff_ms" json:"backoff_ms"`
+	MaxBackoffMs int            `db:"retry_max_backoff_ms" json:"max_backoff_ms"`
+	RetryOn      pq.StringArray `db:"retry_on" json:"retry_on"`
+}
+
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:  3,
+		BackoffMs:    1000,
+		MaxBackoffMs: 30000,
+		RetryOn:      pq.StringArray{ErrorInfrastructure},
+	}
+}
+
+const maxRetryAttempts = 10
+
+func (p RetryPolicy) Validate() error {
+	if p.MaxAttempts < 1 || p.MaxAttempts > maxRetryAttempts {
+		return errors.New("max_attempts must be between 1 and 10")
+	}
+	if p.BackoffMs < 0 || p.MaxBackoffMs < p.BackoffMs {
+		return errors.New("backoff_ms must be non-negative and at most max_backoff_ms")
+	}
+	for _, class := range p.RetryOn {
+		if !slices.Contains(errorClasses, class) {
+			return errors.New("retry_on may only contain infrastructure, timeout, out_of_memory, compile and user_code")
+		}
+	}
+	return nil
+}
+
+// ShouldRetry reports whether a failure of errorClass on the given attempt,
+// counting from 1, gets another attempt.
+func (p RetryPolicy) ShouldRetry(errorClass string, attempt int) bool {
+	return attempt < p.MaxAttempts && p.RetriesOn(errorClass)
+}
+
+// RetriesOn reports whether the policy retries failures of errorClass at
+// all. Such a failure that runs out of attempts is dead-lettered; any other
+// failure is an ordinary error.
+func (p RetryPolicy) RetriesOn(errorClass string) bool {
+	return slices.Contains(p.RetryOn, errorClass)
+}
+
+// Backoff returns the delay before the attempt that follows attempt.
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	d := time.Duration(p.BackoffMs) * time.Millisecond
+	limit := time.Duration(p.MaxBackoffMs) * time.Millisecond
+	for i := 1; i < attempt && d < limit; i++ {
+		d *= 2
+	}
+	return min(d, limit)
+}
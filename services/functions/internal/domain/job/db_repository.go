@@ -3,11 +3,19 @@ package job
 import (
 	"context"
 	"database/sql"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
 )
 
+const jobColumns = `id, function_id, function_version, owner, status, input, output, result,
+	         stdout, stderr, exit_code, truncated, started_at, finished_at, duration_ms,
+	         worker_id, lease_expires_at, recoveries, cancel_requested, attempts, run_after,
+	         attempt_offset, error_class, dead_lettered_at, source_job_id,
+	         start_kind, start_latency_ms, created_at, updated_at`
+
 type postgresRepo struct {
 	db *sqlx.DB
 }
@@ -18,17 +26,19 @@ func NewPostgresRepository(db *sqlx.DB) Repository {
 
 func (r *postgresRepo) Create(ctx context.Context, j *Job) error {
 	const query = `
-	  INSERT INTO jobs (id, function_id, status, result, created_at, updated_at)
-	  VALUES ($1, $2, $3, $4, $5, $6)
+	  INSERT INTO jobs (id, function_id, function_version, owner, status, input, output, result,
+	                    run_after, source_job_id, created_at, updated_at)
+	  VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
 	`
 	_, err := r.db.ExecContext(ctx, query,
-		j.ID, j.FunctionID, j.Status, j.Result, j.CreatedAt, j.UpdatedAt)
+		j.ID, j.FunctionID, j.FunctionVersion, j.Owner, j.Status, j.Input, j.Output, j.Result,
+		j.RunAfter, j.SourceJobID, j.CreatedAt, j.UpdatedAt)
 	return err
 }
 
 func (r *postgresRepo) GetByID(ctx context.Context, jobID uuid.UUID) (*Job, error) {
 	const query = `
-	  SELECT id, function_id, status, result, created_at, updated_at
+	  SELECT ` + jobColumns + `
 	    FROM jobs
 	   WHERE id = $1
 	`
@@ -44,13 +54,288 @@ func (r *postgresRepo) GetByID(ctx context.Context, jobID uuid.UUID) (*Job, erro
 }
 
 func (r *postgresRepo) Update(ctx context.Context, j *Job) error {
+	_, err := r.updateWhere(ctx, j, "")
+	return err
+}
+
+func (r *postgresRepo) UpdateIfStatus(ctx context.Context, j *Job, from Status) (bool, error) {
+	return r.updateWhere(ctx, j, "status = $21", from)
+}
+
+func (r *postgresRepo) UpdateClaimed(ctx context.Context, j *Job, workerID string) (bool, error) {
+	return r.updateWhere(ctx, j, "status = $21 AND worker_id = $22", StatusRunning, workerID)
+}
+
+func (r *postgresRepo) ReleaseExpired(ctx context.Context, j *Job, now time.Time) (bool, error) {
+	return r.updateWhere(ctx, j, "status = $21 AND lease_expires_at < $22", StatusRunning, now)
+}
+
+// updateWhere saves every mutable column of j, restricted by cond when it is
+// not empty. cond's placeholders start at $21 and take condArgs. A cancel
+// request only applies to the run it arrived during, so it is kept while
+// the job stays running and cleared otherwise; it is never taken from j,
+// whose copy may predate the request.
+func (r *postgresRepo) updateWhere(ctx context.Context, j *Job, cond string, condArgs ...any) (bool, error) {
+	query := `
+	  UPDATE jobs
+	     SET status           = $1,
+	         output           = $2,
+	         result           = $3,
+	         stdout           = $4,
+	         stderr           = $5,
+	         exit_code        = $6,
+	         truncated        = $7,
+	         started_at       = $8,
+	         finished_at      = $9,
+	         duration_ms      = $10,
+	         worker_id        = $11,
+	         lease_expires_at = $12,
+	         recoveries       = $13,
+	         run_after        = $14,
+	         error_class      = $15,
+	         dead_lettered_at = $16,
+	         updated_at       = $17,
+	         start_kind       = $18,
+	         start_latency_ms = $19,
+	         cancel_requested = cancel_requested AND $1::text = 'running'
+	   WHERE id = $20`
+	if cond != "" {
+		query += " AND " + cond
+	}
+	args := []any{
+		j.Status, j.Output, j.Result, j.Stdout, j.Stderr, j.ExitCode, j.Truncated,
+		j.StartedAt, j.FinishedAt, j.DurationMs, j.WorkerID, j.LeaseExpiresAt, j.Recoveries,
+		j.RunAfter, j.ErrorClass, j.DeadLetteredAt, j.UpdatedAt, j.StartKind, j.StartLatencyMs, j.ID,
+	}
+	res, err := r.db.ExecContext(ctx, query, append(args, condArgs...)...)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+func (r *postgresRepo) Claim(ctx context.Context, workerID string, lease time.Duration) (*Job, error) {
 	const query = `
 	  UPDATE jobs
-	     SET status    = $1,
-	         result    = $2,
-	         updated_at= $3
-	   WHERE id = $4
+	     SET status = $1, worker_id = $2, lease_expires_at = $3, updated_at = $4,
+	         attempts = attempts + 1
+	   WHERE id = (
+	         SELECT id
+	           FROM jobs
+	          WHERE status = $5 AND run_after <= $4
+	          ORDER BY run_after
+	          LIMIT 1
+	            FOR UPDATE SKIP LOCKED
+	         )
+	  RETURNING ` + jobColumns
+	now := time.Now()
+	var row Job
+	err := r.db.GetContext(ctx, &row, query, StatusRunning, workerID, now.Add(lease), now, StatusQueued)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrQueueEmpty
+		}
+		return nil, err
+	}
+	return &row, nil
+}
+
+func (r *postgresRepo) Defer(ctx context.Context, jobID uuid.UUID, workerID string, runAfter time.Time) (bool, error) {
+	const query = `
+	  UPDATE jobs
+	     SET status = $1, worker_id = '', lease_expires_at = NULL, run_after = $2, updated_at = $3,
+	         attempts = attempts - 1
+	   WHERE id = $4 AND status = $5 AND worker_id = $6
+	`
+	res, err := r.db.ExecContext(ctx, query, StatusQueued, runAfter, time.Now(), jobID, StatusRunning, workerID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+func (r *postgresRepo) Heartbeat(ctx context.Context, workerID string, jobIDs []uuid.UUID, lease time.Duration) ([]uuid.UUID, error) {
+	const query = `
+	  UPDATE jobs
+	     SET lease_expires_at = $1
+	   WHERE id = ANY($2::uuid[]) AND worker_id = $3 AND status = $4
+	  RETURNING id
 	`
-	_, err := r.db.ExecContext(ctx, query, j.Status, j.Result, j.UpdatedAt, j.ID)
+	var held []uuid.UUID
+	err := r.db.SelectContext(ctx, &held, query, time.Now().Add(lease), uuidArray(jobIDs), workerID, StatusRunning)
+	if err != nil {
+		return nil, err
+	}
+	return held, nil
+}
+
+func (r *postgresRepo) ExpiredLeases(ctx context.Context, now time.Time) ([]Job, error) {
+	const query = `
+	  SELECT ` + jobColumns + `
+	    FROM jobs
+	   WHERE status = $1 AND lease_expires_at < $2
+	   ORDER BY lease_expires_at
+	`
+	var jobs []Job
+	if err := r.db.SelectContext(ctx, &jobs, query, StatusRunning, now); err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+func (r *postgresRepo) RequestCancel(ctx context.Context, jobID uuid.UUID) (bool, error) {
+	const query = `
+	  UPDATE jobs
+	     SET cancel_requested = TRUE
+	   WHERE id = $1 AND status = $2
+	`
+	res, err := r.db.ExecContext(ctx, query, jobID, StatusRunning)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+func (r *postgresRepo) RequestCancelOwner(ctx context.Context, owner string) ([]uuid.UUID, error) {
+	const query = `
+	  UPDATE jobs
+	     SET cancel_requested = TRUE
+	   WHERE owner = $1 AND status = $2
+	  RETURNING id
+	`
+	var requested []uuid.UUID
+	if err := r.db.SelectContext(ctx, &requested, query, owner, StatusRunning); err != nil {
+		return nil, err
+	}
+	return requested, nil
+}
+
+func (r *postgresRepo) CancelRequested(ctx context.Context, jobIDs []uuid.UUID) ([]uuid.UUID, error) {
+	const query = `
+	  SELECT ids.id
+	    FROM unnest($1::uuid[]) AS ids (id)
+	    LEFT JOIN jobs j ON j.id = ids.id
+	   WHERE j.id IS NULL OR j.cancel_requested
+	`
+	var requested []uuid.UUID
+	if err := r.db.SelectContext(ctx, &requested, query, uuidArray(jobIDs)); err != nil {
+		return nil, err
+	}
+	return requested, nil
+}
+
+func (r *postgresRepo) RecordAttempt(ctx context.Context, a *Attempt) error {
+	const query = `
+	  INSERT INTO job_attempts (job_id, attempt, worker_id, status, error_class, error, exit_code, started_at, finished_at)
+	  VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+	`
+	_, err := r.db.ExecContext(ctx, query,
+		a.JobID, a.Attempt, a.WorkerID, a.Status, a.ErrorClass, a.Error, a.ExitCode, a.StartedAt, a.FinishedAt)
 	return err
 }
+
+func (r *postgresRepo) ListAttempts(ctx context.Context, jobID uuid.UUID) ([]Attempt, error) {
+	const query = `
+	  SELECT job_id, attempt, worker_id, status, error_class, error, exit_code, started_at, finished_at
+	    FROM job_attempts
+	   WHERE job_id = $1
+	   ORDER BY attempt
+	`
+	attempts := []Attempt{}
+	if err := r.db.SelectContext(ctx, &attempts, query, jobID); err != nil {
+		return nil, err
+	}
+	return attempts, nil
+}
+
+// deadLetterWhere matches dead-lettered jobs against a DeadLetterFilter
+// passed as $1 (job IDs) and $2 (function ID).
+const deadLetterWhere = `
+	   WHERE status = 'dead_lettered'
+	     AND (cardinality($1::uuid[]) = 0 OR id = ANY($1::uuid[]))
+	     AND ($2::uuid IS NULL OR function_id = $2)`
+
+func (r *postgresRepo) ListDeadLettered(ctx context.Context, filter DeadLetterFilter, limit, offset int) ([]Job, error) {
+	const query = `
+	  SELECT ` + jobColumns + `
+	    FROM jobs` + deadLetterWhere + `
+	   ORDER BY dead_lettered_at DESC
+	   LIMIT $3 OFFSET $4
+	`
+	jobs := []Job{}
+	err := r.db.SelectContext(ctx, &jobs, query, uuidArray(filter.JobIDs), filter.FunctionID, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+func (r *postgresRepo) RequeueDeadLettered(ctx context.Context, filter DeadLetterFilter) (int64, error) {
+	const query = `
+	  UPDATE jobs
+	     SET status = 'queued',
+	         result = '',
+	         output = 'null',
+	         stdout = '',
+	         stderr = '',
+	         exit_code = NULL,
+	         truncated = FALSE,
+	         started_at = NULL,
+	         finished_at = NULL,
+	         duration_ms = NULL,
+	         start_kind = '',
+	         start_latency_ms = NULL,
+	         cancel_requested = FALSE,
+	         error_class = '',
+	         dead_lettered_at = NULL,
+	         attempt_offset = attempts,
+	         run_after = $3,
+	         updated_at = $3` + deadLetterWhere
+	res, err := r.db.ExecContext(ctx, query, uuidArray(filter.JobIDs), filter.FunctionID, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (r *postgresRepo) PurgeDeadLettered(ctx context.Context, filter DeadLetterFilter) (int64, error) {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	const attempts = `DELETE FROM job_attempts WHERE job_id IN (SELECT id FROM jobs` + deadLetterWhere + `)`
+	if _, err := tx.ExecContext(ctx, attempts, uuidArray(filter.JobIDs), filter.FunctionID); err != nil {
+		return 0, err
+	}
+	res, err := tx.ExecContext(ctx, `DELETE FROM jobs`+deadLetterWhere, uuidArray(filter.JobIDs), filter.FunctionID)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return n, tx.Commit()
+}
+
+func uuidArray(ids []uuid.UUID) any {
+	strs := make([]string, len(ids))
+	for i, id := range ids {
+		strs[i] = id.String()
+	}
+	return pq.Array(strs)
+}
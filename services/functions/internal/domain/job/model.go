@@ -1,6 +1,7 @@
 package job
 
 import (
+	"encoding/json"
 	"time"
 
 	"github.com/google/uuid"
@@ -9,29 +10,115 @@ import (
 type Status string
 
 const (
-	StatusQueued  Status = "queued"
-	StatusRunning Status = "running"
-	StatusDone    Status = "done"
-	StatusError   Status = "error"
+	StatusQueued    Status = "queued"
+	StatusRunning   Status = "running"
+	StatusDone      Status = "done"
+	StatusError     Status = "error"
+	StatusCancelled Status = "cancelled"
+	// StatusDeadLettered is a job that failed and will not be retried. It
+	// stays in the dead-letter queue until an admin requeues or purges it.
+	StatusDeadLettered Status = "dead_lettered"
 )
 
 type Job struct {
 	ID         uuid.UUID `db:"id"`
 	FunctionID uuid.UUID `db:"function_id"`
-	Status     Status    `db:"status"`
-	Result     string    `db:"result"`
-	CreatedAt  time.Time `db:"created_at"`
-	UpdatedAt  time.Time `db:"updated_at"`
+	// FunctionVersion pins the job to the code it was queued with, so later
+	// edits to the function do not change what it runs.
+	FunctionVersion int    `db:"function_version"`
+	Owner           string `db:"owner"`
+	Status          Status `db:"status"`
+	// Input is the JSON payload passed to the function.
+	Input json.RawMessage `db:"input"`
+	// Output is the JSON result reported by the function, kept apart from
+	// its stdout and stderr.
+	Output json.RawMessage `db:"output"`
+	// Result holds the reason a job failed and is empty otherwise.
+	Result string `db:"result"`
+
+	Stdout string `db:"stdout"`
+	Stderr string `db:"stderr"`
+	// ExitCode is nil until the container exits on its own; a job that
+	// timed out has none.
+	ExitCode *int `db:"exit_code"`
+	// Truncated reports that stdout or stderr hit the output size limit.
+	Truncated  bool       `db:"truncated"`
+	StartedAt  *time.Time `db:"started_at"`
+	FinishedAt *time.Time `db:"finished_at"`
+	DurationMs *int64     `db:"duration_ms"`
+	// StartKind is StartCold or StartWarm, and StartLatencyMs the time from
+	// the worker asking for a container until the function started in it.
+	StartKind      string `db:"start_kind"`
+	StartLatencyMs *int64 `db:"start_latency_ms"`
+
+	// WorkerID and LeaseExpiresAt identify the worker running the job and
+	// how long its claim lasts without a heartbeat.
+	WorkerID       string     `db:"worker_id"`
+	LeaseExpiresAt *time.Time `db:"lease_expires_at"`
+	// Recoveries counts how often the job was requeued after its worker
+	// stopped heartbeating.
+	Recoveries int `db:"recoveries"`
+	// CancelRequested is set when a cancel arrives while the job runs.
+	CancelRequested bool `db:"cancel_requested"`
+	// Attempts counts the times a worker claimed the job. A failed attempt
+	// that is retried puts the job back in the queue until RunAfter.
+	Attempts int       `db:"attempts"`
+	RunAfter time.Time `db:"run_after"`
+	// AttemptOffset is Attempts when the job was last requeued from the
+	// dead-letter queue, so a requeued job gets a fresh set of retries.
+	AttemptOffset int `db:"attempt_offset"`
+
+	// ErrorClass and DeadLetteredAt describe why and when the job was
+	// dead-lettered.
+	ErrorClass     string     `db:"error_class"`
+	DeadLetteredAt *time.Time `db:"dead_lettered_at"`
+	// SourceJobID is set on a job that delivers another job's failure to
+	// its function's failure destination.
+	SourceJobID *uuid.UUID `db:"source_job_id"`
+
+	CreatedAt time.Time `db:"created_at"`
+	UpdatedAt time.Time `db:"updated_at"`
+}
+
+// Ways a function's container is started.
+const (
+	// StartCold is a container created and started for the job.
+	StartCold = "cold"
+	// StartWarm is a pre-started container taken from the warm pool.
+	StartWarm = "warm"
+)
+
+// Execution is what a container run produced.
+type Execution struct {
+	Stdout       string
+	Stderr       string
+	ExitCode     *int
+	Truncated    bool
+	StartKind    string
+	StartLatency time.Duration
+	StartedAt    time.Time
+	FinishedAt   time.Time
+	Output       json.RawMessage
 }
 
-func NewJob(functionID uuid.UUID) *Job {
+// NewJob queues a run of the given function version. A nil input is stored
+// as JSON null.
+func NewJob(functionID uuid.UUID, functionVersion int, owner string, input json.RawMessage) *Job {
+	if len(input) == 0 {
+		input = json.RawMessage("null")
+	}
 	now := time.Now()
 	return &Job{
-		ID:         uuid.New(),
-		FunctionID: functionID,
-		Status:     StatusQueued,
-		CreatedAt:  now,
-		UpdatedAt:  now,
+		ID:              uuid.New(),
+		FunctionID:      functionID,
+		FunctionVersion: functionVersion,
+		Owner:           owner,
+		Input:           input,
+		Output:          json.RawMessage("null"),
+		Status:          StatusQueued,
+		RunAfter:        now,
+		CreatedAt:       now,
+		UpdatedAt:       now,
 	}
 }
 
@@ -40,14 +127,126 @@ func (j *Job) MarkRunning() {
 	j.UpdatedAt = time.Now()
 }
 
-func (j *Job) MarkDone(result string) {
+// RecordExecution stores the output and timing of a run. It is applied
+// before MarkDone or MarkError so a failed run keeps its output.
+func (j *Job) RecordExecution(e Execution) {
+	j.Stdout = e.Stdout
+	j.Stderr = e.Stderr
+	j.ExitCode = e.ExitCode
+	j.Truncated = e.Truncated
+	latency := e.StartLatency.Milliseconds()
+	j.StartKind = e.StartKind
+	j.StartLatencyMs = &latency
+	if len(e.Output) > 0 {
+		j.Output = e.Output
+	}
+	started, finished := e.StartedAt, e.FinishedAt
+	duration := finished.Sub(started).Milliseconds()
+	j.StartedAt = &started
+	j.FinishedAt = &finished
+	j.DurationMs = &duration
+	j.UpdatedAt = time.Now()
+}
+
+func (j *Job) MarkDone() {
 	j.Status = StatusDone
-	j.Result = result
+	j.Result = ""
+	j.UpdatedAt = time.Now()
+}
+
+func (j *Job) MarkCancelled() {
+	j.Status = StatusCancelled
+	j.Result = "job cancelled"
 	j.UpdatedAt = time.Now()
 }
 
+// ScheduleRetry puts a failed job back in the queue to be attempted again
+// at runAfter. errMsg is kept in Result until the next attempt finishes;
+// the failed run's output is dropped.
+func (j *Job) ScheduleRetry(errMsg string, runAfter time.Time) {
+	j.clearRun()
+	j.Status = StatusQueued
+	j.Result = errMsg
+	j.RunAfter = runAfter
+	j.UpdatedAt = time.Now()
+}
+
+// MarkDeadLettered fails the job for good, moving it to the dead-letter
+// queue.
+func (j *Job) MarkDeadLettered(errMsg, errorClass string) {
+	now := time.Now()
+	j.Status = StatusDeadLettered
+	j.Result = errMsg
+	j.ErrorClass = errorClass
+	j.DeadLetteredAt = &now
+	j.UpdatedAt = now
+}
+
+// CurrentAttempt numbers the running attempt from 1, counting from the last
+// requeue out of the dead-letter queue.
+func (j *Job) CurrentAttempt() int {
+	return j.Attempts - j.AttemptOffset
+}
+
+// Requeue puts a job whose worker disappeared back in the queue.
+func (j *Job) Requeue() {
+	j.clearRun()
+	j.Status = StatusQueued
+	j.WorkerID = ""
+	j.LeaseExpiresAt = nil
+	j.Recoveries++
+	j.UpdatedAt = time.Now()
+}
+
+// clearRun drops what the last run recorded, so a job back in the queue
+// does not show the output of a run that is over.
+func (j *Job) clearRun() {
+	j.Output = json.RawMessage("null")
+	j.Stdout = ""
+	j.Stderr = ""
+	j.ExitCode = nil
+	j.Truncated = false
+	j.StartedAt = nil
+	j.FinishedAt = nil
+	j.DurationMs = nil
+	j.StartKind = ""
+	j.StartLatencyMs = nil
+	j.CancelRequested = false
+}
+
+// Release drops the worker's claim so the job is no longer leased.
+func (j *Job) Release() {
+	j.WorkerID = ""
+	j.LeaseExpiresAt = nil
+}
+
+// IsFinished reports whether the job has reached a final status.
+func (j *Job) IsFinished() bool {
+	switch j.Status {
+	case StatusDone, StatusError, StatusCancelled, StatusDeadLettered:
+		return true
+	}
+	return false
+}
+
 func (j *Job) MarkError(errMsg string) {
 	j.Status = StatusError
 	j.Result = errMsg
 	j.UpdatedAt = time.Now()
 }
+
+// Attempt records one run of a job. A job has several when failed runs are
+// retried.
+type Attempt struct {
+	JobID    uuid.UUID `db:"job_id"`
+	Attempt  int       `db:"attempt"`
+	WorkerID string    `db:"worker_id"`
+	Status   Status    `db:"status"`
+	// ErrorClass is one of the function package's error classes for a
+	// failed attempt and empty otherwise.
+	ErrorClass string    `db:"error_class"`
+	Error      string    `db:"error"`
+	ExitCode   *int      `db:"exit_code"`
+	StartedAt  time.Time `db:"started_at"`
+	FinishedAt time.Time `db:"finished_at"`
+}
@@ -3,14 +3,71 @@ package job
 import (
 	"context"
 	"errors"
+	"time"
 
 	"github.com/google/uuid"
 )
 
-var ErrNotFound = errors.New("job not found")
+var (
+	ErrNotFound   = errors.New("job not found")
+	ErrQueueEmpty = errors.New("no queued jobs")
+)
 
 type Repository interface {
 	Create(ctx context.Context, job *Job) error
 	GetByID(ctx context.Context, jobID uuid.UUID) (*Job, error)
 	Update(ctx context.Context, job *Job) error
+	// UpdateIfStatus saves job only if its stored status is still from,
+	// reporting whether it did. It guards transitions that can race, such
+	// as a worker starting a job that is being cancelled.
+	UpdateIfStatus(ctx context.Context, job *Job, from Status) (bool, error)
+
+	// UpdateClaimed saves a job only while workerID still holds its lease,
+	// so a worker that lost its lease cannot overwrite the job.
+	UpdateClaimed(ctx context.Context, job *Job, workerID string) (bool, error)
+
+	// Claim marks the queued job that has waited longest past its RunAfter
+	// running under a lease held by workerID, counts the attempt and returns
+	// the job, skipping jobs being claimed concurrently. It returns
+	// ErrQueueEmpty when there is nothing to run.
+	Claim(ctx context.Context, workerID string, lease time.Duration) (*Job, error)
+	// Defer puts a job workerID holds back in the queue until runAfter,
+	// without counting the claim as an attempt, reporting whether workerID
+	// still held the job.
+	Defer(ctx context.Context, jobID uuid.UUID, workerID string, runAfter time.Time) (bool, error)
+	// Heartbeat extends workerID's leases on jobIDs and returns the jobs it
+	// still holds.
+	Heartbeat(ctx context.Context, workerID string, jobIDs []uuid.UUID, lease time.Duration) ([]uuid.UUID, error)
+	// ExpiredLeases returns running jobs whose lease ran out before now.
+	ExpiredLeases(ctx context.Context, now time.Time) ([]Job, error)
+	// ReleaseExpired saves a job taken over from an expired lease, unless
+	// its worker renewed the lease in the meantime.
+	ReleaseExpired(ctx context.Context, job *Job, now time.Time) (bool, error)
+
+	// RequestCancel flags a running job for cancellation by whichever
+	// replica runs it, reporting whether the job was still running.
+	RequestCancel(ctx context.Context, jobID uuid.UUID) (bool, error)
+	// RequestCancelOwner flags every running job of owner for cancellation
+	// and returns their IDs.
+	RequestCancelOwner(ctx context.Context, owner string) ([]uuid.UUID, error)
+	// CancelRequested returns those of jobIDs flagged for cancellation, or
+	// deleted since they started.
+	CancelRequested(ctx context.Context, jobIDs []uuid.UUID) ([]uuid.UUID, error)
+
+	RecordAttempt(ctx context.Context, attempt *Attempt) error
+	ListAttempts(ctx context.Context, jobID uuid.UUID) ([]Attempt, error)
+
+	ListDeadLettered(ctx context.Context, filter DeadLetterFilter, limit, offset int) ([]Job, error)
+	// RequeueDeadLettered moves the matching dead-lettered jobs back to the
+	// queue with a fresh set of retries and returns how many it moved.
+	RequeueDeadLettered(ctx context.Context, filter DeadLetterFilter) (int64, error)
+	// PurgeDeadLettered deletes the matching dead-lettered jobs and their
+	// attempts and returns how many it deleted.
+	PurgeDeadLettered(ctx context.Context, filter DeadLetterFilter) (int64, error)
+}
+
+// DeadLetterFilter selects dead-lettered jobs. Empty fields match every job.
+type DeadLetterFilter struct {
+	JobIDs     []uuid.UUID
+	FunctionID *uuid.UUID
 }
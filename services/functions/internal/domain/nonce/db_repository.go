@@ -0,0 +1,41 @@
+package nonce
+
+import (
+	"context"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type postgresRepo struct {
+	db *sqlx.DB
+}
+
+func NewPostgresRepository(db *sqlx.DB) Repository {
+	return &postgresRepo{db: db}
+}
+
+func (r *postgresRepo) Use(ctx context.Context, nonce string, now time.Time) (bool, error) {
+	const query = `
+	INSERT INTO identity_nonces (nonce, used_at)
+	VALUES ($1, $2)
+	ON CONFLICT (nonce) DO NOTHING
+	`
+	res, err := r.db.ExecContext(ctx, query, nonce, now)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+func (r *postgresRepo) DeleteBefore(ctx context.Context, before time.Time) (int64, error) {
+	res, err := r.db.ExecContext(ctx, `DELETE FROM identity_nonces WHERE used_at < $1`, before)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
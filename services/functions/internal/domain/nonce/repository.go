@@ -0,0 +1,17 @@
+// Package nonce records the nonces of signed gateway identities, so every
+// replica rejects a nonce any of them has seen.
+package nonce
+
+import (
+	"context"
+	"time"
+)
+
+type Repository interface {
+	// Use records nonce as used at now and reports whether it was not used
+	// before.
+	Use(ctx context.Context, nonce string, now time.Time) (bool, error)
+	// DeleteBefore forgets the nonces used before before and returns how
+	// many it forgot.
+	DeleteBefore(ctx context.Context, before time.Time) (int64, error)
+}
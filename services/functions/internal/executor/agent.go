@@ -0,0 +1,264 @@
+package executor
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+	imageTypes "github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/volume"
+	"github.com/docker/docker/errdefs"
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/docker/docker/pkg/stdcopy"
+
+	"platform/functions/internal/agent"
+)
+
+// agentDir is where function containers mount the agent volume, and
+// agentPath the agent in it.
+const (
+	agentDir  = "/.platform"
+	agentPath = agentDir + "/fn-agent"
+)
+
+// agentRepository names the agent volume and the image used to fill it,
+// after the agent's hash.
+const agentRepository = "platform-agent"
+
+// InstallAgent makes binary the agent every function container runs. Function
+// containers have a read-only root filesystem and Docker only copies files
+// into their volumes, so the agent is kept in a named volume per agent build,
+// which they mount read-only. The volume is filled through a container of an
+// image holding nothing but the agent, which never starts.
+func (dr *DockerRunner) InstallAgent(ctx context.Context, binary []byte) error {
+	sum := sha256.Sum256(binary)
+	id := hex.EncodeToString(sum[:])[:16]
+	name := agentRepository + "-" + id
+
+	if _, err := dr.cli.VolumeCreate(ctx, volume.CreateOptions{Name: name}); err != nil {
+		return fmt.Errorf("volume create error: %w", err)
+	}
+	archive, err := tarFiles(containerFile{name: "fn-agent", mode: 0o755, data: binary})
+	if err != nil {
+		return err
+	}
+	image := agentRepository + ":" + id
+	if _, _, err := dr.cli.ImageInspectWithRaw(ctx, image); errdefs.IsNotFound(err) {
+		rc, err := dr.cli.ImageImport(ctx,
+			imageTypes.ImportSource{Source: bytes.NewReader(archive), SourceName: "-"},
+			image,
+			imageTypes.ImportOptions{Changes: []string{`CMD ["/fn-agent"]`}})
+		if err != nil {
+			return fmt.Errorf("image import error: %w", err)
+		}
+		err = jsonmessage.DisplayJSONMessagesStream(rc, io.Discard, 0, false, nil)
+		rc.Close()
+		if err != nil {
+			return fmt.Errorf("image import error: %w", err)
+		}
+	} else if err != nil {
+		return fmt.Errorf("image inspect error: %w", err)
+	}
+
+	resp, err := dr.cli.ContainerCreate(ctx, &container.Config{Image: image}, &container.HostConfig{
+		Mounts: []mount.Mount{{Type: mount.TypeVolume, Source: name, Target: agentDir}},
+	}, nil, nil, "")
+	if err != nil {
+		return fmt.Errorf("container create error: %w", err)
+	}
+	defer dr.cli.ContainerRemove(context.Background(), resp.ID, container.RemoveOptions{Force: true})
+
+	if _, err := dr.cli.ContainerStatPath(ctx, resp.ID, agentPath); err != nil {
+		if err := dr.copyArchive(ctx, resp.ID, agentDir, archive); err != nil {
+			// another replica may have filled the volume meanwhile, and its
+			// containers may already be running the agent
+			if _, statErr := dr.cli.ContainerStatPath(ctx, resp.ID, agentPath); statErr != nil {
+				return err
+			}
+		}
+	}
+	dr.agentVolume = name
+	return nil
+}
+
+// versionSpec is what the agent needs to run a version: its files and the
+// command line and environment of the version's image. runtime is set when
+// a warm container of that runtime, started from image, can run the
+// version.
+type versionSpec struct {
+	runtime    string
+	image      string
+	entrypoint []string
+	env        []string
+	files      []byte
+}
+
+func (s *versionSpec) request() *agent.Request {
+	return &agent.Request{
+		Entrypoint: s.entrypoint,
+		Env:        s.env,
+		Files:      s.files,
+	}
+}
+
+// versionSpec returns how the agent runs the version built into image. The
+// version's files are kept in the workspace cache by image ID; a replica
+// that did not build the image copies them out of it once.
+func (dr *DockerRunner) versionSpec(ctx context.Context, image string) (*versionSpec, error) {
+	info, _, err := dr.cli.ImageInspectWithRaw(ctx, image)
+	if err != nil {
+		if errdefs.IsNotFound(err) {
+			return nil, fmt.Errorf("%w: %s", ErrImageNotFound, image)
+		}
+		return nil, fmt.Errorf("image inspect error: %w", err)
+	}
+	if info.Config == nil || len(info.Config.Entrypoint) == 0 {
+		return nil, fmt.Errorf("image %s has no entrypoint", image)
+	}
+
+	key := workspaceKey(info.ID)
+	files, ok := dr.workspaces.get(key)
+	if !ok {
+		files, err = dr.extractWorkspace(ctx, image)
+		if err != nil {
+			return nil, err
+		}
+		if err := dr.workspaces.put(key, files); err != nil {
+			return nil, fmt.Errorf("workspace cache error: %w", err)
+		}
+	}
+	spec := &versionSpec{
+		entrypoint: info.Config.Entrypoint,
+		env:        info.Config.Env,
+		files:      files,
+	}
+	// a warm container can run it when the image adds nothing to the
+	// runtime's own image but the version's files
+	rt, ok := dr.runtimes.Lookup(info.Config.Labels[runtimeLabel])
+	if ok && info.Config.Labels[baseImageLabel] == rt.Image {
+		spec.runtime, spec.image = rt.Name, rt.Image
+	}
+	return spec, nil
+}
+
+func workspaceKey(imageID string) string {
+	return strings.TrimPrefix(imageID, "sha256:")
+}
+
+// extractWorkspace copies the files in resultDir out of a version's image,
+// as a tar with names relative to resultDir.
+func (dr *DockerRunner) extractWorkspace(ctx context.Context, image string) ([]byte, error) {
+	resp, err := dr.cli.ContainerCreate(ctx, &container.Config{Image: image}, &container.HostConfig{}, nil, nil, "")
+	if err != nil {
+		return nil, fmt.Errorf("container create error: %w", err)
+	}
+	defer dr.cli.ContainerRemove(context.Background(), resp.ID, container.RemoveOptions{Force: true, RemoveVolumes: true})
+
+	rc, _, err := dr.cli.CopyFromContainer(ctx, resp.ID, resultDir)
+	if err != nil {
+		return nil, fmt.Errorf("workspace copy error: %w", err)
+	}
+	defer rc.Close()
+
+	// the copy is rooted at resultDir's base name, which is dropped
+	var buf bytes.Buffer
+	tr := tar.NewReader(rc)
+	tw := tar.NewWriter(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("workspace copy error: %w", err)
+		}
+		_, name, ok := strings.Cut(hdr.Name, "/")
+		if !ok || name == "" {
+			continue
+		}
+		hdr.Name = name
+		if err := tw.WriteHeader(hdr); err != nil {
+			return nil, err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return nil, fmt.Errorf("workspace copy error: %w", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// awaitResult waits for the function to exit and fetches its result from
+// the agent, while the container still runs and resultDir still holds the
+// result file. If ctx ends first, interrupted is ctx's error. If the agent
+// died without reporting, as when it is OOM-killed, the result is the
+// container's exit code alone.
+func (dr *DockerRunner) awaitResult(ctx context.Context, containerID string) (res *agent.Result, interrupted, err error) {
+	exec, err := dr.cli.ContainerExecCreate(ctx, containerID, container.ExecOptions{
+		User:         sandboxUser,
+		Cmd:          []string{agentPath, agent.ResultCommand},
+		AttachStdout: true,
+		AttachStderr: true,
+	})
+	if err != nil {
+		// the container is gone already
+		return dr.exitResult(ctx, containerID)
+	}
+	stream, err := dr.cli.ContainerExecAttach(ctx, exec.ID, container.ExecAttachOptions{})
+	if err != nil {
+		return dr.exitResult(ctx, containerID)
+	}
+	defer stream.Close()
+	// the stream does not end with ctx
+	stop := context.AfterFunc(ctx, func() { stream.Close() })
+	defer stop()
+
+	out := &cappedBuffer{limit: agent.MaxResultBytes + 64}
+	_, err = stdcopy.StdCopy(out, io.Discard, stream.Reader)
+	if ctx.Err() != nil {
+		return nil, ctx.Err(), nil
+	}
+	if err == nil && !out.truncated {
+		res, err = agent.ReadResult(&out.buf)
+		if err == nil {
+			return res, nil, nil
+		}
+	}
+	return dr.exitResult(ctx, containerID)
+}
+
+// exitResult is the result of a container whose agent did not report: its
+// exit code, once it stops.
+func (dr *DockerRunner) exitResult(ctx context.Context, containerID string) (*agent.Result, error, error) {
+	exitCode, interrupted, err := dr.wait(ctx, containerID)
+	if err != nil || interrupted != nil {
+		return nil, interrupted, err
+	}
+	return &agent.Result{ExitCode: exitCode}, nil, nil
+}
+
+// parseResult checks the result file a function wrote. No file, or an empty
+// one, means the function produced no structured output.
+func parseResult(res *agent.Result) (json.RawMessage, error) {
+	if res.TooLarge {
+		return nil, fmt.Errorf("%w: exceeds %d bytes", ErrInvalidResult, agent.MaxResultBytes)
+	}
+	data := bytes.TrimSpace(res.Output)
+	if len(data) == 0 {
+		return nil, nil
+	}
+	if !json.Valid(data) {
+		return nil, fmt.Errorf("%w: not valid JSON", ErrInvalidResult)
+	}
+	return json.RawMessage(data), nil
+}
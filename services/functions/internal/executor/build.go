@@ -0,0 +1,495 @@
+package executor
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/google/uuid"
+
+	"platform/functions/internal/domain/bundle"
+	"platform/functions/internal/domain/function"
+	"platform/functions/internal/runtimes"
+)
+
+// imageRepository is the local image repository function versions are
+// built into, tagged by ImageTag.
+const imageRepository = "platform-fn"
+
+// Labels of build containers and images, so they can be told apart from
+// anything else on the Docker host.
+const (
+	buildLabel    = "platform.build"
+	functionLabel = "platform.function_id"
+	versionLabel  = "platform.function_version"
+	ownerLabel    = "platform.owner"
+)
+
+// buildTimeout bounds one build step.
+const buildTimeout = 2 * time.Minute
+
+// buildLimits and buildTmpfsMB size build step containers; compilers and their
+// caches need far more than a function's defaults.
+var buildLimits = function.Limits{
+	MemoryMB:      1024,
+	CPUMillicores: 2000,
+	MaxPIDs:       256,
+}
+
+const buildTmpfsMB = 512
+
+// ErrCompile is wrapped by the error returned when a function's code does not
+// build or its dependencies do not install. The build log holds the output
+// of the failed step.
+var ErrCompile = errors.New("compile error")
+
+// ErrBuildTimeout is wrapped by the error returned when a build step runs
+// out of time. A slow registry or an overloaded host is as likely a cause as
+// the code, so it is not a compile error.
+var ErrBuildTimeout = errors.New("build step timed out")
+
+// CacheConfig is where the runner keeps build artifacts on local disk.
+type CacheConfig struct {
+	Dir string
+	// MaxBytes bounds the artifacts kept in Dir; the least recently used
+	// are removed beyond it. Zero keeps every artifact.
+	MaxBytes int64
+	// WorkspacesMaxBytes bounds the version files kept for warm starts, in
+	// the same way. An evicted workspace is copied out of its image again.
+	WorkspacesMaxBytes int64
+}
+
+// buildCache keeps build artifacts on local disk, keyed by a hash of the
+// build step and source, so each version of a function is built once per
+// replica.
+type buildCache struct {
+	dir      string
+	maxBytes int64
+}
+
+func buildKey(b *runtimes.Build, archive []byte, entry string) string {
+	h := sha256.New()
+	write := func(parts ...string) {
+		for _, p := range parts {
+			h.Write([]byte(p))
+			h.Write([]byte{0})
+		}
+	}
+	write(b.Image)
+	write(b.Command...)
+	write(b.Env...)
+	write(entry)
+	h.Write(archive)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// get returns an artifact, marking it as used for eviction.
+func (c buildCache) get(key string) ([]byte, bool) {
+	name := filepath.Join(c.dir, key)
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, false
+	}
+	now := time.Now()
+	_ = os.Chtimes(name, now, now)
+	return data, true
+}
+
+// put stores an artifact. It is written under a temporary name and renamed, so
+// concurrent builds of the same source never expose a partial file.
+func (c buildCache) put(key string, data []byte) error {
+	if err := os.MkdirAll(c.dir, 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(c.dir, key+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(c.dir, key)); err != nil {
+		return err
+	}
+	c.evict()
+	return nil
+}
+
+// evict removes the least recently used artifacts until the cache fits in
+// maxBytes. Subdirectories and files still being written are left alone.
+func (c buildCache) evict() {
+	if c.maxBytes <= 0 {
+		return
+	}
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return
+	}
+	type artifact struct {
+		name string
+		size int64
+		used time.Time
+	}
+	var artifacts []artifact
+	var total int64
+	for _, e := range entries {
+		if !e.Type().IsRegular() || strings.Contains(e.Name(), ".tmp-") {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		artifacts = append(artifacts, artifact{name: e.Name(), size: info.Size(), used: info.ModTime()})
+		total += info.Size()
+	}
+	sort.Slice(artifacts, func(i, j int) bool { return artifacts[i].used.Before(artifacts[j].used) })
+	for _, a := range artifacts {
+		if total <= c.maxBytes {
+			return
+		}
+		if err := os.Remove(filepath.Join(c.dir, a.name)); err == nil || os.IsNotExist(err) {
+			total -= a.size
+		}
+	}
+}
+
+// ImageTag is the tag of a function version's image in the local Docker
+// daemon.
+func ImageTag(functionID uuid.UUID, version int) string {
+	return fmt.Sprintf("%s:%s-v%d", imageRepository, functionID, version)
+}
+
+// ImageBuilder builds the images function versions run on.
+type ImageBuilder interface {
+	// BuildImage builds the version req.Function is at into an image and
+	// returns its tag, writing the output of every build step to log.
+	// When the code does not build or its dependencies do not install, the
+	// error wraps ErrCompile; a step that runs out of time wraps
+	// ErrBuildTimeout.
+	BuildImage(ctx context.Context, req BuildRequest, log io.Writer) (string, error)
+}
+
+// BuildRequest is the build of a single function version.
+type BuildRequest struct {
+	Function *function.Function
+	// Bundle is the version's bundle in canonical form, or nil for a
+	// version with inline code.
+	Bundle []byte
+}
+
+func (dr *DockerRunner) BuildImage(ctx context.Context, req BuildRequest, log io.Writer) (string, error) {
+	fn := req.Function
+	rt, ok := dr.runtimes.Lookup(fn.Language)
+	if !ok {
+		return "", fmt.Errorf("%w: %q", ErrUnknownRuntime, fn.Language)
+	}
+	ws, err := dr.prepare(ctx, req, rt, log)
+	if err != nil {
+		return "", err
+	}
+	tag := ImageTag(fn.ID, fn.Version)
+	if err := dr.commitImage(ctx, fn, rt, ws, tag, log); err != nil {
+		return "", err
+	}
+	fmt.Fprintf(log, "--- built %s\n", tag)
+	return tag, nil
+}
+
+// workspace is what a function container runs: the files in its working
+// directory, the image they go on and the file its entrypoint runs.
+type workspace struct {
+	archive []byte
+	image   string
+	entry   string
+	env     []string
+}
+
+// prepare builds the workspace of a version. Inline code is a single file
+// named after the runtime; a bundle is unpacked as it is and runs its
+// manifest's entrypoint, on an image with its dependencies installed if it
+// has any. Runtimes with a build step run the artifact in place of the code.
+func (dr *DockerRunner) prepare(ctx context.Context, req BuildRequest, rt *runtimes.Runtime, log io.Writer) (workspace, error) {
+	ws := workspace{image: rt.Image, entry: rt.FileName}
+	if req.Bundle == nil {
+		archive, err := tarFiles(containerFile{name: rt.FileName, mode: 0o644, data: []byte(req.Function.Code)})
+		if err != nil {
+			return ws, err
+		}
+		ws.archive = archive
+	} else {
+		manifest, err := bundle.ReadManifest(req.Bundle)
+		if err != nil {
+			return ws, err
+		}
+		ws.archive = req.Bundle
+		ws.entry = manifest.Entrypoint
+		if manifest.Dependencies != "" {
+			if rt.Dependencies == nil {
+				return ws, fmt.Errorf("%w: runtime %s does not install dependencies", ErrCompile, rt.Name)
+			}
+			depFile, err := bundle.ReadFile(req.Bundle, manifest.Dependencies)
+			if err != nil {
+				return ws, err
+			}
+			image, err := dr.installDependencies(ctx, req, rt, manifest.Dependencies, depFile, log)
+			if err != nil {
+				return ws, err
+			}
+			ws.image = image
+			ws.env = rt.Dependencies.Env
+		}
+	}
+
+	if rt.Build != nil {
+		artifact, err := dr.build(ctx, req, rt, ws, log)
+		if err != nil {
+			return ws, err
+		}
+		ws.archive, err = tarFiles(containerFile{name: rt.Build.Artifact, mode: 0o755, data: artifact})
+		if err != nil {
+			return ws, err
+		}
+		ws.entry = rt.Build.Artifact
+	}
+	return ws, nil
+}
+
+// commitImage creates the image of a version from its workspace. A
+// container of the workspace's image gets the files in resultDir and is
+// committed without ever starting. Function containers mount a tmpfs over
+// resultDir, so the files reach them through the agent, see versionSpec.
+func (dr *DockerRunner) commitImage(ctx context.Context, fn *function.Function, rt *runtimes.Runtime, ws workspace, tag string, log io.Writer) error {
+	// a dependency image is local and was just made or found
+	if ws.image == rt.Image {
+		if err := dr.ensureImage(ctx, ws.image, log); err != nil {
+			return err
+		}
+	}
+	containerCfg := &container.Config{
+		Image:      ws.image,
+		Entrypoint: runtimes.Command(rt.Entrypoint, ws.entry),
+		WorkingDir: resultDir,
+		Env:        append([]string{"HOME=/tmp", "TMPDIR=/tmp"}, ws.env...),
+		User:       sandboxUser,
+		Labels: map[string]string{
+			functionLabel:  fn.ID.String(),
+			versionLabel:   strconv.Itoa(fn.Version),
+			runtimeLabel:   rt.Name,
+			baseImageLabel: ws.image,
+			ownerLabel:     fn.Owner,
+		},
+	}
+	resp, err := dr.cli.ContainerCreate(ctx, containerCfg, &container.HostConfig{}, nil, nil, "")
+	if err != nil {
+		return fmt.Errorf("container create error: %w", err)
+	}
+	defer dr.cli.ContainerRemove(context.Background(), resp.ID, container.RemoveOptions{Force: true, RemoveVolumes: true})
+
+	if err := dr.copyArchive(ctx, resp.ID, resultDir, ws.archive); err != nil {
+		return err
+	}
+	committed, err := dr.cli.ContainerCommit(ctx, resp.ID, container.CommitOptions{Reference: tag})
+	if err != nil {
+		return fmt.Errorf("container commit error: %w", err)
+	}
+	// keep the files for warm starts, sparing a copy out of the image
+	if err := dr.workspaces.put(workspaceKey(committed.ID), ws.archive); err != nil {
+		return fmt.Errorf("workspace cache error: %w", err)
+	}
+	return nil
+}
+
+// build returns the artifact of the runtime's build step for a workspace,
+// building it unless it is cached. The workspace is copied into the build
+// container as files, so it never passes through a shell.
+func (dr *DockerRunner) build(ctx context.Context, req BuildRequest, rt *runtimes.Runtime, ws workspace, log io.Writer) ([]byte, error) {
+	b := rt.Build
+	key := buildKey(b, ws.archive, ws.entry)
+	if artifact, ok := dr.buildCache.get(key); ok {
+		fmt.Fprintf(log, "--- build: using the cached artifact\n")
+		return artifact, nil
+	}
+
+	var artifact []byte
+	err := dr.runStep(ctx, buildStep{
+		what: "build",
+		config: &container.Config{
+			Image:      b.Image,
+			Entrypoint: runtimes.Command(b.Command, ws.entry),
+			WorkingDir: resultDir,
+			Env:        append([]string{"HOME=/tmp", "TMPDIR=/tmp"}, b.Env...),
+			User:       sandboxUser,
+			Labels:     map[string]string{buildLabel: ImageTag(req.Function.ID, req.Function.Version)},
+		},
+		host:    dr.buildHostConfig(),
+		name:    fmt.Sprintf("fn-%s-build-%s", rt.Name, uuid.New().String()[:8]),
+		dest:    resultDir,
+		archive: ws.archive,
+		done: func(ctx context.Context, containerID string) (err error) {
+			artifact, err = dr.readArtifact(ctx, containerID, resultDir+"/"+b.Artifact)
+			return err
+		},
+	}, log)
+	if err != nil {
+		return nil, err
+	}
+	if err := dr.buildCache.put(key, artifact); err != nil {
+		return nil, fmt.Errorf("build cache error: %w", err)
+	}
+	return artifact, nil
+}
+
+// buildStep is one container run while building a version, such as a
+// compile or a dependency install.
+type buildStep struct {
+	// what names the step in errors and the build log.
+	what   string
+	config *container.Config
+	host   *container.HostConfig
+	name   string
+	// archive is a tar copied to dest before the container starts.
+	dest    string
+	archive []byte
+	// local is set when config.Image was made on this host, so it is never
+	// pulled.
+	local bool
+	// done is called with the stopped container after a successful run,
+	// before it is removed.
+	done func(ctx context.Context, containerID string) error
+}
+
+// stepSandbox is the sandbox of build steps, with room on /tmp for
+// toolchain and package manager caches.
+func (dr *DockerRunner) stepSandbox() Sandbox {
+	sandbox := dr.sandbox
+	sandbox.TmpfsSizeMB = buildTmpfsMB
+	return sandbox
+}
+
+// buildHostConfig is the host config of build step containers. Their
+// resultDir is an anonymous volume rather than a tmpfs, so the artifact can
+// be copied out once the step has exited.
+func (dr *DockerRunner) buildHostConfig() *container.HostConfig {
+	host := dr.stepSandbox().hostConfig(buildLimits, false)
+	host.Mounts = []mount.Mount{{Type: mount.TypeVolume, Target: resultDir}}
+	return host
+}
+
+// runStep runs a build step to completion under buildTimeout and writes its
+// output to log. When the step exits with an error, the error wraps
+// ErrCompile, and when it runs out of time, ErrBuildTimeout.
+func (dr *DockerRunner) runStep(ctx context.Context, s buildStep, log io.Writer) error {
+	// the pull does not count against the step's timeout
+	if !s.local {
+		if err := dr.ensureImage(ctx, s.config.Image, log); err != nil {
+			return err
+		}
+	}
+	stepCtx, cancel := context.WithTimeout(ctx, buildTimeout)
+	defer cancel()
+
+	resp, err := dr.cli.ContainerCreate(stepCtx, s.config, s.host, nil, nil, s.name)
+	if err != nil {
+		return fmt.Errorf("container create error: %w", err)
+	}
+	containerID := resp.ID
+	defer dr.cli.ContainerRemove(context.Background(), containerID, container.RemoveOptions{Force: true, RemoveVolumes: true})
+
+	if err := dr.copyArchive(stepCtx, containerID, s.dest, s.archive); err != nil {
+		return err
+	}
+	if err := dr.cli.ContainerStart(stepCtx, containerID, container.StartOptions{}); err != nil {
+		return fmt.Errorf("container start error: %w", err)
+	}
+	fmt.Fprintf(log, "--- %s: %s\n", s.what, strings.Join(s.config.Entrypoint, " "))
+
+	exitCode, interrupted, err := dr.wait(stepCtx, containerID)
+	if err != nil {
+		return err
+	}
+
+	collectCtx, cancelCollect := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelCollect()
+	if interrupted != nil {
+		_ = dr.cli.ContainerKill(collectCtx, containerID, "KILL")
+	}
+	if err := dr.copyLogs(collectCtx, containerID, log); err != nil {
+		return err
+	}
+	if interrupted != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("container stopped: %w", ctx.Err())
+		}
+		return fmt.Errorf("%w: %s ran for more than %s", ErrBuildTimeout, s.what, buildTimeout)
+	}
+
+	oomKilled, err := dr.oomKilled(collectCtx, containerID)
+	if err != nil {
+		return err
+	}
+	if oomKilled {
+		return fmt.Errorf("%w: %s exceeded its memory limit of %d MB", ErrCompile, s.what, buildLimits.MemoryMB)
+	}
+	if exitCode != 0 {
+		return fmt.Errorf("%w: %s exited with code %d", ErrCompile, s.what, exitCode)
+	}
+
+	if s.done != nil {
+		return s.done(collectCtx, containerID)
+	}
+	return nil
+}
+
+// copyLogs writes a container's stdout and stderr to w as one stream, in the
+// order they were written.
+func (dr *DockerRunner) copyLogs(ctx context.Context, containerID string, w io.Writer) error {
+	logs, err := dr.cli.ContainerLogs(ctx, containerID, container.LogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+	})
+	if err != nil {
+		return fmt.Errorf("container logs error: %w", err)
+	}
+	defer logs.Close()
+	if _, err := stdcopy.StdCopy(w, w, logs); err != nil {
+		return fmt.Errorf("container logs error: %w", err)
+	}
+	return nil
+}
+
+func (dr *DockerRunner) readArtifact(ctx context.Context, containerID, path string) ([]byte, error) {
+	rc, _, err := dr.cli.CopyFromContainer(ctx, containerID, path)
+	if err != nil {
+		return nil, fmt.Errorf("artifact copy error: %w", err)
+	}
+	defer rc.Close()
+
+	tr := tar.NewReader(rc)
+	if _, err := tr.Next(); err != nil {
+		return nil, fmt.Errorf("artifact copy error: %w", err)
+	}
+	artifact, err := io.ReadAll(tr)
+	if err != nil {
+		return nil, fmt.Errorf("artifact copy error: %w", err)
+	}
+	return artifact, nil
+}
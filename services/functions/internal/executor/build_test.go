@@ -0,0 +1,87 @@
+package executor
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBuildCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := buildCache{dir: t.TempDir(), maxBytes: 250}
+	artifact := make([]byte, 100)
+
+	if err := c.put("a", artifact); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.put("b", artifact); err != nil {
+		t.Fatal(err)
+	}
+	// make a older than b, then use it
+	old := time.Now().Add(-time.Hour)
+	for i, key := range []string{"a", "b"} {
+		used := old.Add(time.Duration(i) * time.Minute)
+		if err := os.Chtimes(filepath.Join(c.dir, key), used, used); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, ok := c.get("a"); !ok {
+		t.Fatal("a is missing")
+	}
+
+	if err := c.put("c", artifact); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.get("b"); ok {
+		t.Error("b, the least recently used artifact, was kept")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, ok := c.get(key); !ok {
+			t.Errorf("%s was evicted", key)
+		}
+	}
+}
+
+func TestBuildCacheKeepsSubdirectories(t *testing.T) {
+	c := buildCache{dir: t.TempDir(), maxBytes: 1}
+	sub := buildCache{dir: filepath.Join(c.dir, "workspaces")}
+	if err := sub.put("w", []byte("workspace")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.put("a", []byte("artifact")); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := sub.get("w"); !ok {
+		t.Error("an entry of a nested cache was evicted")
+	}
+}
+
+func TestBuildErrorClass(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want string
+	}{
+		{ErrCompile, "compile"},
+		{ErrBuildTimeout, "infrastructure"},
+		{ErrImagePull, "infrastructure"},
+		{fmt.Errorf("%w: %q", ErrUnknownRuntime, "cobol"), "infrastructure"},
+	} {
+		if got := buildErrorClass(tc.err); got != tc.want {
+			t.Errorf("buildErrorClass(%v) = %s, want %s", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestBuildBackoff(t *testing.T) {
+	for attempt, want := range map[int]time.Duration{
+		1:  buildRetryBackoff,
+		2:  2 * buildRetryBackoff,
+		3:  4 * buildRetryBackoff,
+		10: buildRetryMaxBackoff,
+	} {
+		if got := buildBackoff(attempt); got != want {
+			t.Errorf("buildBackoff(%d) = %s, want %s", attempt, got, want)
+		}
+	}
+}
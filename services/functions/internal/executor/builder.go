@@ -0,0 +1,186 @@
+package executor
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"platform/functions/internal/domain/bundle"
+	"platform/functions/internal/domain/function"
+)
+
+// buildStaleAfter is how long a build may run before another replica takes
+// it over, presuming its worker died. Build steps are bounded by
+// buildTimeout; the rest is pulls and commits.
+const buildStaleAfter = 15 * time.Minute
+
+// maxBuildLogBytes caps the build log kept for a version.
+const maxBuildLogBytes = 256 << 10
+
+// A build that fails on the platform rather than the code is retried up to
+// maxBuildAttempts times in all, waiting buildRetryBackoff after the first
+// failure and twice as long after each one since, up to buildRetryMaxBackoff.
+const (
+	maxBuildAttempts     = 5
+	buildRetryBackoff    = 10 * time.Second
+	buildRetryMaxBackoff = 5 * time.Minute
+)
+
+// Builder builds the image of every new function version. Versions waiting
+// for a build are queued in the function_versions table and claimed with
+// SELECT ... FOR UPDATE SKIP LOCKED, so any number of replicas can share the
+// builds, and creating a function never waits for one.
+type Builder struct {
+	workerID   string
+	funcRepo   function.Repository
+	bundleRepo bundle.Repository
+	images     ImageBuilder
+	wake       chan struct{}
+	quit       chan struct{}
+	numWorkers int
+}
+
+// NewBuilder creates a builder whose workers claim builds as workerID, which
+// must be unique per replica.
+func NewBuilder(
+	workerID string,
+	funcRepo function.Repository,
+	bundleRepo bundle.Repository,
+	images ImageBuilder,
+	numWorkers int,
+) *Builder {
+	return &Builder{
+		workerID:   workerID,
+		funcRepo:   funcRepo,
+		bundleRepo: bundleRepo,
+		images:     images,
+		wake:       make(chan struct{}, 1),
+		quit:       make(chan struct{}),
+		numWorkers: numWorkers,
+	}
+}
+
+func (b *Builder) Start() {
+	for i := 0; i < b.numWorkers; i++ {
+		go b.workerLoop(i)
+	}
+}
+
+func (b *Builder) Stop() {
+	close(b.quit)
+}
+
+// Wake tells an idle worker that a version is waiting for a build. It never
+// blocks.
+func (b *Builder) Wake() {
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (b *Builder) workerLoop(workerID int) {
+	for {
+		select {
+		case <-b.quit:
+			return
+		default:
+		}
+
+		v, err := b.funcRepo.ClaimBuild(context.Background(), b.workerID, time.Now().Add(-buildStaleAfter))
+		if err == nil {
+			if err := b.processBuild(v); err != nil {
+				log.Printf("[builder %d] error building %s version %d: %v\n", workerID, v.FunctionID, v.Version, err)
+			}
+			continue
+		}
+		if !errors.Is(err, function.ErrNoBuilds) {
+			log.Printf("[builder %d] error claiming build: %v\n", workerID, err)
+		}
+
+		select {
+		case <-b.wake:
+		case <-time.After(pollInterval):
+		case <-b.quit:
+			return
+		}
+	}
+}
+
+// processBuild builds a claimed version and records the outcome. A failure
+// of the platform, such as a registry or Docker outage, is retried until
+// the version runs out of attempts; any other failure fails the build. A
+// failed build can be requeued through the API.
+func (b *Builder) processBuild(v *function.Version) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-b.quit:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	buildLog := &cappedBuffer{limit: maxBuildLogBytes}
+	image, err := b.build(ctx, v, buildLog)
+	if err != nil {
+		class := buildErrorClass(err)
+		if class == function.ErrorInfrastructure && v.BuildAttempts < maxBuildAttempts {
+			v.ScheduleBuildRetry(err.Error(), class, buildLog.String(), time.Now().Add(buildBackoff(v.BuildAttempts)))
+		} else {
+			v.MarkBuildFailed(err.Error(), class, buildLog.String())
+		}
+	} else {
+		v.MarkBuilt(image, buildLog.String())
+	}
+
+	// the build may have been cancelled, so saving gets its own deadline
+	saveCtx, cancelSave := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelSave()
+	saved, saveErr := b.funcRepo.FinishBuild(saveCtx, v, b.workerID)
+	if saveErr != nil {
+		return saveErr
+	}
+	if !saved {
+		log.Printf("[builder] build of %s version %d was taken over, discarding the result\n", v.FunctionID, v.Version)
+	}
+	return err
+}
+
+// buildBackoff is how long a build waits after its attempt-th failure.
+func buildBackoff(attempt int) time.Duration {
+	backoff := buildRetryBackoff
+	for i := 1; i < attempt && backoff < buildRetryMaxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, buildRetryMaxBackoff)
+}
+
+// buildErrorClass tells a build that failed on the code from one that
+// failed on the platform. A language the runtime registry no longer has is
+// the platform's configuration at fault, as the language was valid when the
+// version was created.
+func buildErrorClass(err error) string {
+	if errors.Is(err, ErrCompile) {
+		return function.ErrorCompile
+	}
+	return function.ErrorInfrastructure
+}
+
+func (b *Builder) build(ctx context.Context, v *function.Version, buildLog *cappedBuffer) (string, error) {
+	fn, err := b.funcRepo.GetByID(ctx, v.FunctionID)
+	if err != nil {
+		return "", err
+	}
+	req := BuildRequest{Function: fn.AtVersion(v)}
+	if v.BundleDigest != nil {
+		bdl, err := b.bundleRepo.Get(ctx, *v.BundleDigest)
+		if err != nil {
+			return "", err
+		}
+		req.Bundle = bdl.Data
+	}
+	return b.images.BuildImage(ctx, req, buildLog)
+}
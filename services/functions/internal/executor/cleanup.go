@@ -0,0 +1,148 @@
+package executor
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	imageTypes "github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/errdefs"
+	"github.com/google/uuid"
+)
+
+// removeImage removes an image along with the untagged images it was built
+// on, logging any error.
+func (dr *DockerRunner) removeImage(ctx context.Context, image string) {
+	_, err := dr.cli.ImageRemove(ctx, image, imageTypes.RemoveOptions{Force: true, PruneChildren: true})
+	if err != nil && !errdefs.IsNotFound(err) {
+		log.Printf("[images] failed to remove %s: %v\n", image, err)
+	}
+}
+
+// removeTagged removes the images of repository whose labels match every
+// label filter, such as "platform.owner=alice".
+func (dr *DockerRunner) removeTagged(ctx context.Context, repository string, labels ...string) error {
+	args := filters.NewArgs(filters.Arg("reference", repository))
+	for _, l := range labels {
+		args.Add("label", l)
+	}
+	images, err := dr.cli.ImageList(ctx, imageTypes.ListOptions{Filters: args})
+	if err != nil {
+		return fmt.Errorf("image list error: %w", err)
+	}
+	for _, img := range images {
+		for _, tag := range img.RepoTags {
+			dr.removeImage(ctx, tag)
+		}
+	}
+	return nil
+}
+
+// FunctionImages lists the functions that have version images on the
+// Docker host.
+func (dr *DockerRunner) FunctionImages(ctx context.Context) ([]uuid.UUID, error) {
+	images, err := dr.cli.ImageList(ctx, imageTypes.ListOptions{
+		Filters: filters.NewArgs(
+			filters.Arg("reference", imageRepository),
+			filters.Arg("label", functionLabel),
+		),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("image list error: %w", err)
+	}
+	seen := make(map[uuid.UUID]bool)
+	var ids []uuid.UUID
+	for _, img := range images {
+		id, err := uuid.Parse(img.Labels[functionLabel])
+		if err != nil || seen[id] {
+			continue
+		}
+		seen[id] = true
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// RemoveFunctionImages removes the images of every version of a function.
+func (dr *DockerRunner) RemoveFunctionImages(ctx context.Context, functionID uuid.UUID) error {
+	return dr.removeTagged(ctx, imageRepository, functionLabel+"="+functionID.String())
+}
+
+// RemoveOwnerImages removes the version and dependency images built for
+// owner's functions. Version images go first, as they are built on the
+// dependency images.
+func (dr *DockerRunner) RemoveOwnerImages(ctx context.Context, owner string) error {
+	for _, repository := range []string{imageRepository, depsRepository} {
+		if err := dr.removeTagged(ctx, repository, ownerLabel+"="+owner); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RemoveUnusedImages removes the dependency images that no version image is
+// built on, except those made since before, which a build may be about to
+// commit a version on. Dependency images are counted as used by the version
+// images that name them in baseImageLabel. It returns how many it removed.
+func (dr *DockerRunner) RemoveUnusedImages(ctx context.Context, before time.Time) (int, error) {
+	versions, err := dr.cli.ImageList(ctx, imageTypes.ListOptions{
+		Filters: filters.NewArgs(filters.Arg("reference", imageRepository)),
+	})
+	if err != nil {
+		return 0, fmt.Errorf("image list error: %w", err)
+	}
+	refs := make(map[string]int)
+	for _, v := range versions {
+		if base := v.Labels[baseImageLabel]; base != "" {
+			refs[base]++
+		}
+	}
+
+	deps, err := dr.cli.ImageList(ctx, imageTypes.ListOptions{
+		Filters: filters.NewArgs(filters.Arg("reference", depsRepository)),
+	})
+	if err != nil {
+		return 0, fmt.Errorf("image list error: %w", err)
+	}
+	removed := 0
+	for _, img := range deps {
+		if !time.Unix(img.Created, 0).Before(before) {
+			continue
+		}
+		for _, tag := range img.RepoTags {
+			if refs[tag] > 0 {
+				continue
+			}
+			dr.removeImage(ctx, tag)
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+// RemoveBuildContainers removes the build step containers created before
+// before, which outlived the build they belong to, as when the builder
+// running it crashed. It returns how many it removed.
+func (dr *DockerRunner) RemoveBuildContainers(ctx context.Context, before time.Time) (int, error) {
+	list, err := dr.cli.ContainerList(ctx, container.ListOptions{
+		All:     true,
+		Filters: filters.NewArgs(filters.Arg("label", buildLabel)),
+	})
+	if err != nil {
+		return 0, fmt.Errorf("container list error: %w", err)
+	}
+	removed := 0
+	for _, c := range list {
+		if !time.Unix(c.Created, 0).Before(before) {
+			continue
+		}
+		if err := dr.RemoveContainer(ctx, c.ID); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
@@ -0,0 +1,148 @@
+package executor
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+
+	"platform/functions/internal/domain/bundle"
+	"platform/functions/internal/domain/function"
+)
+
+// ImageJanitor finds and removes the images builds leave behind.
+type ImageJanitor interface {
+	// FunctionImages lists the functions that have version images.
+	FunctionImages(ctx context.Context) ([]uuid.UUID, error)
+	// RemoveFunctionImages removes the images of a function's versions.
+	RemoveFunctionImages(ctx context.Context, functionID uuid.UUID) error
+	// RemoveUnusedImages removes the dependency images no version image is
+	// built on, except those made since before.
+	RemoveUnusedImages(ctx context.Context, before time.Time) (int, error)
+	// RemoveOwnerImages removes the images built for owner's functions.
+	RemoveOwnerImages(ctx context.Context, owner string) error
+}
+
+// collectTimeout bounds a collection started by CollectFunction or
+// CollectOwner.
+const collectTimeout = 10 * time.Minute
+
+// collectGrace is how long a bundle or dependency image is kept after it
+// was made, however unused. It covers the time between an upload and the
+// function that uses it being saved, and between a dependency install and
+// the version image built on it being committed.
+const collectGrace = 15 * time.Minute
+
+// Collector deletes the bundles and images that no live function version
+// uses any more. Version images go with their function, a bundle is in use
+// while a function that is not deleted, or one of its versions, refers to
+// it, and a dependency image while a version image is built on it.
+type Collector struct {
+	funcRepo   function.Repository
+	bundleRepo bundle.Repository
+	images     ImageJanitor
+	interval   time.Duration
+	quit       chan struct{}
+}
+
+func NewCollector(funcRepo function.Repository, bundleRepo bundle.Repository, images ImageJanitor, interval time.Duration) *Collector {
+	return &Collector{
+		funcRepo:   funcRepo,
+		bundleRepo: bundleRepo,
+		images:     images,
+		interval:   interval,
+		quit:       make(chan struct{}),
+	}
+}
+
+func (c *Collector) Start() {
+	go c.loop()
+}
+
+func (c *Collector) Stop() {
+	close(c.quit)
+}
+
+func (c *Collector) loop() {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.quit:
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), c.interval)
+		c.collect(ctx)
+		cancel()
+	}
+}
+
+func (c *Collector) collect(ctx context.Context) {
+	// version images first, so the dependency images they were built on
+	// are no longer counted as used
+	functions, err := c.images.FunctionImages(ctx)
+	if err != nil {
+		log.Printf("[collector] %v\n", err)
+	}
+	for _, id := range functions {
+		_, err := c.funcRepo.GetByID(ctx, id)
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, function.ErrNotFound) {
+			log.Printf("[collector] error loading function %s: %v\n", id, err)
+			continue
+		}
+		c.collectFunction(ctx, id)
+	}
+
+	before := time.Now().Add(-collectGrace)
+	n, err := c.bundleRepo.DeleteUnused(ctx, before)
+	if err != nil {
+		log.Printf("[collector] error deleting unused bundles: %v\n", err)
+	} else if n > 0 {
+		log.Printf("[collector] deleted %d unused bundles\n", n)
+	}
+	removed, err := c.images.RemoveUnusedImages(ctx, before)
+	if err != nil {
+		log.Printf("[collector] %v\n", err)
+	} else if removed > 0 {
+		log.Printf("[collector] removed %d unused dependency images\n", removed)
+	}
+}
+
+// CollectFunction removes the version images of a deleted function in the
+// background.
+func (c *Collector) CollectFunction(functionID uuid.UUID) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), collectTimeout)
+		defer cancel()
+		c.collectFunction(ctx, functionID)
+	}()
+}
+
+func (c *Collector) collectFunction(ctx context.Context, functionID uuid.UUID) {
+	if err := c.images.RemoveFunctionImages(ctx, functionID); err != nil {
+		log.Printf("[collector] %v\n", err)
+		return
+	}
+	log.Printf("[collector] removed the images of deleted function %s\n", functionID)
+}
+
+// CollectOwner removes the images of an owner whose functions were just
+// deleted in the background, then collects whatever else became unused.
+// Bundles uploaded within collectGrace are left to a later pass.
+func (c *Collector) CollectOwner(owner string) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), collectTimeout)
+		defer cancel()
+		if err := c.images.RemoveOwnerImages(ctx, owner); err != nil {
+			log.Printf("[collector] %v\n", err)
+		}
+		c.collect(ctx)
+	}()
+}
@@ -0,0 +1,62 @@
+package executor
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"platform/functions/internal/domain/function"
+	"platform/functions/internal/domain/job"
+)
+
+// failureEvent is the input a failure destination is invoked with.
+type failureEvent struct {
+	JobID          string          `json:"job_id"`
+	FunctionID     string          `json:"function_id"`
+	Version        int             `json:"version"`
+	Error          string          `json:"error"`
+	ErrorClass     string          `json:"error_class"`
+	Attempts       int             `json:"attempts"`
+	Input          json.RawMessage `json:"input"`
+	Stdout         string          `json:"stdout"`
+	Stderr         string          `json:"stderr"`
+	ExitCode       *int            `json:"exit_code"`
+	DeadLetteredAt *time.Time      `json:"dead_lettered_at"`
+}
+
+// routeFailure queues a job of fn's failure destination for a job that was
+// just dead-lettered. It returns the queued job, or nil if fn has no
+// destination. Failures of jobs that were themselves delivering a failure
+// are not routed again, so two functions pointing at each other cannot loop.
+func routeFailure(ctx context.Context, jobRepo job.Repository, funcRepo function.Repository, fn *function.Function, j *job.Job) (*job.Job, error) {
+	if fn.FailureDestination == nil || j.SourceJobID != nil {
+		return nil, nil
+	}
+	dest, err := funcRepo.GetByID(ctx, *fn.FailureDestination)
+	if err != nil {
+		return nil, err
+	}
+
+	input, err := json.Marshal(failureEvent{
+		JobID:          j.ID.String(),
+		FunctionID:     j.FunctionID.String(),
+		Version:        j.FunctionVersion,
+		Error:          j.Result,
+		ErrorClass:     j.ErrorClass,
+		Attempts:       j.CurrentAttempt(),
+		Input:          j.Input,
+		Stdout:         j.Stdout,
+		Stderr:         j.Stderr,
+		ExitCode:       j.ExitCode,
+		DeadLetteredAt: j.DeadLetteredAt,
+	})
+	if err != nil {
+		return nil, err
+	}
+	delivery := job.NewJob(dest.ID, dest.Version, dest.Owner, input)
+	delivery.SourceJobID = &j.ID
+	if err := jobRepo.Create(ctx, delivery); err != nil {
+		return nil, err
+	}
+	return delivery, nil
+}
@@ -0,0 +1,148 @@
+package executor
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/google/uuid"
+
+	"platform/functions/internal/runtimes"
+)
+
+// depsRepository is the local image repository dependency installs are
+// committed to, tagged with depsKey.
+const depsRepository = "platform-fn-deps"
+
+// depsKey identifies a dependency install by everything that affects its
+// result: the runtime's image and install step and the dependency file. The
+// owner is part of it too, so one tenant's functions never run on packages
+// another tenant's install scripts put there.
+func depsKey(owner string, rt *runtimes.Runtime, name string, depFile []byte) string {
+	d := rt.Dependencies
+	h := sha256.New()
+	write := func(parts ...string) {
+		for _, p := range parts {
+			h.Write([]byte(p))
+			h.Write([]byte{0})
+		}
+	}
+	write(owner)
+	write(rt.Image, d.Dir)
+	write(d.Command...)
+	write(d.Env...)
+	write(name)
+	h.Write(depFile)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// installDependencies returns an image of the runtime with the dependencies
+// of a bundle installed in Dependencies.Dir, installing them unless the
+// owner has an image for the same dependency file. When the install fails,
+// the error wraps ErrCompile.
+//
+// The install runs package scripts, so it gets the sandbox of any build
+// step, with network access added: a read-only root filesystem, and an
+// anonymous volume at Dependencies.Dir as the one place it can write. The
+// volume starts out as Dir of a staging image holding the dependency file.
+// Dir is then copied out of the volume into a container of the staging
+// image that never starts, which is committed as the image.
+func (dr *DockerRunner) installDependencies(ctx context.Context, req BuildRequest, rt *runtimes.Runtime, name string, depFile []byte, log io.Writer) (string, error) {
+	d := rt.Dependencies
+	owner := req.Function.Owner
+	image := depsRepository + ":" + depsKey(owner, rt, name, depFile)
+	if _, _, err := dr.cli.ImageInspectWithRaw(ctx, image); err == nil {
+		fmt.Fprintf(log, "--- dependency install: using %s\n", image)
+		return image, nil
+	}
+
+	if err := dr.ensureImage(ctx, rt.Image, log); err != nil {
+		return "", err
+	}
+	// the directory is created by the copy, owned by the sandbox user, so
+	// the install needs no root
+	dir := strings.TrimPrefix(path.Clean(d.Dir), "/")
+	archive, err := tarFiles(
+		containerFile{name: dir + "/", mode: 0o755},
+		containerFile{name: dir + "/" + path.Base(name), mode: 0o644, data: depFile},
+	)
+	if err != nil {
+		return "", err
+	}
+	staging, err := dr.commitFiles(ctx, &container.Config{Image: rt.Image}, "/", bytes.NewReader(archive), "")
+	if err != nil {
+		return "", err
+	}
+	// once committed, the image is the staging image's child and removing
+	// it prunes the staging image too
+	committed := false
+	defer func() {
+		if !committed {
+			dr.removeImage(context.Background(), staging)
+		}
+	}()
+
+	host := dr.stepSandbox().hostConfig(buildLimits, true)
+	host.Mounts = []mount.Mount{{Type: mount.TypeVolume, Target: d.Dir}}
+	err = dr.runStep(ctx, buildStep{
+		what: "dependency install",
+		config: &container.Config{
+			Image:      staging,
+			Entrypoint: runtimes.Command(d.Command, path.Base(name)),
+			WorkingDir: d.Dir,
+			Env:        append([]string{"HOME=/tmp", "TMPDIR=/tmp"}, d.Env...),
+			User:       sandboxUser,
+			Labels:     map[string]string{buildLabel: ImageTag(req.Function.ID, req.Function.Version)},
+		},
+		host:  host,
+		name:  fmt.Sprintf("fn-%s-deps-%s", rt.Name, uuid.New().String()[:8]),
+		local: true,
+		done: func(ctx context.Context, containerID string) error {
+			rc, _, err := dr.cli.CopyFromContainer(ctx, containerID, d.Dir)
+			if err != nil {
+				return fmt.Errorf("dependency copy error: %w", err)
+			}
+			defer rc.Close()
+			_, err = dr.commitFiles(ctx, &container.Config{
+				Image:  staging,
+				Labels: map[string]string{ownerLabel: owner},
+			}, path.Dir(d.Dir), rc, image)
+			if err != nil {
+				return err
+			}
+			committed = true
+			return nil
+		},
+	}, log)
+	if err != nil {
+		return "", err
+	}
+	return image, nil
+}
+
+// commitFiles extracts a tar into dir of a container of config that never
+// starts, and commits the container as an image tagged reference, or as an
+// untagged one if reference is empty. It returns the image's ID.
+func (dr *DockerRunner) commitFiles(ctx context.Context, config *container.Config, dir string, archive io.Reader, reference string) (string, error) {
+	resp, err := dr.cli.ContainerCreate(ctx, config, &container.HostConfig{}, nil, nil, "")
+	if err != nil {
+		return "", fmt.Errorf("container create error: %w", err)
+	}
+	defer dr.cli.ContainerRemove(context.Background(), resp.ID, container.RemoveOptions{Force: true, RemoveVolumes: true})
+
+	if err := dr.cli.CopyToContainer(ctx, resp.ID, dir, archive, container.CopyToContainerOptions{}); err != nil {
+		return "", fmt.Errorf("container copy error: %w", err)
+	}
+	committed, err := dr.cli.ContainerCommit(ctx, resp.ID, container.CommitOptions{Reference: reference})
+	if err != nil {
+		return "", fmt.Errorf("container commit error: %w", err)
+	}
+	return committed.ID, nil
+}
@@ -0,0 +1,22 @@
+package executor
+
+import (
+	"testing"
+
+	"platform/functions/internal/runtimes"
+)
+
+func TestDepsKeyPerOwner(t *testing.T) {
+	rt, ok := runtimes.Default().Lookup("python3.12")
+	if !ok {
+		t.Fatal("python3.12 is not in the default registry")
+	}
+	depFile := []byte("requests==2.32.3\n")
+	alice := depsKey("alice", rt, "requirements.txt", depFile)
+	if depsKey("alice", rt, "requirements.txt", depFile) != alice {
+		t.Error("the same install has different keys")
+	}
+	if depsKey("bob", rt, "requirements.txt", depFile) == alice {
+		t.Error("two owners share a dependency image")
+	}
+}
@@ -2,7 +2,12 @@ package executor
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log"
+	"slices"
+	"sync"
+	"time"
 
 	"platform/functions/internal/domain/function"
 	"platform/functions/internal/domain/job"
@@ -10,33 +15,68 @@ import (
 	"github.com/google/uuid"
 )
 
-type ExecRequest struct {
-	JobID      uuid.UUID
-	FunctionID uuid.UUID
-}
+// pollInterval is how often an idle worker checks the queue for jobs queued
+// by other replicas. Jobs queued by this replica wake a worker through Wake.
+const pollInterval = time.Second
+
+// buildWaitInterval is how long a job whose version is being built waits
+// in the queue before it is claimed again.
+const buildWaitInterval = 5 * time.Second
 
+// cancelCheckInterval is how often running jobs are checked for cancel
+// requests made through another replica.
+const cancelCheckInterval = time.Second
+
+// A worker holds a lease on each job it runs and renews it every
+// heartbeatInterval. A job whose lease runs out is taken over by the Reaper.
+const (
+	leaseDuration     = 30 * time.Second
+	heartbeatInterval = 10 * time.Second
+)
+
+// Executor runs jobs from the queue kept in the jobs table. Workers claim
+// queued rows with SELECT ... FOR UPDATE SKIP LOCKED, so any number of
+// replicas can share the queue and queued jobs survive restarts.
 type Executor struct {
+	workerID   string
 	jobRepo    job.Repository
 	funcRepo   function.Repository
+	builds     *Builder
 	runner     Runner
-	jobs       chan ExecRequest
+	limitCaps  function.Limits
+	wake       chan struct{}
 	quit       chan struct{}
 	numWorkers int
+
+	mu       sync.Mutex
+	watchers map[uuid.UUID][]chan struct{}
+	cancels  map[uuid.UUID]context.CancelFunc
 }
 
+// NewExecutor creates an executor whose workers claim jobs as workerID, which
+// must be unique per replica. Function limits above limitCaps are lowered to
+// the caps when a job runs.
 func NewExecutor(
+	workerID string,
 	jobRepo job.Repository,
 	funcRepo function.Repository,
+	builds *Builder,
 	runner Runner,
+	limitCaps function.Limits,
 	numWorkers int,
 ) *Executor {
 	return &Executor{
+		workerID:   workerID,
 		jobRepo:    jobRepo,
 		funcRepo:   funcRepo,
+		builds:     builds,
 		runner:     runner,
-		jobs:       make(chan ExecRequest),
+		limitCaps:  limitCaps,
+		wake:       make(chan struct{}, 1),
 		quit:       make(chan struct{}),
 		numWorkers: numWorkers,
+		watchers:   make(map[uuid.UUID][]chan struct{}),
+		cancels:    make(map[uuid.UUID]context.CancelFunc),
 	}
 }
 
@@ -44,65 +84,391 @@ func (e *Executor) Start() {
 	for i := 0; i < e.numWorkers; i++ {
 		go e.workerLoop(i)
 	}
+	go e.cancelLoop()
+	go e.heartbeatLoop()
 }
 
 func (e *Executor) Stop() {
 	close(e.quit)
 }
 
-func (e *Executor) Enqueue(req ExecRequest) {
-	e.jobs <- req
+// Wake tells an idle worker that a job was just queued, so it is picked up
+// without waiting for the next poll. It never blocks.
+func (e *Executor) Wake() {
+	select {
+	case e.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Watch returns a channel that is closed once this executor has finished
+// processing jobID. Jobs claimed by another replica never close it, so
+// callers must also poll the job. Call stop when no longer waiting.
+func (e *Executor) Watch(jobID uuid.UUID) (done <-chan struct{}, stop func()) {
+	ch := make(chan struct{})
+	e.mu.Lock()
+	e.watchers[jobID] = append(e.watchers[jobID], ch)
+	e.mu.Unlock()
+
+	return ch, func() {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		list := e.watchers[jobID]
+		for i, w := range list {
+			if w == ch {
+				list = append(list[:i], list[i+1:]...)
+				break
+			}
+		}
+		if len(list) == 0 {
+			delete(e.watchers, jobID)
+		} else {
+			e.watchers[jobID] = list
+		}
+	}
+}
+
+// Cancel stops a job this executor is processing by cancelling the context
+// passed to Runner.Run. It reports false if the job is not being processed
+// here.
+func (e *Executor) Cancel(jobID uuid.UUID) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	cancel, ok := e.cancels[jobID]
+	if ok {
+		cancel()
+	}
+	return ok
+}
+
+func (e *Executor) trackCancel(jobID uuid.UUID, cancel context.CancelFunc) func() {
+	e.mu.Lock()
+	e.cancels[jobID] = cancel
+	e.mu.Unlock()
+	return func() {
+		e.mu.Lock()
+		delete(e.cancels, jobID)
+		e.mu.Unlock()
+	}
+}
+
+func (e *Executor) notify(jobID uuid.UUID) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, ch := range e.watchers[jobID] {
+		close(ch)
+	}
+	delete(e.watchers, jobID)
 }
 
 func (e *Executor) workerLoop(workerID int) {
 	for {
 		select {
-		case req := <-e.jobs:
-			if err := e.processRequest(req); err != nil {
-				log.Printf("[worker %d] error processing request: %v\n", workerID, err)
+		case <-e.quit:
+			return
+		default:
+		}
+
+		j, err := e.jobRepo.Claim(context.Background(), e.workerID, leaseDuration)
+		if err == nil {
+			if err := e.processJob(j); err != nil {
+				log.Printf("[worker %d] error processing job %s: %v\n", workerID, j.ID, err)
 			}
+			e.notify(j.ID)
+			continue
+		}
+		if !errors.Is(err, job.ErrQueueEmpty) {
+			log.Printf("[worker %d] error claiming job: %v\n", workerID, err)
+		}
+
+		select {
+		case <-e.wake:
+		case <-time.After(pollInterval):
+		case <-e.quit:
+			return
+		}
+	}
+}
+
+// cancelLoop cancels running jobs whose cancellation was requested through
+// another replica, or whose rows were deleted with their owner.
+func (e *Executor) cancelLoop() {
+	ticker := time.NewTicker(cancelCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-e.quit:
+			return
+		}
+
+		ids := e.runningJobs()
+		if len(ids) == 0 {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		requested, err := e.jobRepo.CancelRequested(ctx, ids)
+		cancel()
+		if err != nil {
+			log.Printf("[executor] error checking cancel requests: %v\n", err)
+			continue
+		}
+		for _, id := range requested {
+			e.Cancel(id)
+		}
+	}
+}
+
+// heartbeatLoop renews the leases on running jobs. A job whose lease was
+// taken over by the Reaper, for example after this replica stalled, is
+// cancelled here since another worker may already be running it.
+func (e *Executor) heartbeatLoop() {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
 		case <-e.quit:
 			return
 		}
+
+		ids := e.runningJobs()
+		if len(ids) == 0 {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		held, err := e.jobRepo.Heartbeat(ctx, e.workerID, ids, leaseDuration)
+		cancel()
+		if err != nil {
+			log.Printf("[executor] heartbeat failed: %v\n", err)
+			continue
+		}
+		for _, id := range ids {
+			if !slices.Contains(held, id) {
+				log.Printf("[executor] lost lease on job %s, stopping it\n", id)
+				e.Cancel(id)
+			}
+		}
+	}
+}
+
+func (e *Executor) runningJobs() []uuid.UUID {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	ids := make([]uuid.UUID, 0, len(e.cancels))
+	for id := range e.cancels {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// processJob runs one attempt of a job that has been claimed and is marked
+// running. A failed attempt is retried according to the function's retry
+// policy.
+func (e *Executor) processJob(j *job.Job) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	defer e.trackCancel(j.ID, cancel)()
+
+	attempt := &job.Attempt{
+		JobID:     j.ID,
+		Attempt:   j.Attempts,
+		WorkerID:  e.workerID,
+		StartedAt: time.Now(),
+	}
+
+	fn, err := e.funcRepo.GetByID(ctx, j.FunctionID)
+	var v *function.Version
+	if err == nil {
+		// run the version the job was queued with, not the current head
+		v, err = e.funcRepo.GetVersion(ctx, j.FunctionID, j.FunctionVersion)
+		if err == nil {
+			fn = fn.AtVersion(v)
+		}
+	}
+	if err != nil {
+		if errors.Is(err, function.ErrNotFound) || errors.Is(err, function.ErrVersionNotFound) {
+			j.MarkError(err.Error())
+			return e.finishAttempt(j, attempt, "")
+		}
+		// the function could not be loaded, so fall back to the default policy
+		e.failAttempt(j, attempt, function.DefaultRetryPolicy(), function.ErrorInfrastructure, err.Error())
+		return e.finishAttempt(j, attempt, function.ErrorInfrastructure)
+	}
+	switch v.BuildStatus {
+	case function.BuildPending, function.BuildBuilding:
+		// the version is being built for the first time, or rebuilt after
+		// its image went missing
+		return e.deferJob(j)
+	case function.BuildFailed:
+		// builds that failed before classes were kept failed on the code
+		class := v.BuildErrorClass
+		if class == "" {
+			class = function.ErrorCompile
+		}
+		e.failAttempt(j, attempt, fn.RetryPolicy, class, fmt.Sprintf("version %d failed to build: %s", v.Version, v.BuildError))
+		return e.finishAttempt(j, attempt, class)
+	}
+
+	fn.Limits = fn.Limits.Clamp(e.limitCaps)
+	runCtx, cancelRun := context.WithTimeout(ctx, fn.Timeout())
+	defer cancelRun()
+	result, runErr := e.runner.Run(runCtx, RunRequest{
+		JobID:    j.ID,
+		Function: fn,
+		Image:    v.Image,
+		Input:    j.Input,
+	})
+	if errors.Is(runErr, ErrImageNotFound) {
+		// nothing ran, so the job waits for the rebuild without using up
+		// an attempt
+		e.requeueBuild(v)
+		return e.deferJob(j)
+	}
+
+	if result != nil {
+		exec := job.Execution{
+			Stdout:       result.Stdout,
+			Stderr:       result.Stderr,
+			Truncated:    result.Truncated,
+			StartKind:    result.StartKind,
+			StartLatency: result.StartLatency,
+			StartedAt:    result.StartedAt,
+			FinishedAt:   result.FinishedAt,
+			Output:       result.Output,
+		}
+		if runErr == nil || errors.Is(runErr, ErrOutOfMemory) {
+			exec.ExitCode = &result.ExitCode
+			attempt.ExitCode = &result.ExitCode
+		}
+		j.RecordExecution(exec)
+	}
+
+	var class string
+	switch {
+	case errors.Is(ctx.Err(), context.Canceled):
+		j.MarkCancelled()
+		runErr = nil
+	case errors.Is(runErr, context.DeadlineExceeded):
+		class = function.ErrorTimeout
+		e.failAttempt(j, attempt, fn.RetryPolicy, class, fmt.Sprintf("job timed out after %s", fn.Timeout()))
+	case errors.Is(runErr, ErrOutOfMemory):
+		class = function.ErrorOutOfMemory
+		e.failAttempt(j, attempt, fn.RetryPolicy, class, runErr.Error())
+	case errors.Is(runErr, ErrInvalidResult):
+		class = function.ErrorUserCode
+		e.failAttempt(j, attempt, fn.RetryPolicy, class, runErr.Error())
+	case runErr != nil:
+		class = function.ErrorInfrastructure
+		e.failAttempt(j, attempt, fn.RetryPolicy, class, runErr.Error())
+	case result.ExitCode != 0:
+		class = function.ErrorUserCode
+		e.failAttempt(j, attempt, fn.RetryPolicy, class, fmt.Sprintf("function exited with code %d", result.ExitCode))
+	default:
+		j.MarkDone()
+	}
+	if err := e.finishAttempt(j, attempt, class); err != nil {
+		return err
 	}
+	if j.Status == job.StatusDeadLettered {
+		e.routeFailure(fn, j)
+	}
+	return runErr
 }
 
-func (e *Executor) processRequest(req ExecRequest) error {
-    ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-    defer cancel()
+// requeueBuild queues a build of a version whose image went missing.
+func (e *Executor) requeueBuild(v *function.Version) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
 
-    j, err := e.jobRepo.GetByID(ctx, req.JobID)
-    if err != nil {
-        return err
-    }
+	if _, err := e.funcRepo.RequeueBuild(ctx, v.FunctionID, v.Version); err != nil {
+		log.Printf("[executor] error requeueing the build of %s version %d: %v\n", v.FunctionID, v.Version, err)
+		return
+	}
+	e.builds.Wake()
+}
 
-    j.MarkRunning()
-    if err := e.jobRepo.Update(ctx, j); err != nil {
-        return err
-    }
+// deferJob puts a job whose version is not built yet back in the queue, to
+// be claimed again after buildWaitInterval.
+func (e *Executor) deferJob(j *job.Job) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
 
-    fn, err := e.funcRepo.GetByID(ctx, req.FunctionID)
-    if err != nil {
-        j.MarkError("function not found")
-        _ = e.jobRepo.Update(ctx, j)
-        return err
-    }
+	held, err := e.jobRepo.Defer(ctx, j.ID, e.workerID, time.Now().Add(buildWaitInterval))
+	if err != nil {
+		return err
+	}
+	if !held {
+		return fmt.Errorf("lease on job %s was lost before it was deferred", j.ID)
+	}
+	return nil
+}
 
-    result, runErr := e.runner.Run(ctx, fn)
-    if runErr != nil {
-        if ctx.Err() == context.DeadlineExceeded {
-            j.MarkError("job timed out after 30 seconds")
-        } else {
-            j.MarkError(runErr.Error())
-        }
-        _ = e.jobRepo.Update(ctx, j)
-        return runErr
-    }
+// failAttempt schedules another attempt if the policy retries failures of
+// this class. A retryable failure that used up its attempts dead-letters the
+// job; any other failure marks it as an error.
+func (e *Executor) failAttempt(j *job.Job, attempt *job.Attempt, policy function.RetryPolicy, class, errMsg string) {
+	n := j.CurrentAttempt()
+	switch {
+	case policy.ShouldRetry(class, n):
+		j.ScheduleRetry(errMsg, time.Now().Add(policy.Backoff(n)))
+	case policy.RetriesOn(class):
+		j.MarkDeadLettered(errMsg, class)
+	default:
+		j.MarkError(errMsg)
+	}
+}
 
-    j.MarkDone(result)
-    if err := e.jobRepo.Update(ctx, j); err != nil {
-        return err
-    }
+// routeFailure hands a dead-lettered job to its function's failure
+// destination, if it has one.
+func (e *Executor) routeFailure(fn *function.Function, j *job.Job) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
 
-    return nil
-}
\ No newline at end of file
+	delivery, err := routeFailure(ctx, e.jobRepo, e.funcRepo, fn, j)
+	if err != nil {
+		log.Printf("[executor] error routing dead-lettered job %s to its failure destination: %v\n", j.ID, err)
+		return
+	}
+	if delivery != nil {
+		e.Wake()
+	}
+}
+
+// finishAttempt records the attempt in the job's history and saves the job.
+func (e *Executor) finishAttempt(j *job.Job, attempt *job.Attempt, class string) error {
+	// the run may have used up its context, so saving gets its own deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	attempt.FinishedAt = time.Now()
+	attempt.ErrorClass = class
+	attempt.Status = j.Status
+	if j.Status != job.StatusDone && j.Status != job.StatusCancelled {
+		// failed, whether or not the job is queued for another attempt
+		attempt.Status = job.StatusError
+		attempt.Error = j.Result
+	}
+	if err := e.saveFinished(ctx, j); err != nil {
+		return err
+	}
+	if err := e.jobRepo.RecordAttempt(ctx, attempt); err != nil {
+		log.Printf("[executor] error recording attempt %d of job %s: %v\n", attempt.Attempt, j.ID, err)
+	}
+	return nil
+}
+
+// saveFinished stores the outcome of an attempt and releases the job's
+// lease. The save is skipped if the lease was lost, since the job now
+// belongs to whoever took it over.
+func (e *Executor) saveFinished(ctx context.Context, j *job.Job) error {
+	j.Release()
+	saved, err := e.jobRepo.UpdateClaimed(ctx, j, e.workerID)
+	if err != nil {
+		return err
+	}
+	if !saved {
+		return fmt.Errorf("lease on job %s was lost, result discarded", j.ID)
+	}
+	return nil
+}
@@ -0,0 +1,310 @@
+package executor
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/distribution/reference"
+	imageTypes "github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/registry"
+	"github.com/docker/docker/errdefs"
+	"github.com/docker/docker/pkg/jsonmessage"
+)
+
+// imagePullTimeout bounds a single image pull. Pulls never run under a
+// job's or build step's deadline, so a large first pull does not eat into
+// either.
+const imagePullTimeout = 10 * time.Minute
+
+// ErrImagePull is wrapped by the error returned when an image the runner
+// needs could not be pulled, or is missing and the pull policy forbids
+// pulling it.
+var ErrImagePull = errors.New("image pull failed")
+
+// PullPolicy decides when the runner pulls the images of runtimes and
+// build steps.
+type PullPolicy string
+
+const (
+	// PullAlways pulls an image every time a container is created from it,
+	// picking up a tag that moved in the registry.
+	PullAlways PullPolicy = "always"
+	// PullIfNotPresent pulls an image only if the Docker host lacks it.
+	PullIfNotPresent PullPolicy = "if-not-present"
+	// PullNever uses the images on the Docker host; a missing one is an
+	// error.
+	PullNever PullPolicy = "never"
+)
+
+// ParsePullPolicy checks the name of a pull policy.
+func ParsePullPolicy(s string) (PullPolicy, error) {
+	switch p := PullPolicy(s); p {
+	case PullAlways, PullIfNotPresent, PullNever:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown pull policy %q, expected always, if-not-present or never", s)
+}
+
+// ImagePolicy is how the runner gets images from registries.
+type ImagePolicy struct {
+	Pull PullPolicy
+	// Auth holds the credentials of private registries.
+	Auth RegistryAuth
+}
+
+// DefaultImagePolicy pulls missing images anonymously.
+func DefaultImagePolicy() ImagePolicy {
+	return ImagePolicy{Pull: PullIfNotPresent}
+}
+
+// RegistryAuth maps a registry host, such as "ghcr.io" or "docker.io", to
+// its credentials.
+type RegistryAuth map[string]registry.AuthConfig
+
+// LoadRegistryAuth reads the "auths" of a Docker client config file, as
+// written by docker login. Credential helpers are not supported: a file
+// that names any fails to load rather than pulling anonymously from the
+// registries whose credentials the helpers hold.
+func LoadRegistryAuth(path string) (RegistryAuth, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Auths       map[string]registry.AuthConfig `json:"auths"`
+		CredsStore  string                         `json:"credsStore"`
+		CredHelpers map[string]string              `json:"credHelpers"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if file.CredsStore != "" || len(file.CredHelpers) > 0 {
+		return nil, fmt.Errorf("%s: credential helpers (credsStore, credHelpers) are not supported, the credentials must be in auths", path)
+	}
+
+	auth := make(RegistryAuth)
+	for server, cfg := range file.Auths {
+		// docker login stores the username and password as one field
+		if cfg.Auth != "" && cfg.Username == "" {
+			decoded, err := base64.StdEncoding.DecodeString(cfg.Auth)
+			if err != nil {
+				return nil, fmt.Errorf("%s: invalid auth of %s", path, server)
+			}
+			user, password, ok := strings.Cut(string(decoded), ":")
+			if !ok {
+				return nil, fmt.Errorf("%s: invalid auth of %s", path, server)
+			}
+			cfg.Username, cfg.Password = user, password
+		}
+		cfg.Auth = ""
+		cfg.ServerAddress = server
+		auth[registryHost(server)] = cfg
+	}
+	return auth, nil
+}
+
+// registryHost reduces a server address of a Docker config file to the host
+// that reference.Domain returns for images on it.
+func registryHost(server string) string {
+	host := strings.TrimPrefix(strings.TrimPrefix(server, "https://"), "http://")
+	host, _, _ = strings.Cut(host, "/")
+	switch host {
+	case "index.docker.io", "registry-1.docker.io":
+		return "docker.io"
+	}
+	return host
+}
+
+// encoded returns the credentials for the registry of image in the form
+// the Docker API takes, or "" to pull anonymously.
+func (a RegistryAuth) encoded(image string) (string, error) {
+	if len(a) == 0 {
+		return "", nil
+	}
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return "", err
+	}
+	cfg, ok := a[reference.Domain(named)]
+	if !ok {
+		return "", nil
+	}
+	return registry.EncodeAuthConfig(cfg)
+}
+
+// imagePuller shares pulls of the same image, so the pre-pull, the warm
+// pool and builds that need an image at once cause one pull.
+type imagePuller struct {
+	mu       sync.Mutex
+	inflight map[string]*pull
+}
+
+// pull is one pull in flight. Its progress goes to the writers of the
+// callers waiting on it; each caller attaches its writer while it waits
+// and detaches it when it returns, so the pull never writes to the writer
+// of a caller that left.
+type pull struct {
+	done chan struct{}
+	err  error
+
+	mu      sync.Mutex
+	writers map[*io.Writer]bool
+}
+
+// attach adds w to the writers of the pull's progress until detach is
+// called. A nil w is ignored.
+func (p *pull) attach(w io.Writer) (detach func()) {
+	if w == nil {
+		return func() {}
+	}
+	key := &w
+	p.mu.Lock()
+	p.writers[key] = true
+	p.mu.Unlock()
+	return func() {
+		p.mu.Lock()
+		delete(p.writers, key)
+		p.mu.Unlock()
+	}
+}
+
+// printf writes a line of progress to every attached writer.
+func (p *pull) printf(format string, args ...any) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for w := range p.writers {
+		fmt.Fprintf(*w, format, args...)
+	}
+}
+
+// ensureImage makes image available on the Docker host as the pull policy
+// requires. Pull progress is logged and, if progress is not nil, written to
+// it as well. The error wraps ErrImagePull if the image is not available.
+func (dr *DockerRunner) ensureImage(ctx context.Context, image string, progress io.Writer) error {
+	if dr.images.Pull != PullAlways {
+		_, _, err := dr.cli.ImageInspectWithRaw(ctx, image)
+		if err == nil {
+			return nil
+		}
+		if !errdefs.IsNotFound(err) {
+			return fmt.Errorf("image inspect error: %w", err)
+		}
+		if dr.images.Pull == PullNever {
+			return fmt.Errorf("%w: %s is not on the Docker host and the pull policy is never", ErrImagePull, image)
+		}
+	}
+
+	dr.puller.mu.Lock()
+	p, ok := dr.puller.inflight[image]
+	if ok && progress != nil {
+		fmt.Fprintf(progress, "--- waiting for the pull of %s\n", image)
+	}
+	if !ok {
+		p = &pull{done: make(chan struct{}), writers: make(map[*io.Writer]bool)}
+		dr.puller.inflight[image] = p
+	}
+	// attached before the pull starts, so no progress is missed
+	detach := p.attach(progress)
+	defer detach()
+	if !ok {
+		go func() {
+			p.err = dr.pullImage(image, p)
+			dr.puller.mu.Lock()
+			delete(dr.puller.inflight, image)
+			dr.puller.mu.Unlock()
+			close(p.done)
+		}()
+	}
+	dr.puller.mu.Unlock()
+
+	select {
+	case <-p.done:
+		return p.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// pullImage pulls an image under its own deadline, since other callers may
+// be waiting on it, and writes its progress to p.
+func (dr *DockerRunner) pullImage(image string, p *pull) error {
+	ctx, cancel := context.WithTimeout(context.Background(), imagePullTimeout)
+	defer cancel()
+
+	auth, err := dr.images.Auth.encoded(image)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrImagePull, image, err)
+	}
+	started := time.Now()
+	log.Printf("[images] pulling %s\n", image)
+	p.printf("--- pulling %s\n", image)
+
+	rc, err := dr.cli.ImagePull(ctx, image, imageTypes.PullOptions{RegistryAuth: auth})
+	if err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrImagePull, image, err)
+	}
+	defer rc.Close()
+
+	// the pull only fails for good once the stream reports an error
+	dec := json.NewDecoder(rc)
+	for {
+		var msg jsonmessage.JSONMessage
+		if err := dec.Decode(&msg); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return fmt.Errorf("%w: %s: %v", ErrImagePull, image, err)
+		}
+		if msg.Error != nil {
+			return fmt.Errorf("%w: %s: %s", ErrImagePull, image, msg.Error.Message)
+		}
+		// skip the byte counts of layers in flight
+		if msg.Progress != nil || msg.Status == "" {
+			continue
+		}
+		line := msg.Status
+		if msg.ID != "" {
+			line = msg.ID + ": " + line
+		}
+		log.Printf("[images] %s: %s\n", image, line)
+		p.printf("%s\n", line)
+	}
+	log.Printf("[images] pulled %s in %s\n", image, time.Since(started).Round(time.Millisecond))
+	return nil
+}
+
+// PrepullImages makes the images of every runtime and build step available
+// ahead of the first build or warm container that needs them. Failures are
+// logged; builds needing a missing image try again and fail with
+// ErrImagePull. It runs at startup and again whenever the registry is
+// reloaded with changes.
+func (dr *DockerRunner) PrepullImages(ctx context.Context) {
+	seen := make(map[string]bool)
+	for _, rt := range dr.runtimes.List() {
+		images := []string{rt.Image}
+		if rt.Build != nil {
+			images = append(images, rt.Build.Image)
+		}
+		for _, image := range images {
+			if seen[image] {
+				continue
+			}
+			seen[image] = true
+			if err := dr.ensureImage(ctx, image, nil); err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				log.Printf("[images] pre-pull of %s for runtime %s failed: %v\n", image, rt.Name, err)
+			}
+		}
+	}
+}
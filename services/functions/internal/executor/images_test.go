@@ -0,0 +1,61 @@
+package executor
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadRegistryAuth(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.json")
+	// "dXNlcjpzZWNyZXQ=" is user:secret
+	err := os.WriteFile(path, []byte(`{"auths": {"https://index.docker.io/v1/": {"auth": "dXNlcjpzZWNyZXQ="}}}`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth, err := LoadRegistryAuth(path)
+	if err != nil {
+		t.Fatalf("LoadRegistryAuth: %v", err)
+	}
+	cfg, ok := auth["docker.io"]
+	if !ok || cfg.Username != "user" || cfg.Password != "secret" {
+		t.Errorf("docker.io credentials = %+v, %v", cfg, ok)
+	}
+
+	for name, config := range map[string]string{
+		"credsStore":  `{"auths": {"ghcr.io": {}}, "credsStore": "desktop"}`,
+		"credHelpers": `{"credHelpers": {"123456789012.dkr.ecr.us-east-1.amazonaws.com": "ecr-login"}}`,
+	} {
+		path := filepath.Join(dir, name+".json")
+		if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadRegistryAuth(path); err == nil || !strings.Contains(err.Error(), "credential helpers") {
+			t.Errorf("LoadRegistryAuth with %s: %v, want an error about credential helpers", name, err)
+		}
+	}
+}
+
+func TestPullProgressDetach(t *testing.T) {
+	p := &pull{done: make(chan struct{}), writers: make(map[*io.Writer]bool)}
+	var first, second strings.Builder
+	detachFirst := p.attach(&first)
+	detachSecond := p.attach(&second)
+	p.attach(nil)()
+
+	p.printf("--- pulling %s\n", "alpine")
+	detachFirst()
+	p.printf("%s\n", "Pull complete")
+	detachSecond()
+	p.printf("%s\n", "Status: Downloaded newer image")
+
+	if got, want := first.String(), "--- pulling alpine\n"; got != want {
+		t.Errorf("first writer got %q, want %q", got, want)
+	}
+	if got, want := second.String(), "--- pulling alpine\nPull complete\n"; got != want {
+		t.Errorf("second writer got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,378 @@
+package executor
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/google/uuid"
+
+	"platform/functions/internal/domain/function"
+	"platform/functions/internal/runtimes"
+)
+
+// poolLabel marks warm containers with the host of the replica that started
+// them, so a replica restarted on the same host removes the containers it
+// left behind at once. The Reaper removes those of any other replica, see
+// warmMaxAge and warmJob.
+const poolLabel = "platform.pool"
+
+// warmMaxAge is how long a container stays in the pool, even below MinIdle,
+// before it is replaced. An idle warm container much older than that was
+// left behind by a replica that died, and the Reaper removes it.
+const warmMaxAge = 10 * time.Minute
+
+// poolCheckInterval is how often pools are topped up and trimmed.
+const poolCheckInterval = time.Second
+
+// poolRetryDelay pauses a pool after it failed to start a container, so an
+// image that cannot be pulled is not retried in a tight loop.
+const poolRetryDelay = 30 * time.Second
+
+// PoolConfig sizes the warm pool of one runtime, see runtimes.Pool.
+type PoolConfig struct {
+	MinIdle int
+	MaxIdle int
+	IdleTTL time.Duration
+}
+
+// warmPool keeps pre-started containers of each runtime. A warm container
+// runs the agent on the runtime's image and waits for a job to hand it the
+// function's files; each one runs a single job and is removed with it, like
+// any other function container. Only functions without network access run
+// on the runtime's own image, so only those start warm.
+//
+// Pools are made for the runtimes in the registry at startup and sized
+// then. When the registry is reloaded, a pool starts containers of its
+// runtime's new image and removes those of the old one, and stops if its
+// runtime is gone; runtimes added by a reload start cold until the service
+// restarts.
+type warmPool struct {
+	dr    *DockerRunner
+	host  string
+	pools map[string]*runtimePool // runtime name -> pool
+	quit  chan struct{}
+	wg    sync.WaitGroup
+}
+
+type runtimePool struct {
+	name string
+	cfg  PoolConfig
+
+	mu       sync.Mutex
+	idle     []warmContainer
+	starting int
+	// target is how many idle containers to keep. It grows by one, up to
+	// MaxIdle, on every job that finds the pool empty and shrinks back to
+	// MinIdle as containers expire unused.
+	target      int
+	lastFailure time.Time
+	kick        chan struct{}
+}
+
+type warmContainer struct {
+	id      string
+	image   string
+	readyAt time.Time
+}
+
+// StartWarmPool starts keeping warm containers of every runtime, sized by
+// defaults unless the runtime sets its own pool. Containers left behind by
+// an earlier run on this host are removed first. InstallAgent must have
+// been called.
+func (dr *DockerRunner) StartWarmPool(defaults PoolConfig) {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "functionservice"
+	}
+	p := &warmPool{
+		dr:    dr,
+		host:  host,
+		pools: make(map[string]*runtimePool),
+		quit:  make(chan struct{}),
+	}
+	p.removeLeftovers()
+
+	rts := dr.runtimes.List()
+	for i := range rts {
+		rt := &rts[i]
+		cfg := defaults
+		if rt.Pool != nil {
+			cfg = PoolConfig{
+				MinIdle: rt.Pool.MinIdle,
+				MaxIdle: rt.Pool.MaxIdle,
+				IdleTTL: time.Duration(rt.Pool.IdleTTLSeconds) * time.Second,
+			}
+		}
+		if cfg.MaxIdle == 0 {
+			continue
+		}
+		rp := &runtimePool{name: rt.Name, cfg: cfg, target: cfg.MinIdle, kick: make(chan struct{}, 1)}
+		p.pools[rt.Name] = rp
+		p.wg.Add(1)
+		go p.maintain(rp)
+	}
+
+	dr.mu.Lock()
+	dr.pool = p
+	dr.mu.Unlock()
+}
+
+// StopWarmPool stops refilling the pools and removes the idle containers.
+func (dr *DockerRunner) StopWarmPool() {
+	dr.mu.Lock()
+	p := dr.pool
+	dr.pool = nil
+	dr.mu.Unlock()
+	if p == nil {
+		return
+	}
+	close(p.quit)
+	p.wg.Wait()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	for _, rp := range p.pools {
+		rp.mu.Lock()
+		idle := rp.idle
+		rp.idle = nil
+		rp.mu.Unlock()
+		for _, wc := range idle {
+			_ = dr.RemoveContainer(ctx, wc.id)
+		}
+	}
+}
+
+// takeWarm hands out an idle container of a runtime started from image, or
+// reports false if there is none.
+func (dr *DockerRunner) takeWarm(runtime, image string) (warmContainer, bool) {
+	dr.mu.Lock()
+	p := dr.pool
+	dr.mu.Unlock()
+	if p == nil {
+		return warmContainer{}, false
+	}
+	rp, ok := p.pools[runtime]
+	if !ok {
+		return warmContainer{}, false
+	}
+	return rp.take(image)
+}
+
+func (rp *runtimePool) take(image string) (warmContainer, bool) {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	defer rp.wake()
+
+	// the newest container is the least likely to expire; containers of
+	// an image the runtime no longer uses are left for expire
+	for i := len(rp.idle) - 1; i >= 0; i-- {
+		if wc := rp.idle[i]; wc.image == image {
+			rp.idle = append(rp.idle[:i], rp.idle[i+1:]...)
+			return wc, true
+		}
+	}
+	if rp.target < rp.cfg.MaxIdle {
+		rp.target++
+	}
+	return warmContainer{}, false
+}
+
+// runtime returns the pool's runtime as the registry has it now, or false
+// if a reload removed it.
+func (p *warmPool) runtime(rp *runtimePool) (*runtimes.Runtime, bool) {
+	rt, ok := p.dr.runtimes.Lookup(rp.name)
+	if !ok || rt.Name != rp.name {
+		return nil, false
+	}
+	return rt, true
+}
+
+func (rp *runtimePool) wake() {
+	select {
+	case rp.kick <- struct{}{}:
+	default:
+	}
+}
+
+func (p *warmPool) maintain(rp *runtimePool) {
+	defer p.wg.Done()
+	ticker := time.NewTicker(poolCheckInterval)
+	defer ticker.Stop()
+	for {
+		p.expire(rp)
+		p.fill(rp)
+		select {
+		case <-ticker.C:
+		case <-rp.kick:
+		case <-p.quit:
+			return
+		}
+	}
+}
+
+// expire removes containers above MinIdle that sat idle past the TTL, and
+// any that reached warmMaxAge or are of an image the runtime no longer
+// uses, which fill then replaces.
+func (p *warmPool) expire(rp *runtimePool) {
+	image := ""
+	if rt, ok := p.runtime(rp); ok {
+		image = rt.Image
+	}
+
+	rp.mu.Lock()
+	var expired []warmContainer
+	current := rp.idle[:0]
+	for _, wc := range rp.idle {
+		if wc.image == image {
+			current = append(current, wc)
+		} else {
+			expired = append(expired, wc)
+		}
+	}
+	rp.idle = current
+	// idle is oldest first
+	for len(rp.idle) > rp.cfg.MinIdle && time.Since(rp.idle[0].readyAt) > rp.cfg.IdleTTL {
+		expired = append(expired, rp.idle[0])
+		rp.idle = rp.idle[1:]
+		if rp.target > rp.cfg.MinIdle {
+			rp.target--
+		}
+	}
+	for len(rp.idle) > 0 && time.Since(rp.idle[0].readyAt) > warmMaxAge {
+		expired = append(expired, rp.idle[0])
+		rp.idle = rp.idle[1:]
+	}
+	rp.mu.Unlock()
+
+	for _, wc := range expired {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		if err := p.dr.RemoveContainer(ctx, wc.id); err != nil {
+			log.Printf("[pool] %v\n", err)
+		}
+		cancel()
+	}
+}
+
+// fill starts containers until the pool reaches its target.
+func (p *warmPool) fill(rp *runtimePool) {
+	rt, ok := p.runtime(rp)
+	if !ok {
+		return
+	}
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	if time.Since(rp.lastFailure) < poolRetryDelay {
+		return
+	}
+	for len(rp.idle)+rp.starting < rp.target {
+		rp.starting++
+		go p.startContainer(rp, rt)
+	}
+}
+
+func (p *warmPool) startContainer(rp *runtimePool, rt *runtimes.Runtime) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	id, err := p.create(ctx, rt)
+
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	rp.starting--
+	if err != nil {
+		rp.lastFailure = time.Now()
+		log.Printf("[pool] error starting a %s container: %v\n", rt.Name, err)
+		return
+	}
+	select {
+	case <-p.quit:
+		// the pool stopped while the container started
+		go p.dr.RemoveContainer(context.Background(), id)
+		return
+	default:
+	}
+	rp.idle = append(rp.idle, warmContainer{id: id, image: rt.Image, readyAt: time.Now()})
+}
+
+// create starts a container of the runtime's image running the agent. It
+// has the sandbox of any function container, with default limits until a
+// job takes it.
+func (p *warmPool) create(ctx context.Context, rt *runtimes.Runtime) (string, error) {
+	dr := p.dr
+	if err := dr.ensureImage(ctx, rt.Image, nil); err != nil {
+		return "", err
+	}
+
+	containerCfg := &container.Config{
+		Image:       rt.Image,
+		Entrypoint:  []string{agentPath},
+		WorkingDir:  resultDir,
+		Env:         []string{"RESULT_PATH=" + resultPath, "HOME=/tmp", "TMPDIR=/tmp"},
+		User:        sandboxUser,
+		Labels:      map[string]string{poolLabel: p.host},
+		AttachStdin: true,
+		OpenStdin:   true,
+		StdinOnce:   true,
+	}
+	hostCfg := dr.sandbox.functionHostConfig(function.DefaultLimits(), false, dr.agentVolume)
+	name := fmt.Sprintf("fn-%s-warm-%s", rt.Name, uuid.New().String()[:8])
+	resp, err := dr.cli.ContainerCreate(ctx, containerCfg, hostCfg, nil, nil, name)
+	if err != nil {
+		return "", fmt.Errorf("container create error: %w", err)
+	}
+
+	if err := dr.cli.ContainerStart(ctx, resp.ID, container.StartOptions{}); err != nil {
+		_ = dr.RemoveContainer(context.Background(), resp.ID)
+		return "", fmt.Errorf("container start error: %w", err)
+	}
+	return resp.ID, nil
+}
+
+// RemoveIdleWarmContainers removes the warm containers created before
+// before that never took a job. It returns how many it removed.
+func (dr *DockerRunner) RemoveIdleWarmContainers(ctx context.Context, before time.Time) (int, error) {
+	list, err := dr.cli.ContainerList(ctx, container.ListOptions{
+		All:     true,
+		Filters: filters.NewArgs(filters.Arg("label", poolLabel)),
+	})
+	if err != nil {
+		return 0, fmt.Errorf("container list error: %w", err)
+	}
+	removed := 0
+	for _, c := range list {
+		if _, claimed := warmJob(c.Names); claimed || !time.Unix(c.Created, 0).Before(before) {
+			continue
+		}
+		if err := dr.RemoveContainer(ctx, c.ID); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// removeLeftovers removes warm containers an earlier run on this host left
+// behind, idle or not.
+func (p *warmPool) removeLeftovers() {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	list, err := p.dr.cli.ContainerList(ctx, container.ListOptions{
+		All:     true,
+		Filters: filters.NewArgs(filters.Arg("label", poolLabel+"="+p.host)),
+	})
+	if err != nil {
+		log.Printf("[pool] container list error: %v\n", err)
+		return
+	}
+	for _, c := range list {
+		if err := p.dr.RemoveContainer(ctx, c.ID); err != nil {
+			log.Printf("[pool] %v\n", err)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package executor
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+
+	"platform/functions/internal/domain/function"
+	"platform/functions/internal/domain/job"
+)
+
+// ContainerJanitor finds and removes function containers.
+type ContainerJanitor interface {
+	// JobContainers returns the function containers, keyed by container
+	// ID, with the job each one runs.
+	JobContainers(ctx context.Context) (map[string]uuid.UUID, error)
+	RemoveContainer(ctx context.Context, containerID string) error
+	// RemoveBuildContainers removes the build step containers created
+	// before before.
+	RemoveBuildContainers(ctx context.Context, before time.Time) (int, error)
+	// RemoveIdleWarmContainers removes the warm containers created before
+	// before that never took a job.
+	RemoveIdleWarmContainers(ctx context.Context, before time.Time) (int, error)
+}
+
+// OrphanPolicy decides what happens to a job whose worker stopped
+// heartbeating.
+type OrphanPolicy struct {
+	// Requeue puts orphaned jobs back in the queue; otherwise they fail.
+	Requeue bool
+	// MaxRequeues bounds how often one job is requeued before it fails, so
+	// a job that crashes its worker cannot do so forever.
+	MaxRequeues int
+}
+
+// Reaper recovers jobs whose lease expired because their worker died or
+// stalled, and removes function containers that no live job or warm pool
+// owns and build containers that no live build does.
+type Reaper struct {
+	jobRepo    job.Repository
+	funcRepo   function.Repository
+	containers ContainerJanitor
+	policy     OrphanPolicy
+	interval   time.Duration
+	quit       chan struct{}
+}
+
+func NewReaper(
+	jobRepo job.Repository,
+	funcRepo function.Repository,
+	containers ContainerJanitor,
+	policy OrphanPolicy,
+	interval time.Duration,
+) *Reaper {
+	return &Reaper{
+		jobRepo:    jobRepo,
+		funcRepo:   funcRepo,
+		containers: containers,
+		policy:     policy,
+		interval:   interval,
+		quit:       make(chan struct{}),
+	}
+}
+
+func (r *Reaper) Start() {
+	go r.loop()
+}
+
+func (r *Reaper) Stop() {
+	close(r.quit)
+}
+
+func (r *Reaper) loop() {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-r.quit:
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), r.interval)
+		r.reap(ctx)
+		cancel()
+	}
+}
+
+func (r *Reaper) reap(ctx context.Context) {
+	containers, err := r.containers.JobContainers(ctx)
+	if err != nil {
+		log.Printf("[reaper] %v\n", err)
+		return
+	}
+
+	now := time.Now()
+	expired, err := r.jobRepo.ExpiredLeases(ctx, now)
+	if err != nil {
+		log.Printf("[reaper] error listing expired leases: %v\n", err)
+		return
+	}
+	for i := range expired {
+		r.recoverJob(ctx, &expired[i], now)
+	}
+
+	// whatever is left is a container whose job is no longer running under
+	// a live lease, e.g. one a worker died before removing
+	for containerID, jobID := range containers {
+		j, err := r.jobRepo.GetByID(ctx, jobID)
+		if err != nil && err != job.ErrNotFound {
+			log.Printf("[reaper] error loading job %s: %v\n", jobID, err)
+			continue
+		}
+		if err == nil && j.Status == job.StatusRunning && j.LeaseExpiresAt != nil && j.LeaseExpiresAt.After(now) {
+			continue
+		}
+		if err := r.containers.RemoveContainer(ctx, containerID); err != nil {
+			log.Printf("[reaper] %v\n", err)
+			continue
+		}
+		log.Printf("[reaper] removed leftover container %.12s of job %s\n", containerID, jobID)
+	}
+
+	// a build running for longer than buildStaleAfter is taken over by
+	// another builder, so its containers are leftovers too
+	n, err := r.containers.RemoveBuildContainers(ctx, now.Add(-buildStaleAfter))
+	if err != nil {
+		log.Printf("[reaper] %v\n", err)
+	} else if n > 0 {
+		log.Printf("[reaper] removed %d leftover build containers\n", n)
+	}
+	// live pools replace their containers at warmMaxAge
+	n, err = r.containers.RemoveIdleWarmContainers(ctx, now.Add(-2*warmMaxAge))
+	if err != nil {
+		log.Printf("[reaper] %v\n", err)
+	} else if n > 0 {
+		log.Printf("[reaper] removed %d leftover warm containers\n", n)
+	}
+}
+
+// errWorkerLost is the error of an attempt whose worker stopped
+// heartbeating.
+const errWorkerLost = "worker stopped responding while running the job"
+
+// recoverJob requeues or dead-letters a job whose lease expired.
+func (r *Reaper) recoverJob(ctx context.Context, j *job.Job, now time.Time) {
+	worker := j.WorkerID
+	// heartbeats leave updated_at alone, so it is still the time of the claim
+	attempt := &job.Attempt{
+		JobID:     j.ID,
+		Attempt:   j.Attempts,
+		WorkerID:  worker,
+		StartedAt: j.UpdatedAt,
+	}
+	switch {
+	case j.CancelRequested:
+		j.MarkCancelled()
+		j.Release()
+	case r.policy.Requeue && j.Recoveries < r.policy.MaxRequeues:
+		j.Requeue()
+	default:
+		j.MarkDeadLettered(errWorkerLost, function.ErrorInfrastructure)
+		j.Release()
+	}
+
+	ok, err := r.jobRepo.ReleaseExpired(ctx, j, now)
+	if err != nil {
+		log.Printf("[reaper] error recovering job %s: %v\n", j.ID, err)
+		return
+	}
+	if !ok {
+		return
+	}
+	log.Printf("[reaper] job %s abandoned by worker %s is now %s\n", j.ID, worker, j.Status)
+
+	// the claim counted an attempt that the worker never recorded
+	attempt.FinishedAt = now
+	attempt.Status = job.StatusError
+	attempt.ErrorClass = function.ErrorInfrastructure
+	attempt.Error = errWorkerLost
+	if j.Status == job.StatusCancelled {
+		attempt.Status = job.StatusCancelled
+		attempt.ErrorClass = ""
+		attempt.Error = ""
+	}
+	if err := r.jobRepo.RecordAttempt(ctx, attempt); err != nil {
+		log.Printf("[reaper] error recording attempt %d of job %s: %v\n", attempt.Attempt, j.ID, err)
+	}
+
+	if j.Status == job.StatusDeadLettered {
+		fn, err := r.funcRepo.GetByID(ctx, j.FunctionID)
+		if err == nil {
+			_, err = routeFailure(ctx, r.jobRepo, r.funcRepo, fn, j)
+		}
+		if err != nil && err != function.ErrNotFound {
+			log.Printf("[reaper] error routing dead-lettered job %s to its failure destination: %v\n", j.ID, err)
+		}
+	}
+}
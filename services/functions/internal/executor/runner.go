@@ -1,30 +1,130 @@
 package executor
 
 import (
+	"archive/tar"
 	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
-	imageTypes "github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
 	"github.com/docker/docker/pkg/stdcopy"
 	"github.com/google/uuid"
 
+	"platform/functions/internal/agent"
 	"platform/functions/internal/domain/function"
+	"platform/functions/internal/domain/job"
+	"platform/functions/internal/runtimes"
 )
 
+// resultPath is where a function writes its JSON result. It is passed to the
+// function in the RESULT_PATH environment variable; anything written to
+// stdout or stderr is kept as logs.
+const resultPath = resultDir + "/result.json"
+
+// jobLabel marks function containers with the ID of the job they run, so
+// the Reaper can find containers left behind by a dead worker.
+const jobLabel = "platform.job_id"
+
+// RunRequest is a single execution of a function version.
+type RunRequest struct {
+	JobID    uuid.UUID
+	Function *function.Function
+	// Image is the version's built image.
+	Image string
+	// Input is the JSON payload delivered to the function on stdin.
+	Input json.RawMessage
+}
+
+// RunResult describes a finished container. Stdout and Stderr are kept
+// separately and are cut off at the runner's output limit, in which case
+// Truncated is set.
+type RunResult struct {
+	Stdout    string
+	Stderr    string
+	ExitCode  int
+	Truncated bool
+	// StartKind is job.StartCold or job.StartWarm, and StartLatency the
+	// time it took to get the function started.
+	StartKind    string
+	StartLatency time.Duration
+	StartedAt    time.Time
+	FinishedAt   time.Time
+	// Output is the JSON the function wrote to RESULT_PATH, or nil if it
+	// wrote nothing.
+	Output json.RawMessage
+}
+
+// Runner runs a function to completion within the function's Limits; the
+// caller enforces the timeout through ctx. When ctx ends first, because the
+// job timed out or was cancelled, the container is killed and the partial result
+// captured so far is returned together with an error wrapping ctx.Err().
 type Runner interface {
-    Run(ctx context.Context, fn *function.Function) (string, error)
+	Run(ctx context.Context, req RunRequest) (*RunResult, error)
+}
+
+// ErrInvalidResult is wrapped by errors about the result a function wrote,
+// which are the function's fault rather than the platform's.
+var ErrInvalidResult = errors.New("invalid function result")
+
+// ErrOutOfMemory is wrapped by the error returned when the container was
+// killed for exceeding the function's memory limit. The result is returned
+// along with it.
+var ErrOutOfMemory = errors.New("function exceeded its memory limit")
+
+// ErrUnknownRuntime is wrapped by the error returned for a function whose
+// language is not in the runtime registry.
+var ErrUnknownRuntime = errors.New("unknown runtime")
+
+// ErrImageNotFound is wrapped by the error returned when the image of a
+// version is missing from the Docker host, so the version must be rebuilt.
+var ErrImageNotFound = errors.New("function image not found")
+
+// ErrNotRunning is returned by StreamLogs when the job has no container.
+var ErrNotRunning = errors.New("job has no running container")
+
+// LogSource streams the output of a job while its container runs.
+type LogSource interface {
+	// StreamLogs copies the job's stdout and stderr from the start of the
+	// run. With follow it keeps streaming until the container exits.
+	StreamLogs(ctx context.Context, jobID uuid.UUID, follow bool, stdout, stderr io.Writer) error
 }
 
 type DockerRunner struct {
 	cli *client.Client
+	// outputLimit caps the bytes kept from each of stdout and stderr.
+	outputLimit int
+	sandbox     Sandbox
+	runtimes    *runtimes.Registry
+	buildCache  buildCache
+	// workspaces keeps the files of version images for warm starts.
+	workspaces buildCache
+	images     ImagePolicy
+	puller     imagePuller
+
+	mu      sync.Mutex
+	running map[uuid.UUID]string // job ID -> container ID
+	pool    *warmPool            // nil unless StartWarmPool was called
+
+	// agentVolume holds the agent function containers run, see
+	// InstallAgent.
+	agentVolume string
 }
 
-func NewDockerRunner() (*DockerRunner, error) {
+// NewDockerRunner creates a runner that builds images for the runtimes in
+// registry, keeping build artifacts as cache says and pulling the images it
+// builds on as images says.
+func NewDockerRunner(outputLimit int, sandbox Sandbox, registry *runtimes.Registry, cache CacheConfig, images ImagePolicy) (*DockerRunner, error) {
 	dcli, err := client.NewClientWithOpts(
 		client.FromEnv,
 		client.WithAPIVersionNegotiation(),
@@ -32,123 +132,376 @@ func NewDockerRunner() (*DockerRunner, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &DockerRunner{cli: dcli}, nil
-}
-
-func (dr *DockerRunner) Run(ctx context.Context, fn *function.Function) (string, error) {
-    ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
-    defer cancel()
-
-    var image string
-    var cmd []string
-
-    switch strings.ToLower(fn.Language) {
-    case "python":
-        image = "python:3.10-alpine"
-        cmd = []string{"python", "-c", fn.Code}
-    case "go":
-        image = "golang:1.21-alpine"
-        cmd = []string{"sh", "-c", fmt.Sprintf("echo '%s' && echo 'Pretend to run Go code'", fn.Code)}
-    default:
-        image = "alpine"
-        cmd = []string{"echo", fn.Code}
-    }
-
-    containerName := fmt.Sprintf("fn-%s-%s", fn.Language, uuid.New().String()[:8])
-
-    containerCfg := &container.Config{
-        Image: image,
-        Cmd:   cmd,
-        Tty:   false,
-    }
-
-    if err := dr.pullIfNotExists(ctx, image); err != nil {
-        return "", err
-    }
-
-    resp, err := dr.cli.ContainerCreate(ctx, containerCfg, nil, nil, nil, containerName)
-    if err != nil {
-        return "", fmt.Errorf("container create error: %w", err)
-    }
-    containerID := resp.ID
-
-    if err := dr.cli.ContainerStart(ctx, containerID, container.StartOptions{}); err != nil {
-        return "", fmt.Errorf("container start error: %w", err)
-    }
-
-    waitCh, errCh := dr.cli.ContainerWait(ctx, containerID, container.WaitConditionNotRunning)
-    select {
-    case status := <-waitCh:
-        if status.Error != nil {
-            return "", fmt.Errorf("container wait error: %s", status.Error.Message)
-        }
-        if status.StatusCode != 0 {
-            return "", fmt.Errorf("container exit code %d", status.StatusCode)
-        }
-    case e := <-errCh:
-        if e != nil {
-            return "", fmt.Errorf("container wait error: %w", e)
-        }
-    case <-ctx.Done():
-        _ = dr.cli.ContainerRemove(ctx, containerID, container.RemoveOptions{Force: true})
-        return "", fmt.Errorf("job timed out: %w", ctx.Err())
-    }
-
-    logs, err := dr.cli.ContainerLogs(ctx, containerID, container.LogsOptions{
-        ShowStdout: true,
-        ShowStderr: true,
-    })
-    if err != nil {
-        return "", fmt.Errorf("container logs error: %w", err)
-    }
-    defer logs.Close()
-
-    logOutput, err := readLogs(logs)
-    if err != nil {
-        return "", err
-    }
-
-    _ = dr.cli.ContainerRemove(ctx, containerID, container.RemoveOptions{
-        Force: true,
-    })
-
-    return logOutput, nil
-}
-
-func (dr *DockerRunner) pullIfNotExists(ctx context.Context, image string) error {
-	_, _, err := dr.cli.ImageInspectWithRaw(ctx, image)
-	if err == nil {
-		return nil
+	return &DockerRunner{
+		cli:         dcli,
+		outputLimit: outputLimit,
+		sandbox:     sandbox,
+		runtimes:    registry,
+		buildCache:  buildCache{dir: cache.Dir, maxBytes: cache.MaxBytes},
+		workspaces:  buildCache{dir: filepath.Join(cache.Dir, "workspaces"), maxBytes: cache.WorkspacesMaxBytes},
+		images:      images,
+		puller:      imagePuller{inflight: make(map[string]*pull)},
+		running:     make(map[uuid.UUID]string),
+	}, nil
+}
+
+func (dr *DockerRunner) Run(ctx context.Context, req RunRequest) (*RunResult, error) {
+	fn := req.Function
+	requestedAt := time.Now()
+	spec, err := dr.versionSpec(ctx, req.Image)
+	if err != nil {
+		return nil, err
+	}
+	started, err := dr.startWarm(ctx, req, spec)
+	if err != nil {
+		return nil, err
+	}
+	if started == nil {
+		started, err = dr.startCold(ctx, req, spec)
+		if err != nil {
+			return nil, err
+		}
+	}
+	containerID, attach := started.id, started.attach
+	defer dr.cli.ContainerRemove(context.Background(), containerID, container.RemoveOptions{Force: true, RemoveVolumes: true})
+	defer attach.Close()
+	startedAt := time.Now()
+	dr.track(req.JobID, containerID)
+	defer dr.untrack(req.JobID)
+
+	// the input is written while the container runs, so a function that
+	// reads it slowly, or exits without reading all of it, cannot block the
+	// job. The deferred Close ends a write the function never reads.
+	go writeInput(attach, req.Input)
+
+	res, interrupted, err := dr.awaitResult(ctx, containerID)
+	if err != nil {
+		return nil, err
+	}
+	finishedAt := time.Now()
+
+	// ctx may already be done, so collect what the container produced with
+	// a fresh deadline
+	collectCtx, cancelCollect := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelCollect()
+	if interrupted != nil {
+		_ = dr.cli.ContainerKill(collectCtx, containerID, "KILL")
+	} else {
+		// the agent exits once it handed over the result; after that the
+		// logs are complete and an OOM kill is on record
+		if _, _, err := dr.wait(collectCtx, containerID); err != nil {
+			return nil, err
+		}
+	}
+
+	result := &RunResult{
+		StartKind:    started.kind,
+		StartLatency: startedAt.Sub(requestedAt),
+		StartedAt:    startedAt,
+		FinishedAt:   finishedAt,
+	}
+	result.Stdout, result.Stderr, result.Truncated, err = dr.collectLogs(collectCtx, containerID)
+	if err != nil {
+		return nil, err
+	}
+	if interrupted != nil {
+		return result, fmt.Errorf("container stopped: %w", interrupted)
+	}
+	result.ExitCode = res.ExitCode
+
+	oomKilled, err := dr.oomKilled(collectCtx, containerID)
+	if err != nil {
+		return nil, err
+	}
+	if oomKilled {
+		return result, fmt.Errorf("%w of %d MB", ErrOutOfMemory, fn.MemoryMB)
+	}
+
+	if res.ExitCode == 0 {
+		result.Output, err = parseResult(res)
+		if err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// writeInput writes a job's input to the container's stdin and closes it.
+// Write errors only mean the function stopped reading, which is up to it.
+func writeInput(attach types.HijackedResponse, input []byte) {
+	if len(input) > 0 {
+		if _, err := attach.Conn.Write(input); err != nil {
+			return
+		}
+	}
+	_ = attach.CloseWrite()
+}
+
+// startedContainer is a running function container with its stdin
+// attached.
+type startedContainer struct {
+	id     string
+	attach types.HijackedResponse
+	kind   string
+}
+
+// startCold creates and starts a container of the version's image and
+// hands its agent the version to run.
+func (dr *DockerRunner) startCold(ctx context.Context, req RunRequest, spec *versionSpec) (*startedContainer, error) {
+	fn := req.Function
+	containerName := fmt.Sprintf("fn-%s-%s", fn.Language, uuid.New().String()[:8])
+
+	containerCfg := &container.Config{
+		Image:       req.Image,
+		Entrypoint:  []string{agentPath},
+		WorkingDir:  resultDir,
+		Env:         []string{"RESULT_PATH=" + resultPath},
+		User:        sandboxUser,
+		Labels:      map[string]string{jobLabel: req.JobID.String()},
+		Tty:         false,
+		AttachStdin: true,
+		OpenStdin:   true,
+		StdinOnce:   true,
 	}
 
-	pullResp, err := dr.cli.ImagePull(ctx, image, imageTypes.PullOptions{})
+	hostCfg := dr.sandbox.functionHostConfig(fn.Limits, fn.NetworkAccess, dr.agentVolume)
+	resp, err := dr.cli.ContainerCreate(ctx, containerCfg, hostCfg, nil, nil, containerName)
 	if err != nil {
-		return fmt.Errorf("image pull error: %w", err)
+		if errdefs.IsNotFound(err) {
+			return nil, fmt.Errorf("%w: %s", ErrImageNotFound, req.Image)
+		}
+		return nil, fmt.Errorf("container create error: %w", err)
 	}
-	defer pullResp.Close()
+	remove := func() {
+		dr.cli.ContainerRemove(context.Background(), resp.ID, container.RemoveOptions{Force: true, RemoveVolumes: true})
+	}
+
+	// attach before starting so the agent never sees an empty stdin
+	attach, err := dr.cli.ContainerAttach(ctx, resp.ID, container.AttachOptions{
+		Stream: true,
+		Stdin:  true,
+	})
+	if err != nil {
+		remove()
+		return nil, fmt.Errorf("container attach error: %w", err)
+	}
+	if err := dr.cli.ContainerStart(ctx, resp.ID, container.StartOptions{}); err != nil {
+		attach.Close()
+		remove()
+		return nil, fmt.Errorf("container start error: %w", err)
+	}
+	if err := agent.Write(attach.Conn, spec.request()); err != nil {
+		attach.Close()
+		remove()
+		return nil, fmt.Errorf("container stdin error: %w", err)
+	}
+	return &startedContainer{id: resp.ID, attach: attach, kind: job.StartCold}, nil
+}
+
+// wait blocks until the container exits and returns its exit code. If ctx
+// ends first, because the job timed out or was cancelled, interrupted is
+// ctx's error and the container is still running.
+func (dr *DockerRunner) wait(ctx context.Context, containerID string) (exitCode int, interrupted, err error) {
+	waitCh, errCh := dr.cli.ContainerWait(ctx, containerID, container.WaitConditionNotRunning)
+	select {
+	case status := <-waitCh:
+		if status.Error != nil {
+			return 0, nil, fmt.Errorf("container wait error: %s", status.Error.Message)
+		}
+		return int(status.StatusCode), nil, nil
+	case e := <-errCh:
+		if ctx.Err() == nil {
+			return 0, nil, fmt.Errorf("container wait error: %w", e)
+		}
+		return 0, ctx.Err(), nil
+	case <-ctx.Done():
+		return 0, ctx.Err(), nil
+	}
+}
+
+func (dr *DockerRunner) collectLogs(ctx context.Context, containerID string) (stdout, stderr string, truncated bool, err error) {
+	logs, err := dr.cli.ContainerLogs(ctx, containerID, container.LogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+	})
+	if err != nil {
+		return "", "", false, fmt.Errorf("container logs error: %w", err)
+	}
+	defer logs.Close()
+	return readLogs(logs, dr.outputLimit)
+}
 
-	_, _ = io.Copy(io.Discard, pullResp)
+func (dr *DockerRunner) oomKilled(ctx context.Context, containerID string) (bool, error) {
+	info, err := dr.cli.ContainerInspect(ctx, containerID)
+	if err != nil {
+		return false, fmt.Errorf("container inspect error: %w", err)
+	}
+	return info.State != nil && info.State.OOMKilled, nil
+}
+
+// containerFile is a file copied into a container before it starts, owned
+// by the sandbox user. A name ending in a slash is a directory.
+type containerFile struct {
+	name string
+	mode int64
+	data []byte
+}
+
+// tarFiles packs files into an archive for copyArchive.
+func tarFiles(files ...containerFile) ([]byte, error) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, f := range files {
+		hdr := &tar.Header{
+			Name:    f.name,
+			Mode:    f.mode,
+			Size:    int64(len(f.data)),
+			Uid:     sandboxUID,
+			Gid:     sandboxUID,
+			ModTime: time.Now(),
+		}
+		if strings.HasSuffix(f.name, "/") {
+			hdr.Typeflag = tar.TypeDir
+			hdr.Size = 0
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return nil, err
+		}
+		if _, err := tw.Write(f.data); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// copyArchive extracts a tar into dir of a created container.
+func (dr *DockerRunner) copyArchive(ctx context.Context, containerID, dir string, archive []byte) error {
+	if len(archive) == 0 {
+		return nil
+	}
+	err := dr.cli.CopyToContainer(ctx, containerID, dir, bytes.NewReader(archive), container.CopyToContainerOptions{})
+	if err != nil {
+		return fmt.Errorf("container copy error: %w", err)
+	}
 	return nil
 }
 
-func readLogs(reader io.ReadCloser) (string, error) {
-	var stdoutBuf, stderrBuf bytes.Buffer
-	_, err := stdcopy.StdCopy(&stdoutBuf, &stderrBuf, reader)
+func (dr *DockerRunner) track(jobID uuid.UUID, containerID string) {
+	dr.mu.Lock()
+	dr.running[jobID] = containerID
+	dr.mu.Unlock()
+}
+
+func (dr *DockerRunner) untrack(jobID uuid.UUID) {
+	dr.mu.Lock()
+	delete(dr.running, jobID)
+	dr.mu.Unlock()
+}
+
+func (dr *DockerRunner) StreamLogs(ctx context.Context, jobID uuid.UUID, follow bool, stdout, stderr io.Writer) error {
+	dr.mu.Lock()
+	containerID, ok := dr.running[jobID]
+	dr.mu.Unlock()
+	if !ok {
+		return ErrNotRunning
+	}
+
+	logs, err := dr.cli.ContainerLogs(ctx, containerID, container.LogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Follow:     follow,
+	})
 	if err != nil {
-		return "", err
+		if errdefs.IsNotFound(err) {
+			return ErrNotRunning
+		}
+		return fmt.Errorf("container logs error: %w", err)
+	}
+	defer logs.Close()
+
+	if _, err := stdcopy.StdCopy(stdout, stderr, logs); err != nil && ctx.Err() == nil {
+		return err
+	}
+	return nil
+}
+
+// JobContainers lists the function containers on the Docker host, keyed by
+// container ID, with the job each one runs: cold containers by jobLabel and
+// warm ones that took a job by their name.
+func (dr *DockerRunner) JobContainers(ctx context.Context) (map[string]uuid.UUID, error) {
+	containers := make(map[string]uuid.UUID)
+	for _, label := range []string{jobLabel, poolLabel} {
+		list, err := dr.cli.ContainerList(ctx, container.ListOptions{
+			All:     true,
+			Filters: filters.NewArgs(filters.Arg("label", label)),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("container list error: %w", err)
+		}
+		for _, c := range list {
+			if jobID, ok := containerJob(c); ok {
+				containers[c.ID] = jobID
+			}
+		}
 	}
+	return containers, nil
+}
 
-	combined := stdoutBuf.String() + stderrBuf.String()
+// containerJob returns the job a function container runs, if it runs one.
+func containerJob(c types.Container) (uuid.UUID, bool) {
+	if id, ok := c.Labels[jobLabel]; ok {
+		jobID, err := uuid.Parse(id)
+		return jobID, err == nil
+	}
+	return warmJob(c.Names)
+}
 
-	for _, ctrl := range []string{"\x00", "\x01", "\x02", "\x03", "\x04",
-		"\x05", "\x06", "\x07", "\x08", "\x0B", "\x0C",
-		"\x0E", "\x0F"} {
-		combined = strings.ReplaceAll(combined, ctrl, "")
+func (dr *DockerRunner) RemoveContainer(ctx context.Context, containerID string) error {
+	err := dr.cli.ContainerRemove(ctx, containerID, container.RemoveOptions{Force: true, RemoveVolumes: true})
+	if err != nil && !errdefs.IsNotFound(err) {
+		return fmt.Errorf("container remove error: %w", err)
 	}
+	return nil
+}
 
-	combined = strings.ReplaceAll(combined, "\r\n", "\\n")
-	combined = strings.ReplaceAll(combined, "\r", "\\n")
-	combined = strings.ReplaceAll(combined, "\n", "\\n")
+// readLogs demultiplexes the container log stream into stdout and stderr,
+// keeping at most limit bytes of each.
+func readLogs(reader io.Reader, limit int) (stdout, stderr string, truncated bool, err error) {
+	outBuf := &cappedBuffer{limit: limit}
+	errBuf := &cappedBuffer{limit: limit}
+	if _, err := stdcopy.StdCopy(outBuf, errBuf, reader); err != nil {
+		return "", "", false, err
+	}
+	return outBuf.String(), errBuf.String(), outBuf.truncated || errBuf.truncated, nil
+}
+
+// cappedBuffer keeps the first limit bytes written to it and discards the
+// rest, recording that it did so.
+type cappedBuffer struct {
+	buf       bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	room := b.limit - b.buf.Len()
+	if len(p) > room {
+		b.truncated = true
+		if room > 0 {
+			b.buf.Write(p[:room])
+		}
+		return len(p), nil
+	}
+	b.buf.Write(p)
+	return len(p), nil
+}
 
-	return combined, nil
+// String returns the captured text in a form Postgres accepts: NUL bytes are
+// dropped and a multi-byte character split by truncation is replaced.
+func (b *cappedBuffer) String() string {
+	s := strings.ReplaceAll(b.buf.String(), "\x00", "")
+	return strings.ToValidUTF8(s, "\uFFFD")
 }
@@ -0,0 +1,108 @@
+package executor
+
+import (
+	_ "embed"
+	"fmt"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+
+	"platform/functions/internal/domain/function"
+)
+
+// defaultSeccompProfile is Docker's default profile, which denies every
+// syscall it does not list, tightened for containers without capabilities:
+// the rules that only apply with a capability are gone, and so are ptrace,
+// process_vm_readv and process_vm_writev, clock_adjtime and
+// name_to_handle_at, which Docker allows without one.
+//
+//go:embed seccomp.json
+var defaultSeccompProfile string
+
+// sandboxUID is the unprivileged user functions run as, "nobody" in the
+// images functions run on.
+const (
+	sandboxUID  = 65534
+	sandboxUser = "65534:65534"
+)
+
+// resultDir is the working directory of function containers. It is a
+// tmpfs of Sandbox.WorkspaceSizeMB that the agent unpacks the function's
+// files into, and holds RESULT_PATH. The tmpfs is gone once the container
+// stops, so the runner fetches the result through the agent while the
+// function's container still runs. Version images keep their files in
+// resultDir, where versionSpec finds them.
+const resultDir = "/var/tmp"
+
+// Sandbox is the hardening applied to every function container.
+type Sandbox struct {
+	// TmpfsSizeMB bounds the writable scratch space at /tmp.
+	TmpfsSizeMB int
+	// WorkspaceSizeMB bounds resultDir, which holds the function's files
+	// and its result.
+	WorkspaceSizeMB int
+	// SeccompProfile is the seccomp profile JSON.
+	SeccompProfile string
+}
+
+func DefaultSandbox() Sandbox {
+	return Sandbox{
+		TmpfsSizeMB:     64,
+		WorkspaceSizeMB: 64,
+		SeccompProfile:  defaultSeccompProfile,
+	}
+}
+
+// hostConfig enforces the sandbox and limits on a container: no
+// capabilities or privilege escalation, a read-only root filesystem, no
+// network unless asked for, and hard memory, CPU and PID limits. Swap is
+// disabled so the memory limit is a hard one; a container that exceeds it
+// is OOM-killed.
+func (s Sandbox) hostConfig(limits function.Limits, network bool) *container.HostConfig {
+	networkMode := "none"
+	if network {
+		networkMode = "bridge"
+	}
+	return &container.HostConfig{
+		NetworkMode:    container.NetworkMode(networkMode),
+		ReadonlyRootfs: true,
+		CapDrop:        []string{"ALL"},
+		SecurityOpt: []string{
+			"no-new-privileges:true",
+			"seccomp=" + s.SeccompProfile,
+		},
+		Tmpfs: map[string]string{
+			"/tmp": fmt.Sprintf("rw,nosuid,nodev,mode=1777,size=%dm", s.TmpfsSizeMB),
+		},
+		Resources: resources(limits),
+	}
+}
+
+// functionHostConfig is hostConfig with what a function container adds:
+// resultDir as a tmpfs the function's files can run from, and the agent
+// volume mounted read-only at agentDir.
+func (s Sandbox) functionHostConfig(limits function.Limits, network bool, agentVolume string) *container.HostConfig {
+	host := s.hostConfig(limits, network)
+	host.Tmpfs[resultDir] = fmt.Sprintf("rw,exec,nosuid,nodev,mode=1777,size=%dm", s.WorkspaceSizeMB)
+	host.Mounts = []mount.Mount{{
+		Type:     mount.TypeVolume,
+		Source:   agentVolume,
+		Target:   agentDir,
+		ReadOnly: true,
+	}}
+	return host
+}
+
+// resources are the memory, CPU and PID limits of a container. They can be
+// changed on a running container, which is how a warm container takes on the
+// limits of the function it runs.
+func resources(limits function.Limits) container.Resources {
+	memory := int64(limits.MemoryMB) << 20
+	pids := int64(limits.MaxPIDs)
+	return container.Resources{
+		Memory:     memory,
+		MemorySwap: memory,
+		NanoCPUs:   int64(limits.CPUMillicores) * 1e6,
+		PidsLimit:  &pids,
+	}
+}
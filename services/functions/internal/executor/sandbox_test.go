@@ -0,0 +1,252 @@
+package executor
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	imageTypes "github.com/docker/docker/api/types/image"
+	"github.com/google/uuid"
+
+	"platform/functions/internal/domain/function"
+	"platform/functions/internal/runtimes"
+)
+
+// The tests in this file run real function containers and are skipped when
+// no Docker daemon is reachable.
+
+// newTestRunner returns a runner with the default sandbox and an agent built
+// from this tree.
+func newTestRunner(t *testing.T) *DockerRunner {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("runs containers")
+	}
+	dr, err := NewDockerRunner(1<<20, DefaultSandbox(), runtimes.Default(), CacheConfig{Dir: t.TempDir()}, DefaultImagePolicy())
+	if err != nil {
+		t.Skipf("docker is not available: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := dr.cli.Ping(ctx); err != nil {
+		t.Skipf("docker is not available: %v", err)
+	}
+
+	bin := filepath.Join(t.TempDir(), "fn-agent")
+	cmd := exec.Command("go", "build", "-o", bin, "platform/functions/cmd/agent")
+	cmd.Env = append(os.Environ(), "CGO_ENABLED=0")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("building the agent: %v\n%s", err, out)
+	}
+	agentBinary, err := os.ReadFile(bin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if err := dr.InstallAgent(ctx, agentBinary); err != nil {
+		t.Fatalf("InstallAgent: %v", err)
+	}
+	return dr
+}
+
+// runPython builds code as a Python function with the given limits and runs
+// it once.
+func runPython(t *testing.T, dr *DockerRunner, code string, limits function.Limits) (*RunResult, error) {
+	t.Helper()
+	fn := &function.Function{
+		ID:       uuid.New(),
+		Version:  1,
+		Language: "python3.12",
+		Code:     code,
+		Limits:   limits,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	tag, err := dr.BuildImage(ctx, BuildRequest{Function: fn}, io.Discard)
+	if err != nil {
+		t.Fatalf("BuildImage: %v", err)
+	}
+	t.Cleanup(func() {
+		_, _ = dr.cli.ImageRemove(context.Background(), tag, imageTypes.RemoveOptions{Force: true})
+	})
+
+	runCtx, cancelRun := context.WithTimeout(ctx, fn.Timeout())
+	defer cancelRun()
+	return dr.Run(runCtx, RunRequest{JobID: uuid.New(), Function: fn, Image: tag})
+}
+
+// probe reports what a function can see and do in its container.
+const probe = `
+import ctypes, errno, json, os
+
+libc = ctypes.CDLL(None, use_errno=True)
+
+def denied(call, *args):
+    ctypes.set_errno(0)
+    return call(*args) == -1 and ctypes.get_errno() == errno.EPERM
+
+def write_fails(path):
+    try:
+        with open(path, "w") as f:
+            f.write("x")
+        return None
+    except OSError as e:
+        return e.errno
+
+status = {}
+with open("/proc/self/status") as f:
+    for line in f:
+        key, _, value = line.partition(":")
+        status[key] = value.strip()
+
+result = {
+    "uid": os.getuid(),
+    "gid": os.getgid(),
+    "cap_eff": status["CapEff"],
+    "cap_bnd": status["CapBnd"],
+    "no_new_privs": status["NoNewPrivs"],
+    "seccomp": status["Seccomp"],
+    "rootfs_write": write_fails("/probe"),
+    "workspace_write": write_fails("probe"),
+    "interfaces": sorted(os.listdir("/sys/class/net")),
+    "unshare_user": denied(libc.unshare, 0x10000000),
+    "ptrace": denied(libc.ptrace, 0, 0, 0, 0),
+}
+with open(os.environ["RESULT_PATH"], "w") as f:
+    json.dump(result, f)
+`
+
+func TestSandbox(t *testing.T) {
+	dr := newTestRunner(t)
+	res, err := runPython(t, dr, probe, function.DefaultLimits())
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if res.ExitCode != 0 {
+		t.Fatalf("exit code %d, stderr:\n%s", res.ExitCode, res.Stderr)
+	}
+	var got struct {
+		UID            int      `json:"uid"`
+		GID            int      `json:"gid"`
+		CapEff         string   `json:"cap_eff"`
+		CapBnd         string   `json:"cap_bnd"`
+		NoNewPrivs     string   `json:"no_new_privs"`
+		Seccomp        string   `json:"seccomp"`
+		RootfsWrite    *int     `json:"rootfs_write"`
+		WorkspaceWrite *int     `json:"workspace_write"`
+		Interfaces     []string `json:"interfaces"`
+		UnshareUser    bool     `json:"unshare_user"`
+		Ptrace         bool     `json:"ptrace"`
+	}
+	if err := json.Unmarshal(res.Output, &got); err != nil {
+		t.Fatalf("result %s: %v", res.Output, err)
+	}
+
+	if got.UID != sandboxUID || got.GID != sandboxUID {
+		t.Errorf("runs as %d:%d, want %s", got.UID, got.GID, sandboxUser)
+	}
+	if got.CapEff != "0000000000000000" || got.CapBnd != "0000000000000000" {
+		t.Errorf("capabilities effective %s, bounding %s, want none", got.CapEff, got.CapBnd)
+	}
+	if got.NoNewPrivs != "1" {
+		t.Errorf("NoNewPrivs is %s, want 1", got.NoNewPrivs)
+	}
+	if got.Seccomp != "2" {
+		t.Errorf("seccomp mode %s, want 2 (filter)", got.Seccomp)
+	}
+	if got.RootfsWrite == nil || *got.RootfsWrite != 30 { // EROFS
+		t.Errorf("writing to the root filesystem: errno %v, want EROFS", got.RootfsWrite)
+	}
+	if got.WorkspaceWrite != nil {
+		t.Errorf("writing to the working directory: errno %d, want success", *got.WorkspaceWrite)
+	}
+	if len(got.Interfaces) != 1 || got.Interfaces[0] != "lo" {
+		t.Errorf("network interfaces %v, want only lo", got.Interfaces)
+	}
+	if !got.UnshareUser {
+		t.Error("unshare(CLONE_NEWUSER) is allowed")
+	}
+	if !got.Ptrace {
+		t.Error("ptrace is allowed")
+	}
+}
+
+func TestSandboxPIDLimit(t *testing.T) {
+	dr := newTestRunner(t)
+	limits := function.DefaultLimits()
+	limits.MaxPIDs = 16
+	res, err := runPython(t, dr, `
+import json, os, time
+
+children = 0
+try:
+    while children < 100:
+        if os.fork() == 0:
+            time.sleep(30)
+            os._exit(0)
+        children += 1
+except OSError:
+    pass
+with open(os.environ["RESULT_PATH"], "w") as f:
+    json.dump(children, f)
+os._exit(0)
+`, limits)
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	var children int
+	if err := json.Unmarshal(res.Output, &children); err != nil {
+		t.Fatalf("result %s: %v, stderr:\n%s", res.Output, err, res.Stderr)
+	}
+	if children >= limits.MaxPIDs {
+		t.Errorf("forked %d children under a limit of %d processes", children, limits.MaxPIDs)
+	}
+}
+
+func TestSandboxMemoryLimit(t *testing.T) {
+	dr := newTestRunner(t)
+	limits := function.DefaultLimits()
+	limits.MemoryMB = 64
+	_, err := runPython(t, dr, `
+chunks = []
+while True:
+    chunks.append(bytearray(16 << 20))
+`, limits)
+	if !errors.Is(err, ErrOutOfMemory) {
+		t.Errorf("Run: %v, want ErrOutOfMemory", err)
+	}
+}
+
+func TestSandboxWorkspaceLimit(t *testing.T) {
+	dr := newTestRunner(t)
+	res, err := runPython(t, dr, `
+import errno, json, os
+
+written = 0
+failed = None
+try:
+    with open("fill", "wb") as f:
+        while written < (256 << 20):
+            f.write(bytes(1 << 20))
+            f.flush()
+            written += 1 << 20
+except OSError as e:
+    failed = e.errno
+os.remove("fill")
+with open(os.environ["RESULT_PATH"], "w") as f:
+    json.dump(failed, f)
+`, function.DefaultLimits())
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if string(res.Output) != "28" { // ENOSPC
+		t.Errorf("filling the working directory: errno %s, want ENOSPC", res.Output)
+	}
+}
@@ -0,0 +1,88 @@
+package executor
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/google/uuid"
+
+	"platform/functions/internal/agent"
+	"platform/functions/internal/domain/job"
+)
+
+// Labels of version images that tell whether a warm container of the
+// runtime can run the version: it can when the image adds nothing to the
+// runtime's own image but the version's files.
+const (
+	runtimeLabel   = "platform.runtime"
+	baseImageLabel = "platform.base_image"
+)
+
+// Labels cannot be added to a running container, so a warm container is
+// renamed after the job it takes instead of getting jobLabel.
+const warmJobPrefix = "fn-job-"
+
+// warmJob returns the job a warm container was renamed after, given the
+// container's names as Docker lists them.
+func warmJob(names []string) (uuid.UUID, bool) {
+	for _, name := range names {
+		if id, ok := strings.CutPrefix(strings.TrimPrefix(name, "/"), warmJobPrefix); ok {
+			jobID, err := uuid.Parse(id)
+			return jobID, err == nil
+		}
+	}
+	return uuid.Nil, false
+}
+
+// startWarm runs a job in a container from the warm pool. It returns nil
+// when the job cannot start warm, because the pool is empty or the version
+// needs more than the runtime's image, and the job should start cold.
+func (dr *DockerRunner) startWarm(ctx context.Context, req RunRequest, spec *versionSpec) (*startedContainer, error) {
+	if req.Function.NetworkAccess || spec.runtime == "" {
+		return nil, nil
+	}
+	wc, ok := dr.takeWarm(spec.runtime, spec.image)
+	if !ok {
+		return nil, nil
+	}
+
+	started, err := dr.claimWarm(ctx, wc, req, spec)
+	if err != nil {
+		_ = dr.RemoveContainer(context.Background(), wc.id)
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		log.Printf("[runner] warm container %.12s is unusable, starting job %s cold: %v\n", wc.id, req.JobID, err)
+		return nil, nil
+	}
+	return started, nil
+}
+
+// claimWarm names a warm container after the job, so the Reaper can tell
+// whether the job is still running, gives it the function's limits and
+// hands the agent the version to run. The job's input follows on the same
+// stream.
+func (dr *DockerRunner) claimWarm(ctx context.Context, wc warmContainer, req RunRequest, spec *versionSpec) (*startedContainer, error) {
+	if err := dr.cli.ContainerRename(ctx, wc.id, warmJobPrefix+req.JobID.String()); err != nil {
+		return nil, fmt.Errorf("container rename error: %w", err)
+	}
+	_, err := dr.cli.ContainerUpdate(ctx, wc.id, container.UpdateConfig{Resources: resources(req.Function.Limits)})
+	if err != nil {
+		return nil, fmt.Errorf("container update error: %w", err)
+	}
+	attach, err := dr.cli.ContainerAttach(ctx, wc.id, container.AttachOptions{
+		Stream: true,
+		Stdin:  true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("container attach error: %w", err)
+	}
+	if err := agent.Write(attach.Conn, spec.request()); err != nil {
+		attach.Close()
+		return nil, fmt.Errorf("container stdin error: %w", err)
+	}
+	return &startedContainer{id: wc.id, attach: attach, kind: job.StartWarm}, nil
+}
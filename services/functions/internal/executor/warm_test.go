@@ -0,0 +1,17 @@
+package executor
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestWarmJob(t *testing.T) {
+	jobID := uuid.New()
+	if got, ok := warmJob([]string{"/" + warmJobPrefix + jobID.String()}); !ok || got != jobID {
+		t.Errorf("warmJob of a claimed container = %s, %v, want %s", got, ok, jobID)
+	}
+	if _, ok := warmJob([]string{"/fn-python3.12-warm-1a2b3c4d"}); ok {
+		t.Error("an idle warm container has a job")
+	}
+}
@@ -0,0 +1,186 @@
+// Package runtimes describes the languages functions can be written in.
+package runtimes
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// Runtime is one language version functions run on. The function's code is
+// written to FileName in the container's working directory, or a bundle is
+// unpacked there, and Entrypoint is run from that directory with FilePlaceholder
+// replaced by the file to run.
+type Runtime struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	// Aliases are other names the runtime is known by, such as "python".
+	// Functions created with an alias are stored with Name.
+	Aliases      []string      `json:"aliases,omitempty"`
+	Image        string        `json:"image"`
+	FileName     string        `json:"file_name"`
+	Entrypoint   []string      `json:"entrypoint"`
+	Build        *Build        `json:"build,omitempty"`
+	Dependencies *Dependencies `json:"dependencies,omitempty"`
+	// Pool overrides the platform's warm pool settings for the runtime.
+	Pool *Pool `json:"pool,omitempty"`
+}
+
+// Pool sizes the warm pool of pre-started containers of a runtime.
+type Pool struct {
+	// MinIdle containers are always kept ready; up to MaxIdle are kept
+	// while jobs keep missing the pool.
+	MinIdle int `json:"min_idle"`
+	MaxIdle int `json:"max_idle"`
+	// IdleTTLSeconds is how long a container above MinIdle stays idle
+	// before it is removed.
+	IdleTTLSeconds int `json:"idle_ttl_seconds"`
+}
+
+// FilePlaceholder stands for a file in Runtime.Entrypoint, Build.Command
+// and Dependencies.Command.
+const FilePlaceholder = "{file}"
+
+// Build compiles a function before it runs. Command runs in Image with the
+// code in the working directory and must leave Artifact there; the artifact
+// is cached and copied into the runtime's container in place of the code.
+type Build struct {
+	Image    string   `json:"image"`
+	Command  []string `json:"command"`
+	Env      []string `json:"env,omitempty"`
+	Artifact string   `json:"artifact"`
+}
+
+// Dependencies installs the dependency file of a bundle. Command runs in Dir
+// of the runtime's image, with the dependency file copied there; Dir is then
+// kept as an image layer that the bundle runs on, with Env set.
+type Dependencies struct {
+	Dir     string   `json:"dir"`
+	Command []string `json:"command"`
+	Env     []string `json:"env,omitempty"`
+}
+
+// Command returns argv with every FilePlaceholder replaced by file.
+func Command(argv []string, file string) []string {
+	cmd := make([]string, len(argv))
+	for i, arg := range argv {
+		cmd[i] = strings.ReplaceAll(arg, FilePlaceholder, file)
+	}
+	return cmd
+}
+
+//go:embed runtimes.json
+var defaultRuntimes []byte
+
+// Registry is the set of available runtimes. A registry loaded from a file
+// can be reloaded from it, see Reload.
+type Registry struct {
+	mu       sync.RWMutex
+	runtimes []Runtime
+	byName   map[string]*Runtime
+}
+
+// Default returns the built-in runtimes.
+func Default() *Registry {
+	r, err := parse(defaultRuntimes)
+	if err != nil {
+		panic("runtimes: invalid built-in registry: " + err.Error())
+	}
+	return r
+}
+
+// Load reads a registry from a JSON file holding a list of runtimes.
+func Load(path string) (*Registry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	r, err := parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return r, nil
+}
+
+// Reload reads the registry from path again and replaces its runtimes,
+// reporting whether they changed. If the file is invalid, the registry
+// keeps the runtimes it has. Runtimes returned before a reload are not
+// changed by it.
+func (r *Registry) Reload(path string) (bool, error) {
+	loaded, err := Load(path)
+	if err != nil {
+		return false, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if reflect.DeepEqual(r.runtimes, loaded.runtimes) {
+		return false, nil
+	}
+	r.runtimes, r.byName = loaded.runtimes, loaded.byName
+	return true, nil
+}
+
+func parse(data []byte) (*Registry, error) {
+	r := &Registry{byName: make(map[string]*Runtime)}
+	if err := json.Unmarshal(data, &r.runtimes); err != nil {
+		return nil, err
+	}
+	if len(r.runtimes) == 0 {
+		return nil, fmt.Errorf("no runtimes defined")
+	}
+	for i := range r.runtimes {
+		rt := &r.runtimes[i]
+		if err := rt.validate(); err != nil {
+			return nil, err
+		}
+		for _, name := range append([]string{rt.Name}, rt.Aliases...) {
+			key := strings.ToLower(name)
+			if _, ok := r.byName[key]; ok {
+				return nil, fmt.Errorf("runtime name %q is defined twice", name)
+			}
+			r.byName[key] = rt
+		}
+	}
+	return r, nil
+}
+
+func (rt *Runtime) validate() error {
+	if rt.Name == "" {
+		return fmt.Errorf("runtime without a name")
+	}
+	if rt.Image == "" || rt.FileName == "" || len(rt.Entrypoint) == 0 {
+		return fmt.Errorf("runtime %s: image, file_name and entrypoint are required", rt.Name)
+	}
+	if b := rt.Build; b != nil && (b.Image == "" || len(b.Command) == 0 || b.Artifact == "") {
+		return fmt.Errorf("runtime %s: build needs an image, command and artifact", rt.Name)
+	}
+	if d := rt.Dependencies; d != nil && (d.Dir == "" || len(d.Command) == 0) {
+		return fmt.Errorf("runtime %s: dependencies need a dir and command", rt.Name)
+	}
+	if p := rt.Pool; p != nil && (p.MinIdle < 0 || p.MaxIdle < p.MinIdle || p.IdleTTLSeconds <= 0) {
+		return fmt.Errorf("runtime %s: pool needs 0 <= min_idle <= max_idle and a positive idle_ttl_seconds", rt.Name)
+	}
+	if rt.Build != nil && rt.Dependencies != nil {
+		return fmt.Errorf("runtime %s: a runtime with a build step cannot install dependencies", rt.Name)
+	}
+	return nil
+}
+
+// Lookup finds a runtime by name or alias, ignoring case.
+func (r *Registry) Lookup(name string) (*Runtime, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	rt, ok := r.byName[strings.ToLower(name)]
+	return rt, ok
+}
+
+// List returns every runtime in the order they were defined.
+func (r *Registry) List() []Runtime {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.runtimes
+}
@@ -0,0 +1,142 @@
+package runtimes
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDefault(t *testing.T) {
+	r := Default()
+	if len(r.List()) == 0 {
+		t.Fatal("no built-in runtimes")
+	}
+	for _, name := range []string{"python", "Python3.12", "node", "go"} {
+		if _, ok := r.Lookup(name); !ok {
+			t.Errorf("Lookup(%q) found nothing", name)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "runtimes.json")
+	err := os.WriteFile(path, []byte(`[
+	  {"name": "ruby3.3", "aliases": ["ruby"], "image": "ruby:3.3-alpine",
+	   "file_name": "main.rb", "entrypoint": ["ruby", "{file}"]}
+	]`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	rt, ok := r.Lookup("RUBY")
+	if !ok {
+		t.Fatal("alias lookup found nothing")
+	}
+	if rt.Name != "ruby3.3" || rt.Image != "ruby:3.3-alpine" {
+		t.Errorf("loaded %+v", rt)
+	}
+	if _, ok := r.Lookup("python"); ok {
+		t.Error("a loaded registry kept the built-in runtimes")
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := Load(filepath.Join(dir, "missing.json")); err == nil {
+		t.Error("Load of a missing file succeeded")
+	}
+
+	path := filepath.Join(dir, "broken.json")
+	if err := os.WriteFile(path, []byte(`[{"name": `), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	_, err := Load(path)
+	if err == nil || !strings.Contains(err.Error(), path) {
+		t.Errorf("Load of invalid JSON: %v, want an error naming the file", err)
+	}
+}
+
+func TestReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "runtimes.json")
+	write := func(image string) {
+		t.Helper()
+		data := `[{"name": "ruby3.3", "image": "` + image + `", "file_name": "main.rb", "entrypoint": ["ruby", "{file}"]}]`
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("ruby:3.3-alpine")
+	r, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	old, _ := r.Lookup("ruby3.3")
+
+	if changed, err := r.Reload(path); err != nil || changed {
+		t.Errorf("Reload of an unchanged file = %v, %v, want no change", changed, err)
+	}
+
+	write("ruby:3.3.1-alpine")
+	if changed, err := r.Reload(path); err != nil || !changed {
+		t.Fatalf("Reload of a changed file = %v, %v, want a change", changed, err)
+	}
+	if rt, _ := r.Lookup("ruby3.3"); rt.Image != "ruby:3.3.1-alpine" {
+		t.Errorf("reloaded image %s", rt.Image)
+	}
+	if old.Image != "ruby:3.3-alpine" {
+		t.Errorf("a reload changed a runtime looked up before it: %s", old.Image)
+	}
+
+	if err := os.WriteFile(path, []byte(`[]`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Reload(path); err == nil {
+		t.Error("Reload of an invalid file succeeded")
+	}
+	if _, ok := r.Lookup("ruby3.3"); !ok {
+		t.Error("a failed reload dropped the runtimes")
+	}
+}
+
+func TestParseValidation(t *testing.T) {
+	const base = `"image": "img", "file_name": "main", "entrypoint": ["run", "{file}"]`
+	for _, tc := range []struct {
+		name string
+		json string
+		want string
+	}{
+		{"empty", `[]`, "no runtimes defined"},
+		{"no name", `[{` + base + `}]`, "runtime without a name"},
+		{"no image", `[{"name": "a", "file_name": "main", "entrypoint": ["run"]}]`, "image, file_name and entrypoint are required"},
+		{"no entrypoint", `[{"name": "a", "image": "img", "file_name": "main"}]`, "image, file_name and entrypoint are required"},
+		{"incomplete build", `[{"name": "a", ` + base + `, "build": {"image": "img"}}]`, "build needs an image, command and artifact"},
+		{"incomplete dependencies", `[{"name": "a", ` + base + `, "dependencies": {"dir": "/deps"}}]`, "dependencies need a dir and command"},
+		{"build and dependencies", `[{"name": "a", ` + base + `,
+		   "build": {"image": "img", "command": ["cc"], "artifact": "out"},
+		   "dependencies": {"dir": "/deps", "command": ["install"]}}]`, "cannot install dependencies"},
+		{"pool bounds", `[{"name": "a", ` + base + `, "pool": {"min_idle": 2, "max_idle": 1, "idle_ttl_seconds": 60}}]`, "pool needs"},
+		{"pool ttl", `[{"name": "a", ` + base + `, "pool": {"min_idle": 0, "max_idle": 1}}]`, "pool needs"},
+		{"duplicate name", `[{"name": "a", ` + base + `}, {"name": "A", ` + base + `}]`, `runtime name "A" is defined twice`},
+		{"alias clash", `[{"name": "a", ` + base + `}, {"name": "b", "aliases": ["a"], ` + base + `}]`, `runtime name "a" is defined twice`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := parse([]byte(tc.json))
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("parse: %v, want an error containing %q", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestCommand(t *testing.T) {
+	got := Command([]string{"go", "build", "-o", "main", "{file}", "--src={file}"}, "main.go")
+	want := []string{"go", "build", "-o", "main", "main.go", "--src=main.go"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Command = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,113 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"platform/functions/internal/domain/bundle"
+	"platform/functions/internal/domain/function"
+)
+
+// maxBundleBytes caps the size of an uploaded bundle archive.
+const maxBundleBytes = 10 << 20
+
+// bundleContentTypes are the Content-Types of the archive formats a bundle
+// can be uploaded in. Any of them is accepted for any format, which is
+// detected from the archive itself.
+var bundleContentTypes = []string{
+	"application/zip",
+	"application/x-tar",
+	"application/gzip",
+	"application/x-gzip",
+}
+
+// isBundleUpload reports whether the request body is a bundle archive rather
+// than JSON.
+func isBundleUpload(c *gin.Context) bool {
+	contentType := c.ContentType()
+	for _, t := range bundleContentTypes {
+		if contentType == t {
+			return true
+		}
+	}
+	return false
+}
+
+// readBundle reads and stores the bundle in the request body and returns it
+// with the name of the runtime its manifest asks for, writing the error
+// response if the upload is invalid.
+func (h *handler) readBundle(c *gin.Context) (*bundle.Bundle, string, bool) {
+	upload, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxBundleBytes))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("bundle exceeds %d MB", maxBundleBytes>>20)})
+		} else {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "failed to read bundle"})
+		}
+		return nil, "", false
+	}
+	data, manifest, err := bundle.Normalize(upload)
+	if err != nil {
+		if errors.Is(err, bundle.ErrInvalid) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return nil, "", false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, "", false
+	}
+
+	rt, ok := h.runtimes.Lookup(manifest.Runtime)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unsupported runtime %q, see GET /runtimes", manifest.Runtime)})
+		return nil, "", false
+	}
+	if manifest.Dependencies != "" && rt.Dependencies == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("runtime %s does not install dependencies, include them in the bundle", rt.Name)})
+		return nil, "", false
+	}
+
+	b := bundle.New(data)
+	ctx := context.Background()
+	if err := h.bundleRepo.Put(ctx, b); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, "", false
+	}
+	return b, rt.Name, true
+}
+
+// createBundleFunction -> POST /functions with a bundle archive
+// The function gets the default configuration, which can be changed with
+// PATCH.
+func (h *handler) createBundleFunction(c *gin.Context) {
+	b, language, ok := h.readBundle(c)
+	if !ok {
+		return
+	}
+	fn := function.NewFunction(callerIdentity(c).UserID, "", language)
+	fn.BundleDigest = &b.Digest
+	fn.Limits = fn.Limits.Clamp(h.limitCaps)
+
+	h.create(c, fn)
+}
+
+// replaceBundle -> PUT /functions/:id with a bundle archive
+// Only the code is replaced, creating a new version; the configuration is
+// kept.
+func (h *handler) replaceBundle(c *gin.Context) {
+	fn, ok := h.loadFunction(c)
+	if !ok {
+		return
+	}
+	b, language, ok := h.readBundle(c)
+	if !ok {
+		return
+	}
+	fn.UpdateBundle(b.Digest, language)
+	h.saveFunction(c, fn)
+}
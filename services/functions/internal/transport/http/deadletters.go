@@ -0,0 +1,144 @@
+package http
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+
+	"platform/functions/internal/domain/job"
+)
+
+const (
+	defaultDeadLetterLimit = 50
+	maxDeadLetterLimit     = 200
+)
+
+// listDeadLetters -> GET /admin/dead-letters?function_id=&limit=&offset=
+// Newest first.
+func (h *handler) listDeadLetters(c *gin.Context) {
+	var filter job.DeadLetterFilter
+	if s := c.Query("function_id"); s != "" {
+		id, err := uuid.Parse(s)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid function ID"})
+			return
+		}
+		filter.FunctionID = &id
+	}
+	limit, offset := defaultDeadLetterLimit, 0
+	if s := c.Query("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxDeadLetterLimit {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and 200"})
+			return
+		}
+		limit = n
+	}
+	if s := c.Query("offset"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "offset must be a non-negative integer"})
+			return
+		}
+		offset = n
+	}
+
+	jobs, err := h.jobRepo.ListDeadLettered(context.Background(), filter, limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, jobs)
+}
+
+// getDeadLetter -> GET /admin/dead-letters/:id
+// Returns the job together with the history of its attempts.
+func (h *handler) getDeadLetter(c *gin.Context) {
+	j, ok := h.loadJob(c)
+	if !ok {
+		return
+	}
+	if j.Status != job.StatusDeadLettered {
+		c.JSON(http.StatusNotFound, gin.H{"error": "job is not dead-lettered"})
+		return
+	}
+	attempts, err := h.jobRepo.ListAttempts(context.Background(), j.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"job": j, "attempts": attempts})
+}
+
+// requeueDeadLetters -> POST /admin/dead-letters/requeue
+// Body: {"job_ids": [...]} or {"function_id": "..."}. The jobs run again with
+// a fresh set of retries.
+func (h *handler) requeueDeadLetters(c *gin.Context) {
+	filter, ok := bindDeadLetterFilter(c)
+	if !ok {
+		return
+	}
+	n, err := h.jobRepo.RequeueDeadLettered(context.Background(), filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if n > 0 {
+		h.exec.Wake()
+	}
+	c.JSON(http.StatusOK, gin.H{"requeued": n})
+}
+
+// purgeDeadLetters -> POST /admin/dead-letters/purge
+// Body: {"job_ids": [...]} or {"function_id": "..."}.
+func (h *handler) purgeDeadLetters(c *gin.Context) {
+	filter, ok := bindDeadLetterFilter(c)
+	if !ok {
+		return
+	}
+	n, err := h.jobRepo.PurgeDeadLettered(context.Background(), filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"purged": n})
+}
+
+// bindDeadLetterFilter reads the jobs a requeue or purge applies to. One of
+// job_ids or function_id is required so an empty body cannot match the whole
+// queue.
+func bindDeadLetterFilter(c *gin.Context) (job.DeadLetterFilter, bool) {
+	var req struct {
+		JobIDs     []string `json:"job_ids"`
+		FunctionID string   `json:"function_id"`
+	}
+	var filter job.DeadLetterFilter
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid JSON"})
+		return filter, false
+	}
+	if len(req.JobIDs) == 0 && req.FunctionID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "job_ids or function_id is required"})
+		return filter, false
+	}
+	for _, s := range req.JobIDs {
+		id, err := uuid.Parse(s)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid job ID " + s})
+			return filter, false
+		}
+		filter.JobIDs = append(filter.JobIDs, id)
+	}
+	if req.FunctionID != "" {
+		id, err := uuid.Parse(req.FunctionID)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid function ID"})
+			return filter, false
+		}
+		filter.FunctionID = &id
+	}
+	return filter, true
+}
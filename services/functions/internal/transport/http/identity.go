@@ -0,0 +1,143 @@
+package http
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"platform/functions/internal/domain/nonce"
+)
+
+// Identity headers set and signed by the gateway.
+const (
+	headerUserID            = "X-User-ID"
+	headerUserRoles         = "X-User-Roles"
+	headerIdentityTimestamp = "X-Identity-Timestamp"
+	headerIdentityNonce     = "X-Identity-Nonce"
+	headerIdentitySignature = "X-Identity-Signature"
+
+	ctxIdentityKey = "identity"
+
+	// identityMaxSkew bounds how old a signed identity may be. Nonces are
+	// remembered for longer, so a captured signature cannot be replayed.
+	identityMaxSkew = 30 * time.Second
+)
+
+type identity struct {
+	UserID string
+	Roles  []string
+}
+
+func (i identity) isAdmin() bool {
+	return slices.Contains(i.Roles, "admin")
+}
+
+// canAccess reports whether the caller may see resources owned by owner.
+func (i identity) canAccess(owner string) bool {
+	return i.isAdmin() || i.UserID == owner
+}
+
+// requireIdentity verifies the identity headers signed by the gateway with
+// the shared internal secret. The signature covers the request's method and
+// path, and each nonce is accepted once by all replicas together.
+func requireIdentity(secret []byte, nonceRepo nonce.Repository) gin.HandlerFunc {
+	nonces := &nonceTracker{repo: nonceRepo}
+	return func(c *gin.Context) {
+		userID := c.GetHeader(headerUserID)
+		roles := c.GetHeader(headerUserRoles)
+		ts := c.GetHeader(headerIdentityTimestamp)
+		nonce := c.GetHeader(headerIdentityNonce)
+		sig := c.GetHeader(headerIdentitySignature)
+		if userID == "" || ts == "" || nonce == "" || sig == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "missing identity"})
+			return
+		}
+
+		unix, err := strconv.ParseInt(ts, 10, 64)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid identity timestamp"})
+			return
+		}
+		if age := time.Since(time.Unix(unix, 0)); age > identityMaxSkew || age < -identityMaxSkew {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "identity expired"})
+			return
+		}
+
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(strings.Join([]string{userID, roles, ts, nonce, c.Request.Method, c.Request.URL.EscapedPath()}, "\n")))
+		expected := hex.EncodeToString(mac.Sum(nil))
+		if !hmac.Equal([]byte(expected), []byte(sig)) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid identity signature"})
+			return
+		}
+		fresh, err := nonces.use(c.Request.Context(), nonce, time.Now())
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "failed to check identity nonce"})
+			return
+		}
+		if !fresh {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "identity already used"})
+			return
+		}
+
+		id := identity{UserID: userID}
+		if roles != "" {
+			id.Roles = strings.Split(roles, ",")
+		}
+		c.Set(ctxIdentityKey, id)
+		c.Next()
+	}
+}
+
+// nonceTracker remembers the nonces of signed identities in the database,
+// shared by every replica, until their timestamp rejects them anyway: twice
+// identityMaxSkew, as a timestamp may be ahead of a replica's clock by up
+// to the skew.
+type nonceTracker struct {
+	repo nonce.Repository
+
+	mu        sync.Mutex
+	lastPrune time.Time
+}
+
+// use records nonce and reports whether no replica saw it before.
+func (n *nonceTracker) use(ctx context.Context, nonce string, now time.Time) (bool, error) {
+	n.mu.Lock()
+	prune := now.Sub(n.lastPrune) > identityMaxSkew
+	if prune {
+		n.lastPrune = now
+	}
+	n.mu.Unlock()
+	if prune {
+		// pruning is left to a later request if it fails
+		_, _ = n.repo.DeleteBefore(ctx, now.Add(-2*identityMaxSkew))
+	}
+	return n.repo.Use(ctx, nonce, now)
+}
+
+// requireAdmin rejects callers without the admin role. It must run after
+// requireIdentity.
+func requireAdmin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !callerIdentity(c).isAdmin() {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "admin role required"})
+			return
+		}
+		c.Next()
+	}
+}
+
+func callerIdentity(c *gin.Context) identity {
+	v, _ := c.Get(ctxIdentityKey)
+	id, _ := v.(identity)
+	return id
+}
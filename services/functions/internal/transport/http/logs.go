@@ -0,0 +1,152 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"platform/functions/internal/domain/job"
+	"platform/functions/internal/executor"
+)
+
+// logPollInterval is how often a followed job is re-read while it waits in
+// the queue or between its container exiting and its result being saved.
+const logPollInterval = 500 * time.Millisecond
+
+// streamJobLogs -> GET /jobs/:id/logs?follow=true
+// Streams the job's output as Server-Sent Events: "stdout" and "stderr"
+// events carry output, and a final "end" event carries the job status.
+// Finished jobs are served from the stored output. With follow=true a queued
+// or running job is streamed live until its container exits; a job claimed
+// by another replica cannot be attached to, so its stored output is sent
+// once it finishes.
+func (h *handler) streamJobLogs(c *gin.Context) {
+	j, ok := h.loadJob(c)
+	if !ok {
+		return
+	}
+	follow := c.Query("follow") == "true"
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	ctx := c.Request.Context()
+	stdout := &sseWriter{c: c, event: "stdout"}
+	stderr := &sseWriter{c: c, event: "stderr"}
+
+	var streamed bool
+	if follow {
+		var err error
+		j, streamed, err = h.followJob(ctx, j, stdout, stderr)
+		if err != nil {
+			writeEvent(c, "error", err.Error())
+			return
+		}
+		if j == nil {
+			return // client went away
+		}
+	} else if !j.IsFinished() {
+		// a snapshot of what the running container has written so far
+		err := h.logs.StreamLogs(ctx, j.ID, false, stdout, stderr)
+		if err != nil && !errors.Is(err, executor.ErrNotRunning) {
+			writeEvent(c, "error", err.Error())
+			return
+		}
+		streamed = err == nil
+	}
+
+	if !streamed {
+		stdout.Write([]byte(j.Stdout))
+		stderr.Write([]byte(j.Stderr))
+	}
+	writeEndEvent(c, j)
+}
+
+// followJob streams the job's container output until the job finishes. It
+// returns the finished job and whether its output was streamed live; a job
+// that finished before its container could be attached to is returned with
+// streamed false so the stored output is sent instead. A nil job means the
+// client disconnected.
+func (h *handler) followJob(ctx context.Context, j *job.Job, stdout, stderr *sseWriter) (*job.Job, bool, error) {
+	ticker := time.NewTicker(logPollInterval)
+	defer ticker.Stop()
+
+	var streamed bool
+	for !j.IsFinished() {
+		if !streamed {
+			err := h.logs.StreamLogs(ctx, j.ID, true, stdout, stderr)
+			switch {
+			case err == nil:
+				streamed = true
+			case !errors.Is(err, executor.ErrNotRunning):
+				return nil, false, err
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, false, nil
+		case <-ticker.C:
+		}
+
+		var err error
+		j, err = h.jobRepo.GetByID(ctx, j.ID)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, false, nil
+			}
+			return nil, false, err
+		}
+	}
+	return j, streamed, nil
+}
+
+// sseWriter sends everything written to it as events of one type.
+type sseWriter struct {
+	c     *gin.Context
+	event string
+}
+
+func (w *sseWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	writeEvent(w.c, w.event, string(p))
+	return len(p), nil
+}
+
+// writeEvent writes one event and flushes it. Every line of data gets its
+// own "data:" field, which clients join back together with newlines.
+func writeEvent(c *gin.Context, event, data string) {
+	var b strings.Builder
+	b.WriteString("event: ")
+	b.WriteString(event)
+	b.WriteByte('\n')
+	for _, line := range strings.Split(data, "\n") {
+		b.WriteString("data: ")
+		b.WriteString(line)
+		b.WriteByte('\n')
+	}
+	b.WriteByte('\n')
+	c.Writer.WriteString(b.String())
+	c.Writer.Flush()
+}
+
+func writeEndEvent(c *gin.Context, j *job.Job) {
+	data, _ := json.Marshal(gin.H{
+		"status":    j.Status,
+		"exit_code": j.ExitCode,
+		"truncated": j.Truncated,
+		"result":    j.Result,
+	})
+	writeEvent(c, "end", string(data))
+}
@@ -1,70 +1,175 @@
 package http
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 
+	"platform/functions/internal/domain/bundle"
 	"platform/functions/internal/domain/function"
 	"platform/functions/internal/domain/job"
+	"platform/functions/internal/domain/nonce"
 	"platform/functions/internal/executor"
+	"platform/functions/internal/runtimes"
 )
 
 func SetupRoutes(
 	r *gin.Engine,
 	funcRepo function.Repository,
 	jobRepo job.Repository,
+	bundleRepo bundle.Repository,
+	nonceRepo nonce.Repository,
 	execSvc *executor.Executor,
+	builds *executor.Builder,
+	collector *executor.Collector,
+	logSource executor.LogSource,
+	registry *runtimes.Registry,
+	limitCaps function.Limits,
+	identitySecret []byte,
 ) {
 	h := &handler{
-		funcRepo: funcRepo,
-		jobRepo:  jobRepo,
-		exec:     execSvc,
+		funcRepo:   funcRepo,
+		jobRepo:    jobRepo,
+		bundleRepo: bundleRepo,
+		exec:       execSvc,
+		builds:     builds,
+		collector:  collector,
+		logs:       logSource,
+		runtimes:   registry,
+		limitCaps:  limitCaps,
 	}
 
-	r.POST("/functions", h.createFunction)
-	r.GET("/functions", h.listFunctions)
+	api := r.Group("/")
+	api.Use(requireIdentity(identitySecret, nonceRepo))
+	{
+		api.GET("/runtimes", h.listRuntimes)
 
-	r.POST("/functions/:id/execute", h.executeFunction)
-	r.GET("/jobs/:id", h.getJob)
+		api.POST("/functions", h.createFunction)
+		api.GET("/functions", h.listFunctions)
+		api.GET("/functions/:id", h.getFunction)
+		api.PUT("/functions/:id", h.replaceFunction)
+		api.PATCH("/functions/:id", h.patchFunction)
+		api.DELETE("/functions/:id", h.deleteFunction)
+
+		api.GET("/functions/:id/versions", h.listVersions)
+		api.GET("/functions/:id/versions/:version", h.getVersion)
+		api.POST("/functions/:id/versions/:version/build", h.rebuildVersion)
+		api.GET("/functions/:id/aliases", h.listAliases)
+		api.PUT("/functions/:id/aliases/:name", h.setAlias)
+		api.DELETE("/functions/:id/aliases/:name", h.deleteAlias)
+
+		api.POST("/functions/:id/execute", h.executeFunction)
+		api.POST("/functions/:id/invoke", h.invokeFunction)
+		api.GET("/jobs/:id", h.getJob)
+		api.GET("/jobs/:id/logs", h.streamJobLogs)
+		api.POST("/jobs/:id/cancel", h.cancelJob)
+		api.GET("/jobs/:id/attempts", h.listJobAttempts)
+	}
+
+	admin := api.Group("/admin", requireAdmin())
+	{
+		admin.GET("/dead-letters", h.listDeadLetters)
+		admin.GET("/dead-letters/:id", h.getDeadLetter)
+		admin.POST("/dead-letters/requeue", h.requeueDeadLetters)
+		admin.POST("/dead-letters/purge", h.purgeDeadLetters)
+	}
+
+	// internal routes are called by other services and not exposed by the
+	// gateway; the callers sign their identity like the gateway does
+	internal := r.Group("/internal", requireIdentity(identitySecret, nonceRepo))
+	{
+		internal.DELETE("/owners/:owner/functions", h.deleteOwnerFunctions)
+	}
 }
 
 type handler struct {
-	funcRepo function.Repository
-	jobRepo  job.Repository
-	exec     *executor.Executor
+	funcRepo   function.Repository
+	jobRepo    job.Repository
+	bundleRepo bundle.Repository
+	exec       *executor.Executor
+	builds     *executor.Builder
+	collector  *executor.Collector
+	logs       executor.LogSource
+	runtimes   *runtimes.Registry
+	// limitCaps are the platform-wide maximums for function limits.
+	limitCaps function.Limits
 }
 
 // createFunction -> POST /functions
+// A bundle archive can be uploaded in place of the JSON body.
 func (h *handler) createFunction(c *gin.Context) {
+	if isBundleUpload(c) {
+		h.createBundleFunction(c)
+		return
+	}
 	var req struct {
-		Owner    string `json:"owner"`
-		Code     string `json:"code"`
-		Language string `json:"language"`
+		Code     string          `json:"code"`
+		Language string          `json:"language"`
+		Retry    json.RawMessage `json:"retry"`
+		Limits   json.RawMessage `json:"limits"`
+		Network  bool            `json:"network_access"`
+
+		FailureDestination json.RawMessage `json:"failure_destination"`
 	}
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid JSON"})
+	if err := c.ShouldBindJSON(&req); err != nil || req.Code == "" || req.Language == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "code and language are required"})
+		return
+	}
+
+	language, ok := h.resolveRuntime(c, req.Language)
+	if !ok {
 		return
 	}
-	fmt.Print(req)
+	fn := function.NewFunction(callerIdentity(c).UserID, req.Code, language)
+	fn.NetworkAccess = req.Network
+	fn.Limits = fn.Limits.Clamp(h.limitCaps)
+	if !applyRetryPolicy(c, fn, req.Retry) || !h.applyLimits(c, fn, req.Limits) ||
+		!h.applyFailureDestination(c, fn, req.FailureDestination) {
+		return
+	}
+	h.create(c, fn)
+}
 
-	fn := function.NewFunction(req.Owner, req.Code, req.Language)
+// create stores a new function and queues the build of its first version.
+// The function can run once the build is ready.
+func (h *handler) create(c *gin.Context, fn *function.Function) {
 	ctx := context.Background()
 	if err := h.funcRepo.Create(ctx, fn); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-
-	c.JSON(http.StatusCreated, gin.H{"function_id": fn.ID.String(), "status": "created"})
+	h.builds.Wake()
+	c.JSON(http.StatusCreated, gin.H{
+		"function_id":  fn.ID.String(),
+		"status":       "created",
+		"version":      fn.Version,
+		"build_status": function.BuildPending,
+	})
 }
 
 // listFunctions -> GET /functions
+// Admins see every function, everyone else only their own.
 func (h *handler) listFunctions(c *gin.Context) {
 	ctx := context.Background()
-	funcs, err := h.funcRepo.List(ctx)
+	caller := callerIdentity(c)
+
+	var funcs []function.Function
+	var err error
+	if caller.isAdmin() {
+		funcs, err = h.funcRepo.List(ctx)
+	} else {
+		funcs, err = h.funcRepo.ListByOwner(ctx, caller.UserID)
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -72,43 +177,709 @@ func (h *handler) listFunctions(c *gin.Context) {
 	c.JSON(http.StatusOK, funcs)
 }
 
-// executeFunction -> POST /functions/:id/execute
-func (h *handler) executeFunction(c *gin.Context) {
-	fnIDStr := c.Param("id")
-	fnID, err := uuid.Parse(fnIDStr)
+// getFunction -> GET /functions/:id
+func (h *handler) getFunction(c *gin.Context) {
+	fn, ok := h.loadFunction(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, fn)
+}
+
+// replaceFunction -> PUT /functions/:id
+// A bundle archive can be uploaded in place of the JSON body.
+func (h *handler) replaceFunction(c *gin.Context) {
+	if isBundleUpload(c) {
+		h.replaceBundle(c)
+		return
+	}
+	var req struct {
+		Code     string          `json:"code"`
+		Language string          `json:"language"`
+		Retry    json.RawMessage `json:"retry"`
+		Limits   json.RawMessage `json:"limits"`
+		Network  bool            `json:"network_access"`
+
+		FailureDestination json.RawMessage `json:"failure_destination"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.Code == "" || req.Language == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "code and language are required"})
+		return
+	}
+
+	language, ok := h.resolveRuntime(c, req.Language)
+	if !ok {
+		return
+	}
+	fn, ok := h.loadFunction(c)
+	if !ok {
+		return
+	}
+	fn.Update(req.Code, language)
+	// a replacement resets anything it leaves out to the defaults
+	fn.RetryPolicy = function.DefaultRetryPolicy()
+	fn.Limits = function.DefaultLimits().Clamp(h.limitCaps)
+	fn.NetworkAccess = req.Network
+	fn.FailureDestination = nil
+	if !applyRetryPolicy(c, fn, req.Retry) || !h.applyLimits(c, fn, req.Limits) ||
+		!h.applyFailureDestination(c, fn, req.FailureDestination) {
+		return
+	}
+	h.saveFunction(c, fn)
+}
+
+// patchFunction -> PATCH /functions/:id
+func (h *handler) patchFunction(c *gin.Context) {
+	var req struct {
+		Code     *string         `json:"code"`
+		Language *string         `json:"language"`
+		Retry    json.RawMessage `json:"retry"`
+		Limits   json.RawMessage `json:"limits"`
+		Network  *bool           `json:"network_access"`
+
+		FailureDestination json.RawMessage `json:"failure_destination"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid JSON"})
+		return
+	}
+	// fields that are present must be valid, as on create
+	if (req.Code != nil && *req.Code == "") || (req.Language != nil && *req.Language == "") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "code and language cannot be empty"})
+		return
+	}
+
+	fn, ok := h.loadFunction(c)
+	if !ok {
+		return
+	}
+	code, language := fn.Code, fn.Language
+	if req.Code != nil {
+		code = *req.Code
+	}
+	if req.Language != nil {
+		language, ok = h.resolveRuntime(c, *req.Language)
+		if !ok {
+			return
+		}
+	}
+	if fn.BundleDigest != nil && req.Code == nil {
+		// a bundle's runtime comes from its manifest
+		if req.Language != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "upload a new bundle to change the runtime of a bundled function"})
+			return
+		}
+	} else {
+		fn.Update(code, language)
+	}
+	if req.Network != nil {
+		fn.NetworkAccess = *req.Network
+	}
+	if !applyRetryPolicy(c, fn, req.Retry) || !h.applyLimits(c, fn, req.Limits) ||
+		!h.applyFailureDestination(c, fn, req.FailureDestination) {
+		return
+	}
+	h.saveFunction(c, fn)
+}
+
+// listRuntimes -> GET /runtimes
+func (h *handler) listRuntimes(c *gin.Context) {
+	c.JSON(http.StatusOK, h.runtimes.List())
+}
+
+// resolveRuntime returns the name of the runtime language names, which may
+// be an alias, writing the error response if there is no such runtime.
+func (h *handler) resolveRuntime(c *gin.Context, language string) (string, bool) {
+	rt, ok := h.runtimes.Lookup(language)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unsupported language %q, see GET /runtimes", language)})
+		return "", false
+	}
+	return rt.Name, true
+}
+
+// applyRetryPolicy merges the fields present in raw into fn's retry policy
+// and validates the result, writing the error response if it is invalid.
+func applyRetryPolicy(c *gin.Context, fn *function.Function, raw json.RawMessage) bool {
+	if len(raw) == 0 || string(raw) == "null" {
+		return true
+	}
+	policy := fn.RetryPolicy
+	if err := json.Unmarshal(raw, &policy); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid retry policy"})
+		return false
+	}
+	if err := policy.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return false
+	}
+	fn.RetryPolicy = policy
+	return true
+}
+
+// applyLimits merges the fields present in raw into fn's limits and checks
+// them against the platform caps, writing the error response if they are
+// invalid.
+func (h *handler) applyLimits(c *gin.Context, fn *function.Function, raw json.RawMessage) bool {
+	if len(raw) == 0 || string(raw) == "null" {
+		return true
+	}
+	limits := fn.Limits
+	if err := json.Unmarshal(raw, &limits); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid limits"})
+		return false
+	}
+	if err := limits.Validate(h.limitCaps); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return false
+	}
+	fn.Limits = limits
+	return true
+}
+
+// applyFailureDestination sets fn's failure destination from raw, a function
+// ID or null to clear it, writing the error response if it is not another
+// function of the same owner. An absent field leaves the destination as is.
+func (h *handler) applyFailureDestination(c *gin.Context, fn *function.Function, raw json.RawMessage) bool {
+	if len(raw) == 0 {
+		return true
+	}
+	if string(raw) == "null" {
+		fn.FailureDestination = nil
+		return true
+	}
+	var id string
+	if err := json.Unmarshal(raw, &id); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "failure_destination must be a function ID"})
+		return false
+	}
+	destID, err := uuid.Parse(id)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "failure_destination must be a function ID"})
+		return false
+	}
+	if destID == fn.ID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "a function cannot be its own failure destination"})
+		return false
+	}
+
+	ctx := context.Background()
+	dest, err := h.funcRepo.GetByID(ctx, destID)
+	if err != nil && err != function.ErrNotFound {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return false
+	}
+	if err != nil || dest.Owner != fn.Owner {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "failure destination not found"})
+		return false
+	}
+	fn.FailureDestination = &dest.ID
+	return true
+}
+
+// saveFunction stores fn. A change of code creates a new version, whose
+// build is queued.
+func (h *handler) saveFunction(c *gin.Context, fn *function.Function) {
+	ctx := context.Background()
+	if err := h.funcRepo.Update(ctx, fn); err != nil {
+		if err == function.ErrNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "function not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	h.builds.Wake()
+	c.JSON(http.StatusOK, fn)
+}
+
+// deleteFunction -> DELETE /functions/:id
+// The row is kept for history but the function disappears from every read,
+// so new executions are rejected with 404. Its images are removed in the
+// background.
+func (h *handler) deleteFunction(c *gin.Context) {
+	fn, ok := h.loadFunction(c)
+	if !ok {
+		return
+	}
+
+	ctx := context.Background()
+	if err := h.funcRepo.Delete(ctx, fn.ID); err != nil {
+		if err == function.ErrNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "function not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	h.collector.CollectFunction(fn.ID)
+	c.JSON(http.StatusOK, gin.H{"function_id": fn.ID.String(), "status": "deleted"})
+}
+
+// loadFunction resolves the :id parameter to a function the caller may
+// access, writing the error response when it cannot.
+func (h *handler) loadFunction(c *gin.Context) (*function.Function, bool) {
+	return h.findFunction(c, c.Param("id"))
+}
+
+func (h *handler) findFunction(c *gin.Context, id string) (*function.Function, bool) {
+	fnID, err := uuid.Parse(id)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid function ID"})
+		return nil, false
+	}
+
+	ctx := context.Background()
+	fn, err := h.funcRepo.GetByID(ctx, fnID)
+	if err != nil {
+		if err == function.ErrNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "function not found"})
+			return nil, false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	// other users' functions are reported as missing rather than forbidden
+	if !callerIdentity(c).canAccess(fn.Owner) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "function not found"})
+		return nil, false
+	}
+	return fn, true
+}
+
+// loadFunctionRef resolves an :id parameter of the form "<id>[@<qualifier>]",
+// where the qualifier is a version number or an alias name, to the function
+// and the version to run. Without a qualifier the latest version is used.
+func (h *handler) loadFunctionRef(c *gin.Context) (*function.Function, int, bool) {
+	id, qualifier, _ := strings.Cut(c.Param("id"), "@")
+	fn, ok := h.findFunction(c, id)
+	if !ok {
+		return nil, 0, false
+	}
+	if qualifier == "" {
+		return fn, fn.Version, true
+	}
+
+	ctx := context.Background()
+	if n, err := strconv.Atoi(qualifier); err == nil {
+		if _, err := h.funcRepo.GetVersion(ctx, fn.ID, n); err != nil {
+			writeVersionError(c, err)
+			return nil, 0, false
+		}
+		return fn, n, true
+	}
+
+	alias, err := h.funcRepo.GetAlias(ctx, fn.ID, qualifier)
+	if err != nil {
+		if err == function.ErrAliasNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "alias not found"})
+			return nil, 0, false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, 0, false
+	}
+	return fn, alias.Version, true
+}
+
+func writeVersionError(c *gin.Context, err error) {
+	if err == function.ErrVersionNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "version not found"})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+}
+
+// listVersions -> GET /functions/:id/versions
+func (h *handler) listVersions(c *gin.Context) {
+	fn, ok := h.loadFunction(c)
+	if !ok {
+		return
+	}
+	versions, err := h.funcRepo.ListVersions(context.Background(), fn.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, versions)
+}
+
+// getVersion -> GET /functions/:id/versions/:version
+func (h *handler) getVersion(c *gin.Context) {
+	n, err := strconv.Atoi(c.Param("version"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid version"})
+		return
+	}
+	fn, ok := h.loadFunction(c)
+	if !ok {
+		return
+	}
+	v, err := h.funcRepo.GetVersion(context.Background(), fn.ID, n)
+	if err != nil {
+		writeVersionError(c, err)
 		return
 	}
+	c.JSON(http.StatusOK, v)
+}
 
+// rebuildVersion -> POST /functions/:id/versions/:version/build
+// Queues another build of a version whose build finished, such as one that
+// failed on the platform after running out of attempts.
+func (h *handler) rebuildVersion(c *gin.Context) {
+	n, err := strconv.Atoi(c.Param("version"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid version"})
+		return
+	}
+	fn, ok := h.loadFunction(c)
+	if !ok {
+		return
+	}
 	ctx := context.Background()
-	// create a new job in "queued" state
-	newJob := job.NewJob(fnID)
-	if err := h.jobRepo.Create(ctx, newJob); err != nil {
+	if _, err := h.funcRepo.GetVersion(ctx, fn.ID, n); err != nil {
+		writeVersionError(c, err)
+		return
+	}
+	queued, err := h.funcRepo.RequeueBuild(ctx, fn.ID, n)
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	if !queued {
+		c.JSON(http.StatusConflict, gin.H{"error": "version is already being built"})
+		return
+	}
+	h.builds.Wake()
+	c.JSON(http.StatusAccepted, gin.H{"version": n, "build_status": function.BuildPending})
+}
 
-	// Enqueue to the Executor
-	h.exec.Enqueue(executor.ExecRequest{
-		JobID:      newJob.ID,
-		FunctionID: fnID,
-	})
+// listAliases -> GET /functions/:id/aliases
+func (h *handler) listAliases(c *gin.Context) {
+	fn, ok := h.loadFunction(c)
+	if !ok {
+		return
+	}
+	aliases, err := h.funcRepo.ListAliases(context.Background(), fn.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, aliases)
+}
+
+// setAlias -> PUT /functions/:id/aliases/:name
+// Creates the alias or moves it to another version, which is how a release
+// is promoted or rolled back.
+func (h *handler) setAlias(c *gin.Context) {
+	name := c.Param("name")
+	if !function.ValidAliasName(name) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid alias name"})
+		return
+	}
+	var req struct {
+		Version int `json:"version"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.Version < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "version is required"})
+		return
+	}
+
+	fn, ok := h.loadFunction(c)
+	if !ok {
+		return
+	}
+	ctx := context.Background()
+	if _, err := h.funcRepo.GetVersion(ctx, fn.ID, req.Version); err != nil {
+		writeVersionError(c, err)
+		return
+	}
+
+	alias := &function.Alias{
+		FunctionID: fn.ID,
+		Name:       name,
+		Version:    req.Version,
+		UpdatedAt:  time.Now(),
+	}
+	if err := h.funcRepo.SetAlias(ctx, alias); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, alias)
+}
+
+// deleteAlias -> DELETE /functions/:id/aliases/:name
+func (h *handler) deleteAlias(c *gin.Context) {
+	fn, ok := h.loadFunction(c)
+	if !ok {
+		return
+	}
+	if err := h.funcRepo.DeleteAlias(context.Background(), fn.ID, c.Param("name")); err != nil {
+		if err == function.ErrAliasNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "alias not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"name": c.Param("name"), "status": "deleted"})
+}
+
+// maxInputBytes caps the size of an execution's input payload.
+const maxInputBytes = 1 << 20
+
+// readInput reads the request body as the JSON input payload. An empty body
+// is passed to the function as null.
+func readInput(c *gin.Context) (json.RawMessage, bool) {
+	body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxInputBytes))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "input payload too large"})
+		} else {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "failed to read input"})
+		}
+		return nil, false
+	}
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 {
+		return nil, true
+	}
+	if !json.Valid(body) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "input must be valid JSON"})
+		return nil, false
+	}
+	return json.RawMessage(body), true
+}
+
+// createJob queues a job for the function reference in :id, using the
+// request body as its input. The jobs table is the queue, so the job can be
+// claimed by any replica as soon as it is stored. A job of a version that
+// is still being built waits in the queue for the build.
+func (h *handler) createJob(c *gin.Context) (*job.Job, bool) {
+	input, ok := readInput(c)
+	if !ok {
+		return nil, false
+	}
+	fn, version, ok := h.loadFunctionRef(c)
+	if !ok {
+		return nil, false
+	}
+
+	ctx := context.Background()
+	v, err := h.funcRepo.GetVersion(ctx, fn.ID, version)
+	if err != nil {
+		writeVersionError(c, err)
+		return nil, false
+	}
+	if v.BuildStatus == function.BuildFailed {
+		writeBuildFailed(c, v)
+		return nil, false
+	}
+
+	caller := callerIdentity(c)
+	// create a new job in "queued" state, pinned to the resolved version
+	newJob := job.NewJob(fn.ID, version, caller.UserID, input)
+	if err := h.jobRepo.Create(ctx, newJob); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	h.exec.Wake()
+	return newJob, true
+}
+
+// writeBuildFailed rejects running a version that failed to build.
+func writeBuildFailed(c *gin.Context, v *function.Version) {
+	msg := fmt.Sprintf("version %d failed to build: %s", v.Version, v.BuildError)
+	c.JSON(http.StatusConflict, gin.H{"error": msg, "build_status": v.BuildStatus})
+}
+
+// executeFunction -> POST /functions/:id[@version|@alias]/execute
+// The request body, if any, is the JSON input delivered to the function on
+// stdin.
+func (h *handler) executeFunction(c *gin.Context) {
+	newJob, ok := h.createJob(c)
+	if !ok {
+		return
+	}
 
 	// Return the job ID so client can poll
 	c.JSON(http.StatusAccepted, gin.H{
-		"job_id": newJob.ID.String(),
-		"status": "queued",
+		"job_id":  newJob.ID.String(),
+		"version": newJob.FunctionVersion,
+		"status":  "queued",
 	})
 }
 
+const (
+	defaultInvokeTimeout = 10 * time.Second
+	maxInvokeTimeout     = 30 * time.Second
+)
+
+// parseInvokeTimeout reads the ?timeout= parameter, given either as a
+// duration ("5s", "1500ms") or a number of seconds.
+func parseInvokeTimeout(raw string) (time.Duration, bool) {
+	if raw == "" {
+		return defaultInvokeTimeout, true
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil {
+		secs, convErr := strconv.Atoi(raw)
+		if convErr != nil {
+			return 0, false
+		}
+		d = time.Duration(secs) * time.Second
+	}
+	if d <= 0 || d > maxInvokeTimeout {
+		return 0, false
+	}
+	return d, true
+}
+
+// invokeFunction -> POST /functions/:id[@version|@alias]/invoke?timeout=10s
+// Runs the function like execute but waits for the job to finish and returns
+// it inline. If the timeout elapses first the job keeps running and a 202
+// with the job ID is returned so the caller can fall back to polling.
+func (h *handler) invokeFunction(c *gin.Context) {
+	timeout, ok := parseInvokeTimeout(c.Query("timeout"))
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "timeout must be between 1ms and " + maxInvokeTimeout.String()})
+		return
+	}
+
+	newJob, ok := h.createJob(c)
+	if !ok {
+		return
+	}
+
+	j, err := h.waitForJob(c.Request.Context(), newJob.ID, timeout)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !j.IsFinished() {
+		c.JSON(http.StatusAccepted, gin.H{
+			"job_id":  j.ID.String(),
+			"version": j.FunctionVersion,
+			"status":  j.Status,
+		})
+		return
+	}
+	c.JSON(http.StatusOK, j)
+}
+
+// invokePollInterval is how often an invoke re-reads its job, which catches
+// jobs run by another replica.
+const invokePollInterval = 250 * time.Millisecond
+
+// waitForJob returns the job once it has finished, or as it stands when the
+// timeout elapses or ctx ends.
+func (h *handler) waitForJob(ctx context.Context, jobID uuid.UUID, timeout time.Duration) (*job.Job, error) {
+	done, stop := h.exec.Watch(jobID)
+	defer stop()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	ticker := time.NewTicker(invokePollInterval)
+	defer ticker.Stop()
+
+	for {
+		j, err := h.jobRepo.GetByID(context.Background(), jobID)
+		if err != nil || j.IsFinished() {
+			return j, err
+		}
+		select {
+		case <-done:
+			// the job may have been queued again, as for a retry, so
+			// keep polling
+			done = nil
+		case <-ticker.C:
+		case <-timer.C:
+			return h.jobRepo.GetByID(context.Background(), jobID)
+		case <-ctx.Done():
+			return h.jobRepo.GetByID(context.Background(), jobID)
+		}
+	}
+}
+
 // getJob -> GET /jobs/:id
 func (h *handler) getJob(c *gin.Context) {
+	j, ok := h.loadJob(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, j)
+}
+
+// listJobAttempts -> GET /jobs/:id/attempts
+func (h *handler) listJobAttempts(c *gin.Context) {
+	j, ok := h.loadJob(c)
+	if !ok {
+		return
+	}
+	attempts, err := h.jobRepo.ListAttempts(context.Background(), j.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, attempts)
+}
+
+// cancelJob -> POST /jobs/:id/cancel
+// A queued job is cancelled at once and never runs. A running job has its
+// container killed; the executor then records it as cancelled, so 202 is
+// returned while that happens.
+func (h *handler) cancelJob(c *gin.Context) {
+	j, ok := h.loadJob(c)
+	if !ok {
+		return
+	}
+
+	ctx := context.Background()
+	if j.Status == job.StatusQueued {
+		j.MarkCancelled()
+		cancelled, err := h.jobRepo.UpdateIfStatus(ctx, j, job.StatusQueued)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if cancelled {
+			c.JSON(http.StatusOK, gin.H{"job_id": j.ID.String(), "status": j.Status})
+			return
+		}
+		// a worker started it in the meantime
+		if j, err = h.jobRepo.GetByID(ctx, j.ID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	if j.Status == job.StatusRunning {
+		// the job may be running on another replica, which picks up the
+		// flag set by RequestCancel
+		requested := h.exec.Cancel(j.ID)
+		if !requested {
+			var err error
+			requested, err = h.jobRepo.RequestCancel(ctx, j.ID)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+		}
+		if requested {
+			c.JSON(http.StatusAccepted, gin.H{"job_id": j.ID.String(), "status": "cancelling"})
+			return
+		}
+	}
+	c.JSON(http.StatusConflict, gin.H{"error": "job already finished", "status": j.Status})
+}
+
+// loadJob resolves the :id parameter to a job the caller may access,
+// writing the error response when it cannot.
+func (h *handler) loadJob(c *gin.Context) (*job.Job, bool) {
 	jobIDStr := c.Param("id")
 	jobID, err := uuid.Parse(jobIDStr)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid job ID"})
-		return
+		return nil, false
 	}
 
 	ctx := context.Background()
@@ -116,10 +887,43 @@ func (h *handler) getJob(c *gin.Context) {
 	if err != nil {
 		if err == job.ErrNotFound {
 			c.JSON(http.StatusNotFound, gin.H{"error": "job not found"})
-			return
+			return nil, false
 		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	if !callerIdentity(c).canAccess(j.Owner) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "job not found"})
+		return nil, false
+	}
+	return j, true
+}
+
+// deleteOwnerFunctions -> DELETE /internal/owners/:owner/functions
+// Running jobs of the owner are cancelled before their rows go, and the
+// owner's images are removed in the background.
+func (h *handler) deleteOwnerFunctions(c *gin.Context) {
+	owner := c.Param("owner")
+	if !callerIdentity(c).canAccess(owner) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "cannot delete the functions of another user"})
 		return
 	}
-	c.JSON(http.StatusOK, j)
+	// running jobs are stopped here or, on other replicas, once they find
+	// their rows flagged or gone
+	ctx := context.Background()
+	running, err := h.jobRepo.RequestCancelOwner(ctx, owner)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	for _, id := range running {
+		h.exec.Cancel(id)
+	}
+	n, err := h.funcRepo.DeleteByOwner(ctx, owner)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	h.collector.CollectOwner(owner)
+	c.JSON(http.StatusOK, gin.H{"deleted": n})
 }
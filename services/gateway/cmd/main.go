@@ -47,6 +47,32 @@ func main() {
 		public.POST("/register", forwardToAuthService)
 		public.POST("/login", forwardToAuthService)
 		public.POST("/refresh", forwardToAuthService)
+		public.GET("/login/oidc", forwardToAuthService)
+		public.GET("/login/oidc/callback", forwardToAuthService)
+
+		// account management authenticates with a Bearer token at the auth service
+		public.GET("/me", forwardToAuthService)
+		public.PATCH("/me", forwardToAuthService)
+		public.DELETE("/me", forwardToAuthService)
+		public.POST("/me/password", forwardToAuthService)
+		public.POST("/me/email/verify", forwardToAuthService)
+
+		// key management authenticates with a Bearer token at the auth service
+		public.POST("/api-keys", forwardToAuthService)
+		public.GET("/api-keys", forwardToAuthService)
+		public.DELETE("/api-keys/:id", forwardToAuthService)
+
+		// OpenID Connect provider endpoints
+		public.GET("/.well-known/openid-configuration", forwardToAuthService)
+		public.GET("/jwks", forwardToAuthService)
+		public.GET("/authorize", forwardToAuthService)
+		public.POST("/authorize", forwardToAuthService)
+		public.POST("/token", forwardToAuthService)
+		public.GET("/userinfo", forwardToAuthService)
+		public.POST("/userinfo", forwardToAuthService)
+		public.POST("/clients", forwardToAuthService)
+		public.POST("/introspect", forwardToAuthService)
+		public.POST("/revoke", forwardToAuthService)
 	}
 
 	protected := r.Group("/")
@@ -55,18 +81,34 @@ func main() {
 		protected.GET("/health", func(c *gin.Context) {
 			c.String(http.StatusOK, "API Gateway is healthy\n")
 		})
-		protected.Any("/functions", forwardToFunctionService)
-		protected.Any("/functions/*rest", forwardToFunctionService)
+		functions := protected.Group("/functions")
+		functions.Use(auth.RequireScope(functionScope))
+		{
+			functions.Any("", forwardToFunctionService)
+			functions.Any("/*rest", forwardToFunctionService)
+		}
+
+		protected.GET("/runtimes", auth.RequireScope(functionScope), forwardToFunctionService)
 
-		protected.Any("/jobs", forwardToFunctionService)
-		protected.Any("/jobs/*rest", forwardToFunctionService)
+		jobs := protected.Group("/jobs")
+		jobs.Use(auth.RequireScope(jobScope))
+		{
+			jobs.Any("", forwardToFunctionService)
+			jobs.Any("/*rest", forwardToFunctionService)
+		}
 
 		admin := protected.Group("/admin")
+		admin.Use(auth.RequireScope(adminScope))
 		admin.Use(auth.RequireRoles("admin"))
 		{
 			admin.GET("/dashboard", func(c *gin.Context) {
 				c.JSON(http.StatusOK, gin.H{"dashboard": "admin metrics"})
 			})
+			admin.GET("/users", forwardToAuthService)
+			admin.POST("/users/:id/disable", forwardToAuthService)
+			admin.POST("/users/:id/enable", forwardToAuthService)
+			admin.GET("/dead-letters", forwardToFunctionService)
+			admin.Any("/dead-letters/*rest", forwardToFunctionService)
 		}
 	}
 
@@ -94,9 +136,37 @@ func rateLimitMiddleware(rdb *redis.Client) gin.HandlerFunc {
 	return limitMW
 }
 
+// functionScope maps a /functions request to the API key scope it needs.
+func functionScope(c *gin.Context) string {
+	switch {
+	case strings.HasSuffix(c.Request.URL.Path, "/execute"),
+		strings.HasSuffix(c.Request.URL.Path, "/invoke"):
+		return "functions:execute"
+	case c.Request.Method == http.MethodGet:
+		return "functions:read"
+	default:
+		return "functions:write"
+	}
+}
+
+func jobScope(c *gin.Context) string {
+	if c.Request.Method == http.MethodGet {
+		return "jobs:read"
+	}
+	return "jobs:write"
+}
+
+// adminScope is never granted to API keys, so admin routes require a JWT.
+func adminScope(c *gin.Context) string {
+	return "admin"
+}
+
 func forwardToAuthService(c *gin.Context) {
 	path := strings.TrimPrefix(c.Request.URL.Path, "/auth")
 	targetURL := fmt.Sprintf("%s%s", authServiceURL, path)
+	if c.Request.URL.RawQuery != "" {
+		targetURL += "?" + c.Request.URL.RawQuery
+	}
 	log.Printf("Forwarding to Auth Service => %s", targetURL)
 
 	req, err := http.NewRequest(c.Request.Method, targetURL, c.Request.Body)
@@ -109,7 +179,13 @@ func forwardToAuthService(c *gin.Context) {
 		req.Header[k] = v
 	}
 
-	client := &http.Client{Timeout: 10 * time.Second}
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+		// pass redirects (e.g. from /authorize) back to the caller
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
 	resp, err := client.Do(req)
 	if err != nil {
 		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "auth service unreachable"})
@@ -134,7 +210,7 @@ func forwardToFunctionService(c *gin.Context) {
 
 	log.Printf("Forwarding to Function Service => %s", finalURL)
 
-	req, err := http.NewRequest(c.Request.Method, finalURL, c.Request.Body)
+	req, err := http.NewRequestWithContext(c.Request.Context(), c.Request.Method, finalURL, c.Request.Body)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create request"})
 		return
@@ -144,9 +220,9 @@ func forwardToFunctionService(c *gin.Context) {
 	for k, v := range c.Request.Header {
 		req.Header[k] = v
 	}
+	auth.SetIdentityHeaders(c, req)
 
-	client := &http.Client{Timeout: 15 * time.Second}
-	resp, err := client.Do(req)
+	resp, err := functionServiceClient.Do(req)
 	if err != nil {
 		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "function service unreachable"})
 		return
@@ -158,6 +234,41 @@ func forwardToFunctionService(c *gin.Context) {
 		c.Writer.Header()[k] = v
 	}
 
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		streamBody(c, resp.Body)
+		return
+	}
+
 	bodyBytes, _ := io.ReadAll(resp.Body)
 	c.Writer.Write(bodyBytes)
 }
+
+// functionServiceClient bounds the wait for response headers rather than the
+// whole exchange, so event streams can stay open. The limit is long enough
+// for a synchronous invoke, which may wait up to 30 seconds.
+var functionServiceClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		ResponseHeaderTimeout: 45 * time.Second,
+	},
+}
+
+// streamBody copies a streamed response to the client, flushing after every
+// read so events are delivered as they arrive.
+func streamBody(c *gin.Context, body io.Reader) {
+	c.Writer.WriteHeaderNow()
+	c.Writer.Flush()
+	buf := make([]byte, 4096)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if _, werr := c.Writer.Write(buf[:n]); werr != nil {
+				return
+			}
+			c.Writer.Flush()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+const APIKeyHeader = "X-API-Key"
+
+var authServiceURL = func() string {
+	if u := os.Getenv("AUTH_SERVICE_URL"); u != "" {
+		return u
+	}
+	return "http://auth:8081"
+}()
+
+var apiKeyClient = &http.Client{Timeout: 5 * time.Second}
+
+var errAuthUnavailable = errors.New("auth service unreachable")
+
+type apiKeyIdentity struct {
+	UserID string   `json:"user_id"`
+	Roles  []string `json:"roles"`
+	Scopes []string `json:"scopes"`
+}
+
+// verifyAPIKey asks the auth service to resolve an API key, since only it
+// holds the key hashes.
+func verifyAPIKey(key string) (*apiKeyIdentity, error) {
+	body, err := json.Marshal(map[string]string{"key": key})
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := apiKeyClient.Post(authServiceURL+"/internal/api-keys/verify", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errAuthUnavailable, err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized:
+		var errResp struct {
+			Error string `json:"error"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&errResp)
+		if errResp.Error == "" {
+			errResp.Error = "invalid api key"
+		}
+		return nil, errors.New(errResp.Error)
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("%w: verify returned %d", errAuthUnavailable, resp.StatusCode)
+	}
+
+	var identity apiKeyIdentity
+	if err := json.NewDecoder(resp.Body).Decode(&identity); err != nil {
+		return nil, fmt.Errorf("invalid verify response: %v", err)
+	}
+	return &identity, nil
+}
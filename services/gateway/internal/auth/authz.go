@@ -36,3 +36,28 @@ func RequireRoles(requiredRoles ...string) gin.HandlerFunc {
 		c.Next()
 	}
 }
+
+// RequireScope restricts API-key requests to keys holding the scope returned
+// by scopeFor. Requests authenticated with a JWT are not scoped.
+func RequireScope(scopeFor func(c *gin.Context) string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		scopesVal, exists := c.Get(CtxScopesKey)
+		if !exists {
+			c.Next()
+			return
+		}
+		scopes, ok := scopesVal.([]string)
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "invalid scopes format"})
+			return
+		}
+
+		required := scopeFor(c)
+		if !slices.Contains(scopes, required) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "api key missing scope " + required})
+			return
+		}
+
+		c.Next()
+	}
+}
@@ -15,9 +15,29 @@ var hmacSecret = []byte(os.Getenv("JWT_SECRET"))
 
 const CtxUserKey = "usedID"
 const CtxRolesKey = "roles"
+const CtxScopesKey = "scopes"
 
 func AuthMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
+		if apiKey := c.GetHeader(APIKeyHeader); apiKey != "" {
+			identity, err := verifyAPIKey(apiKey)
+			if err != nil {
+				status := http.StatusUnauthorized
+				if errors.Is(err, errAuthUnavailable) {
+					status = http.StatusServiceUnavailable
+				}
+				c.AbortWithStatusJSON(status, gin.H{"error": err.Error()})
+				return
+			}
+
+			c.Set(CtxUserKey, identity.UserID)
+			c.Set(CtxRolesKey, identity.Roles)
+			c.Set(CtxScopesKey, identity.Scopes)
+
+			c.Next()
+			return
+		}
+
 		authHeader := c.GetHeader("Authorization")
 		if authHeader == "" {
 			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "missing Authorization header"})
@@ -31,14 +51,24 @@ func AuthMiddleware() gin.HandlerFunc {
 		}
 
 		tokenString := parts[1]
-		claims, err := parseToken(tokenString)
-		if err != nil {
+		if _, err := parseToken(tokenString); err != nil {
 			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
 			return
 		}
+		// the signature and expiry are checked here, revocation and the
+		// user's current state only by the auth service
+		identity, err := checkToken(tokenString)
+		if err != nil {
+			status := http.StatusUnauthorized
+			if errors.Is(err, errAuthUnavailable) {
+				status = http.StatusServiceUnavailable
+			}
+			c.AbortWithStatusJSON(status, gin.H{"error": err.Error()})
+			return
+		}
 
-		c.Set(CtxUserKey, claims.UserID)
-		c.Set(CtxRolesKey, claims.Roles)
+		c.Set(CtxUserKey, identity.UserID)
+		c.Set(CtxRolesKey, identity.Roles)
 
 		c.Next()
 	}
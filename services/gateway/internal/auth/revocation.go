@@ -0,0 +1,96 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// tokenCheckTTL is how long the gateway trusts the auth service's answer for
+// an access token, and so the longest a revoked token or a disabled user
+// keeps working at the edge.
+const tokenCheckTTL = 30 * time.Second
+
+// maxCachedTokens bounds the token check cache; it is emptied when full.
+const maxCachedTokens = 10000
+
+type tokenIdentity struct {
+	UserID string   `json:"user_id"`
+	Roles  []string `json:"roles"`
+}
+
+type cachedToken struct {
+	identity  *tokenIdentity
+	err       error
+	expiresAt time.Time
+}
+
+var tokenCache = struct {
+	sync.Mutex
+	entries map[[32]byte]cachedToken
+}{entries: make(map[[32]byte]cachedToken)}
+
+// checkToken asks the auth service whether a locally valid access token was
+// revoked or its user disabled, caching the answer for tokenCheckTTL.
+func checkToken(token string) (*tokenIdentity, error) {
+	key := sha256.Sum256([]byte(token))
+	now := time.Now()
+
+	tokenCache.Lock()
+	entry, ok := tokenCache.entries[key]
+	tokenCache.Unlock()
+	if ok && now.Before(entry.expiresAt) {
+		return entry.identity, entry.err
+	}
+
+	identity, err := verifyToken(token)
+	if errors.Is(err, errAuthUnavailable) {
+		return nil, err
+	}
+
+	tokenCache.Lock()
+	if len(tokenCache.entries) >= maxCachedTokens {
+		tokenCache.entries = make(map[[32]byte]cachedToken)
+	}
+	tokenCache.entries[key] = cachedToken{identity: identity, err: err, expiresAt: now.Add(tokenCheckTTL)}
+	tokenCache.Unlock()
+	return identity, err
+}
+
+func verifyToken(token string) (*tokenIdentity, error) {
+	body, err := json.Marshal(map[string]string{"token": token})
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := apiKeyClient.Post(authServiceURL+"/internal/tokens/verify", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errAuthUnavailable, err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized:
+		var errResp struct {
+			Error string `json:"error"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&errResp)
+		if errResp.Error == "" {
+			errResp.Error = "invalid token"
+		}
+		return nil, errors.New(errResp.Error)
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("%w: verify returned %d", errAuthUnavailable, resp.StatusCode)
+	}
+
+	var identity tokenIdentity
+	if err := json.NewDecoder(resp.Body).Decode(&identity); err != nil {
+		return nil, fmt.Errorf("%w: invalid verify response: %v", errAuthUnavailable, err)
+	}
+	return &identity, nil
+}